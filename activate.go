@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// "gdoh activate" points the operating system's resolver at
+// 127.0.0.1, "gdoh deactivate" puts back whatever was there before.
+// Both need root, same as listening on :53 does.
+
+// ErrAlreadyActive is returned when activate finds its own backup of
+// the previous settings; activating twice would "save" 127.0.0.1 as
+// the thing to restore.
+var ErrAlreadyActive = errors.New("Already active (run deactivate first)")
+
+// ErrNotActive is returned by deactivate if there is nothing to undo.
+var ErrNotActive = errors.New("Not active")
+
+const (
+	// macOS: JSON map of network service name -> DNS servers.
+	darwinState = "/var/db/gdoh.dns-backup.json"
+	// systemd-resolved drop-in, removed on deactivate.
+	resolvedDropIn = "/etc/systemd/resolved.conf.d/gdoh.conf"
+	// openresolv/resolvconf "interface" name; "lo." sorts it first.
+	resolvconfIface = "lo.gdoh"
+	// Last resort: we overwrite resolv.conf and keep a copy here.
+	resolvConf       = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.gdoh-backup"
+)
+
+func activate() error {
+	switch runtime.GOOS {
+	case "darwin":
+		return activateDarwin()
+	case "linux":
+		return activateLinux()
+	}
+	return fmt.Errorf("activate: unsupported OS: %s", runtime.GOOS)
+}
+
+func deactivate() error {
+	switch runtime.GOOS {
+	case "darwin":
+		return deactivateDarwin()
+	case "linux":
+		return deactivateLinux()
+	}
+	return fmt.Errorf("deactivate: unsupported OS: %s", runtime.GOOS)
+}
+
+// run runs a command, folding its output into the error (if any), so
+// that the user sees why e.g. networksetup was unhappy.
+func run(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s",
+			name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// networkServices lists macOS network services ("Wi-Fi",
+// "Ethernet", ...), including disabled ones - they may get enabled
+// while we're active.
+func networkServices() ([]string, error) {
+	out, err := run("", "networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	services := []string{}
+	// The first line is "An asterisk (*) denotes that a network
+	// service is disabled."
+	for _, line := range lines[1:] {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "*")
+		if line != "" {
+			services = append(services, line)
+		}
+	}
+	return services, nil
+}
+
+func activateDarwin() error {
+	if exists(darwinState) {
+		return ErrAlreadyActive
+	}
+	services, err := networkServices()
+	if err != nil {
+		return err
+	}
+	saved := map[string][]string{}
+	for _, svc := range services {
+		out, err := run("", "networksetup", "-getdnsservers", svc)
+		if err != nil {
+			return err
+		}
+		// Either a list of addresses, or "There aren't any DNS
+		// Servers set on Wi-Fi."
+		servers := []string{}
+		for _, f := range strings.Fields(out) {
+			if net.ParseIP(f) != nil {
+				servers = append(servers, f)
+			}
+		}
+		saved[svc] = servers
+	}
+	state, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(darwinState, state, 0644); err != nil {
+		return err
+	}
+	for _, svc := range services {
+		if _, err := run("", "networksetup",
+			"-setdnsservers", svc, "127.0.0.1"); err != nil {
+			return err
+		}
+		log.Printf("activated: %s", svc)
+	}
+	return flushDarwin()
+}
+
+func deactivateDarwin() error {
+	state, err := ioutil.ReadFile(darwinState)
+	if os.IsNotExist(err) {
+		return ErrNotActive
+	}
+	if err != nil {
+		return err
+	}
+	saved := map[string][]string{}
+	if err := json.Unmarshal(state, &saved); err != nil {
+		return err
+	}
+	for svc, servers := range saved {
+		if len(servers) == 0 {
+			// Back to whatever DHCP says.
+			servers = []string{"Empty"}
+		}
+		args := append([]string{"-setdnsservers", svc}, servers...)
+		if _, err := run("", "networksetup", args...); err != nil {
+			// The service may be gone by now; restore the rest.
+			log.Print("deactivate error:", err.Error())
+			continue
+		}
+		log.Printf("deactivated: %s", svc)
+	}
+	if err := os.Remove(darwinState); err != nil {
+		return err
+	}
+	return flushDarwin()
+}
+
+func flushDarwin() error {
+	if _, err := run("", "dscacheutil", "-flushcache"); err != nil {
+		return err
+	}
+	_, err := run("", "killall", "-HUP", "mDNSResponder")
+	return err
+}
+
+// usesResolved guesses whether systemd-resolved manages DNS here.
+func usesResolved() bool {
+	return exists("/run/systemd/resolve")
+}
+
+func activateLinux() error {
+	switch {
+	case usesResolved():
+		if exists(resolvedDropIn) {
+			return ErrAlreadyActive
+		}
+		if err := os.MkdirAll("/etc/systemd/resolved.conf.d",
+			0755); err != nil {
+			return err
+		}
+		// "~." makes this the DNS server for all domains, not
+		// just a fallback next to the one(s) from DHCP.
+		conf := "# Written by gdoh activate\n" +
+			"[Resolve]\nDNS=127.0.0.1\nDomains=~.\n"
+		if err := ioutil.WriteFile(resolvedDropIn,
+			[]byte(conf), 0644); err != nil {
+			return err
+		}
+		_, err := run("", "systemctl", "restart", "systemd-resolved")
+		return err
+	case hasResolvconf():
+		_, err := run("nameserver 127.0.0.1\n",
+			"resolvconf", "-a", resolvconfIface)
+		return err
+	default:
+		if exists(resolvConfBackup) {
+			return ErrAlreadyActive
+		}
+		if err := os.Rename(resolvConf, resolvConfBackup); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(resolvConf, []byte(
+			"# Written by gdoh activate\nnameserver 127.0.0.1\n",
+		), 0644)
+	}
+}
+
+func deactivateLinux() error {
+	switch {
+	case exists(resolvedDropIn):
+		if err := os.Remove(resolvedDropIn); err != nil {
+			return err
+		}
+		_, err := run("", "systemctl", "restart", "systemd-resolved")
+		return err
+	case exists(resolvConfBackup):
+		return os.Rename(resolvConfBackup, resolvConf)
+	case hasResolvconf():
+		_, err := run("", "resolvconf", "-d", resolvconfIface)
+		return err
+	}
+	return ErrNotActive
+}
+
+func hasResolvconf() bool {
+	_, err := exec.LookPath("resolvconf")
+	return err == nil
+}
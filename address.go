@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dnsmasq's address=/example.com/10.0.0.5: the domain, and all its
+// subdomains, resolve to that address. With no address
+// (address=/example.com/), they're NXDOMAIN; with "#", the null
+// address, 0.0.0.0 and ::. As in a dnsmasq.conf, several domains can
+// share one line (/a.example/b.example/10.0.0.5), and in a -config
+// file, "address=/example.com/10.0.0.5" works as it is.
+//
+// Questions for the family the rule doesn't give get an empty
+// answer, rather than going upstream.
+
+var addressFlags = &stringsFlag{}
+
+func init() {
+	addressFlags.check = func(v string) error {
+		return newAddressRules().load([]string{v})
+	}
+	flag.Var(addressFlags, "address",
+		"Fixed address for domains and their subdomains, dnsmasq style: /DOMAIN/[DOMAIN/...][ADDRESS|#] (repeatable)")
+}
+
+type addressRule struct {
+	addrs    []net.IP
+	nxdomain bool
+}
+
+type addressRules map[string]*addressRule // domain -> rule
+
+var addresses = newAddressRules()
+
+func newAddressRules() addressRules {
+	return addressRules{}
+}
+
+func (ar addressRules) load(values []string) error {
+	for _, v := range values {
+		parts := strings.Split(v, "/")
+		if len(parts) < 3 || parts[0] != "" {
+			return fmt.Errorf("-address %s: want /DOMAIN/[ADDRESS]", v)
+		}
+		var addrs []net.IP
+		switch to := parts[len(parts)-1]; to {
+		case "":
+		case "#":
+			addrs = []net.IP{net.IPv4zero, net.IPv6zero}
+		default:
+			ip := net.ParseIP(to)
+			if ip == nil {
+				return fmt.Errorf("-address %s: bad address %s", v, to)
+			}
+			addrs = []net.IP{ip}
+		}
+		for _, domain := range parts[1 : len(parts)-1] {
+			if domain == "" {
+				return fmt.Errorf("-address %s: empty domain", v)
+			}
+			domain = normalizeName(domain)
+			rule, ok := ar[domain]
+			if !ok {
+				rule = &addressRule{}
+				ar[domain] = rule
+			}
+			if addrs == nil {
+				rule.nxdomain = true
+			}
+			rule.addrs = append(rule.addrs, addrs...)
+		}
+	}
+	return nil
+}
+
+// answer answers for the most specific rule matching the question.
+func (ar addressRules) answer(q *dnsMsg) (*dnsMsg, bool) {
+	question := q.Question[0]
+	if len(ar) == 0 || question.Class != classINET {
+		return nil, false
+	}
+	for _, parent := range parentNames(question.Name) {
+		rule, ok := ar[parent]
+		if !ok {
+			continue
+		}
+		if rule.nxdomain && len(rule.addrs) == 0 {
+			return reply(q, rcodeNXDomain), true
+		}
+		r := reply(q, rcodeSuccess)
+		for _, ip := range rule.addrs {
+			type_ := uint16(typeAAAA)
+			if ip.To4() != nil {
+				type_ = typeA
+			}
+			if question.Type == type_ || question.Type == typeANY {
+				r.Answer = append(r.Answer, dnsRR{Name: question.Name,
+					Type: type_, Class: classINET, TTL: rewriteTTL,
+					Data: addrData(ip, type_)})
+			}
+		}
+		return r, true
+	}
+	return nil, false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin API: a handful of JSON endpoints to look at and poke the
+// running resolver. Every request must carry the token, either as
+// "Authorization: Bearer <token>", or as the password in basic auth
+// (so that it also works from a browser). The exceptions are the
+// health checks, meant for Kubernetes probes and alike.
+//
+//	GET    /healthz                     200 if we're alive
+//	GET    /readyz                      200 if we can answer queries
+//	GET    /                            the dashboard
+//	GET    /api/stats[?n=10]            counters, last hour's top n
+//	GET    /api/endpoints               endpoints and their health
+//	GET    /api/recent[?n=50]           the last n queries
+//	GET    /api/top[?n=10]              just the last hour's top n
+//	POST   /api/cache/flush[?name=N]    flush the cache (or just N)
+//	GET    /api/blocklist[?name=N]      lists (or whether N is blocked)
+//	POST   /api/blocklist?name=N        block N
+//	DELETE /api/blocklist?name=N        unblock N (added via the API)
+//	GET    /api/filtering               is filtering enabled?
+//	POST   /api/filtering?enabled=B     enable/disable filtering
+//	POST   /api/pause?for=D             disable filtering for a while
+
+var admin = flag.String("admin", "",
+	"HTTP address for the admin API, e.g. 127.0.0.1:8053 (off by default)")
+var adminToken = flag.String("admin-token", "",
+	"Token required by the admin API")
+
+func serveAdmin(ln net.Listener) {
+	if *adminToken == "" {
+		log.Fatal("The admin API needs -admin-token")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", adminDashboard)
+	mux.HandleFunc("/api/stats", adminStats)
+	mux.HandleFunc("/api/endpoints", adminEndpoints)
+	mux.HandleFunc("/api/recent", adminRecent)
+	mux.HandleFunc("/api/top", adminTop)
+	mux.HandleFunc("/api/cache/flush", adminFlush)
+	mux.HandleFunc("/api/blocklist", adminBlocklist)
+	mux.HandleFunc("/api/blocklist/reload", adminReloadLists)
+	mux.HandleFunc("/api/filtering", adminFiltering)
+	mux.HandleFunc("/api/pause", adminPause)
+	mux.HandleFunc("/api/passive", adminPassive)
+	mux.HandleFunc("/api/vpn", adminVPN)
+	mux.HandleFunc("/metrics", adminMetrics)
+	public := http.NewServeMux()
+	public.HandleFunc("/healthz", adminHealthz)
+	public.HandleFunc("/readyz", adminReadyz)
+	public.Handle("/", authorized(mux))
+	log.Printf("Admin API on %s", *admin)
+	if err := http.Serve(ln, public); !stopping() {
+		log.Fatal(err)
+	}
+}
+
+func authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare(
+			[]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gdoh"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allow checks the request method, responding with an error if it's
+// not one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print("admin error:", err.Error())
+	}
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"counters":      stats.snapshot(),
+		"cache_entries": responseCache.len(),
+		"cache":         responseCache.stats(),
+		"last_hour":     aggregated.report(intParam(r, "n", 10)),
+		"block_types":   typeBlockStats(),
+	})
+}
+
+func adminEndpoints(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	writeJSON(w, dohClient.health.snapshot(dohClient.endpoints()))
+}
+
+func adminFlush(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	n := responseCache.flush(r.FormValue("name"))
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+func adminBlocklist(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" && r.Method != "GET" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == "POST":
+		blocked.add(name)
+	case r.Method == "DELETE":
+		if !blocked.remove(name) {
+			http.Error(w, "Not blocked via the API",
+				http.StatusNotFound)
+			return
+		}
+	case name == "":
+		writeJSON(w, blocked.summary())
+		return
+	}
+	source, ok := blocked.match(name)
+	if ip := net.ParseIP(r.FormValue("client")); ip != nil {
+		// As that client would see it.
+		source, ok = blocked.matchClient(name, &net.IPAddr{IP: ip})
+	}
+	writeJSON(w, map[string]interface{}{
+		"name":    normalizeName(name),
+		"blocked": ok,
+		"source":  source,
+	})
+}
+
+func adminReloadLists(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	if err := blocked.load(blockFiles.values); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, blocked.summary())
+}
+
+func adminFiltering(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "Bad value for enabled",
+				http.StatusBadRequest)
+			return
+		}
+		blocked.setEnabled(enabled)
+	}
+	writeFiltering(w)
+}
+
+func writeFiltering(w http.ResponseWriter) {
+	v := map[string]interface{}{"enabled": blocked.isEnabled()}
+	if until, ok := blocked.paused(); ok {
+		v["paused_until"] = until
+	}
+	writeJSON(w, v)
+}
+
+func adminPause(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("for"))
+	if err != nil || d < 0 {
+		http.Error(w, "Bad value for for", http.StatusBadRequest)
+		return
+	}
+	until := blocked.pause(d)
+	if d > 0 {
+		log.Printf("filtering paused until %s", until.Format(time.Stamp))
+	}
+	writeFiltering(w)
+}
+
+// adminCall calls the admin API of a running gdoh (per -admin and
+// -admin-token), for the CLI.
+func adminCall(method, path string, params url.Values) ([]byte, error) {
+	if *admin == "" {
+		return nil, errors.New("Need -admin to reach the admin API")
+	}
+	host, port, err := net.SplitHostPort(*admin)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(host, port),
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := secret(*adminToken)
+	if err != nil {
+		return nil, fmt.Errorf("-admin-token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, r.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// pauseCommand implements "gdoh pause 10m".
+func pauseCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: gdoh pause DURATION")
+	}
+	body, err := adminCall("POST", "/api/pause",
+		url.Values{"for": {args[0]}})
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	return nil
+}
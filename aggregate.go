@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Rolling counters over the last hour, in 5 minute buckets: what's
+// being asked, by whom, and how it turned out.
+
+const (
+	bucketLength = 5 * time.Minute
+	bucketCount  = 12
+	// Cap on distinct keys per bucket, so that a client walking
+	// random names can't eat all our memory; the excess is counted
+	// under "(other)".
+	bucketKeys = 10000
+)
+
+type bucket struct {
+	slot   int64
+	counts map[string]int
+}
+
+type rollingCounter struct {
+	sync.Mutex
+	buckets [bucketCount]bucket
+}
+
+func (rc *rollingCounter) add(key string, now time.Time) {
+	slot := now.UnixNano() / int64(bucketLength)
+	rc.Lock()
+	defer rc.Unlock()
+	b := &rc.buckets[slot%bucketCount]
+	if b.slot != slot || b.counts == nil {
+		b.slot = slot
+		b.counts = map[string]int{}
+	}
+	if _, ok := b.counts[key]; !ok && len(b.counts) >= bucketKeys {
+		key = "(other)"
+	}
+	b.counts[key]++
+}
+
+// sum adds up the buckets still in the window.
+func (rc *rollingCounter) sum(now time.Time) map[string]int {
+	slot := now.UnixNano() / int64(bucketLength)
+	rc.Lock()
+	defer rc.Unlock()
+	counts := map[string]int{}
+	for _, b := range rc.buckets {
+		if b.slot > slot-bucketCount {
+			for key, n := range b.counts {
+				counts[key] += n
+			}
+		}
+	}
+	return counts
+}
+
+type aggregates struct {
+	domains, blocked, qtypes, rcodes, clients rollingCounter
+}
+
+var aggregated = &aggregates{}
+
+func (a *aggregates) add(e queryEntry) {
+	a.domains.add(e.Name, e.Time)
+	if e.Outcome == outcomeBlocked {
+		a.blocked.add(e.Name, e.Time)
+	}
+	a.qtypes.add(e.Type, e.Time)
+	a.rcodes.add(rcodeName(e.Rcode), e.Time)
+	a.clients.add(clientHost(e.Client), e.Time)
+}
+
+type aggregateReport struct {
+	Domains []nameCount       `json:"domains"`
+	Blocked []nameCount       `json:"blocked"`
+	Clients []nameCount       `json:"clients"`
+	Devices map[string]string `json:"devices,omitempty"`
+	Qtypes  map[string]int    `json:"qtypes"`
+	Rcodes  map[string]int    `json:"rcodes"`
+}
+
+// report returns the top n domains, blocked domains and clients, and
+// the full qtype/rcode distributions.
+func (a *aggregates) report(n int) aggregateReport {
+	now := time.Now()
+	report := aggregateReport{
+		Domains: top(a.domains.sum(now), n),
+		Blocked: top(a.blocked.sum(now), n),
+		Clients: top(a.clients.sum(now), n),
+		Qtypes:  a.qtypes.sum(now),
+		Rcodes:  a.rcodes.sum(now),
+	}
+	// The names of the top clients, as of now.
+	for _, nc := range report.Clients {
+		if name := dhcpLeases.name(nc.Name); name != "" {
+			if report.Devices == nil {
+				report.Devices = map[string]string{}
+			}
+			report.Devices[nc.Name] = name
+		}
+	}
+	return report
+}
+
+// dumpStats writes everything we know to the log (on SIGUSR1).
+func dumpStats() {
+	b, err := json.Marshal(map[string]interface{}{
+		"counters":      stats.snapshot(),
+		"cache_entries": responseCache.len(),
+		"last_hour":     aggregated.report(20),
+	})
+	if err != nil {
+		log.Print("stats error:", err.Error())
+		return
+	}
+	log.Printf("stats: %s", b)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alerts: when things go wrong (and when they get better), POST a
+// JSON event to a webhook, and/or run a command with the event in
+// its environment (GDOH_EVENT, GDOH_MESSAGE, and GDOH_<DETAIL> for
+// any details).
+
+var alertWebhook = flag.String("alert-webhook", "",
+	"URL to POST alert events to")
+var alertExec = flag.String("alert-exec", "",
+	"Shell command to run on alert events")
+var alertErrorRate = flag.Float64("alert-error-rate", 0.5,
+	"Alert when this fraction of upstream queries fail (0 disables)")
+
+// How often to look at the stats, and how many upstream queries we
+// need to see in that time before trusting the error rate.
+const (
+	alertInterval   = 10 * time.Second
+	alertMinQueries = 10
+)
+
+type alertEvent struct {
+	Event   string            `json:"event"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func alertsEnabled() bool {
+	return *alertWebhook != "" || *alertExec != ""
+}
+
+// alert logs an event, and sends it on to the hooks, in the
+// background.
+func alert(event, message string, details map[string]string) {
+	log.Printf("alert: %s: %s", event, message)
+	if !alertsEnabled() {
+		return
+	}
+	e := alertEvent{event, message, time.Now(), details}
+	go func() {
+		if *alertWebhook != "" {
+			if err := postAlert(e); err != nil {
+				log.Print("alert error:", err.Error())
+			}
+		}
+		if *alertExec != "" {
+			if err := execAlert(e); err != nil {
+				log.Print("alert error:", err.Error())
+			}
+		}
+	}()
+}
+
+func postAlert(e alertEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Through the system resolver, rather than ourselves: this is
+	// about us having trouble.
+	r, err := http.Post(*alertWebhook, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", r.Status)
+	}
+	return nil
+}
+
+func execAlert(e alertEvent) error {
+	cmd := exec.Command("sh", "-c", *alertExec)
+	cmd.Env = append(os.Environ(),
+		"GDOH_EVENT="+e.Event,
+		"GDOH_MESSAGE="+e.Message,
+	)
+	for k, v := range e.Details {
+		cmd.Env = append(cmd.Env, "GDOH_"+strings.ToUpper(k)+"="+v)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// watchHealth periodically checks on the endpoints and the error
+// rate, and raises alerts when they change state.
+func watchHealth() {
+	var down, failing, stale bool
+	last := stats.snapshot()
+	for range backgroundTick(alertInterval) {
+		now := stats.snapshot()
+		queries := now.CacheMisses - last.CacheMisses
+		failed := now.Errors - last.Errors
+		hits := now.CacheHits - last.CacheHits
+		last = now
+
+		allDown := true
+		for _, h := range dohClient.health.snapshot(dohClient.endpoints()) {
+			allDown = allDown && !h.Healthy
+		}
+		switch {
+		case allDown && !down:
+			alert("upstreams_down", "All endpoints are unhealthy", nil)
+		case !allDown && down:
+			alert("upstreams_up", "Endpoints are back", nil)
+			stale = false
+		}
+		down = allDown
+		if down && hits > 0 && !stale {
+			alert("serving_from_cache",
+				"Answering from the cache only, upstreams are down",
+				nil)
+			stale = true
+		}
+
+		if *alertErrorRate <= 0 || queries < alertMinQueries {
+			continue
+		}
+		rate := float64(failed) / float64(queries)
+		details := map[string]string{
+			"error_rate": strconv.FormatFloat(rate, 'f', 3, 64),
+		}
+		switch {
+		case rate >= *alertErrorRate && !failing:
+			alert("error_rate", "Upstream error rate is "+
+				formatFloat(rate*100)+"%", details)
+			failing = true
+		case rate < *alertErrorRate && failing:
+			alert("error_rate_ok", "Upstream error rate is back to "+
+				formatFloat(rate*100)+"%", details)
+			failing = false
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 1, 64)
+}
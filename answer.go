@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var queryTimeout = flag.Duration("query-timeout", 4*time.Second,
+	"Give up on a query after this long (stubs usually stop waiting at 5s)")
+
+// answer returns the response to send back to the client: from the
+// blocklist, the cache, or upstream, in this order.
+func answer(query []byte, client net.Addr) []byte {
+	atomic.AddInt64(&stats.Queries, 1)
+	queried()
+	// Everything it takes to answer has to fit in here: once the
+	// client has given up, there's no point.
+	ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
+	defer cancel()
+	if len(query) >= 4 && (query[2]>>3)&0xf == opcodeUpdate {
+		return dynamicZone.update(query, client)
+	}
+	q, err := parseMsg(query)
+	if err != nil || len(q.Question) != 1 {
+		// Not something we understand; let upstream deal with it.
+		resp, _, _ := forward(ctx, query, "", client, nil)
+		return resp
+	}
+	client, stripped := identify(q, client)
+	if stripped {
+		query = q.pack()
+	}
+	var t *queryTrace
+	if traced(q.Question[0].Name) {
+		ctx, t = withTrace(ctx)
+	}
+	if _, ok := client.(*identifiedAddr); ok {
+		tracef(ctx, "client: %s", describeClient(client))
+	}
+	start := time.Now()
+	resp, outcome := resolve(ctx, q, query, client)
+	if t != nil {
+		tracef(ctx, "done: %s", outcome)
+		logTrace(t, q.Question[0], client)
+	}
+	e := queryEntry{
+		Time:     start,
+		Client:   client.String(),
+		Device:   deviceFor(client),
+		Name:     q.Question[0].Name,
+		Type:     typeName(q.Question[0].Type),
+		Outcome:  outcome,
+		Duration: time.Since(start).Seconds() * 1000,
+	}
+	if len(resp) >= 4 {
+		e.Rcode = int(resp[3] & 0xf)
+	}
+	recent.add(e)
+	queryLog.add(e)
+	aggregated.add(e)
+	statsd.add(e)
+	watched.check(e)
+	return resp
+}
+
+func resolve(ctx context.Context, q *dnsMsg, query []byte, client net.Addr) ([]byte, string) {
+	question := q.Question[0]
+	tracef(ctx, "question: %s %s %s, from %s, id %d", question.Name,
+		className(question.Class), typeName(question.Type), client, q.ID)
+	if b := matchTypeBlock(question.Type, client); b != nil {
+		tracef(ctx, "blocked: -block-type %s", b.rule)
+		atomic.AddInt64(&stats.Blocked, 1)
+		if b.nodata {
+			return reply(q, rcodeSuccess).pack(), outcomeBlocked
+		}
+		return reply(q, rcodeRefused).pack(), outcomeBlocked
+	}
+	if r, ok := chaosAnswer(q); ok {
+		tracef(ctx, "answered locally: CHAOS")
+		return r.pack(), outcomeLocal
+	}
+	if r, ok := leases.answer(q); ok {
+		tracef(ctx, "answered locally: DHCP lease")
+		return r.pack(), outcomeLocal
+	}
+	if r, ok := dynamicZone.answer(q); ok {
+		tracef(ctx, "answered locally: dynamic zone")
+		return r.pack(), outcomeLocal
+	}
+	vw := viewFor(client)
+	if vw != nil {
+		tracef(ctx, "view: %s", vw.name)
+		if r, ok := vw.addresses.answer(q); ok {
+			tracef(ctx, "answered locally: -view-address")
+			return r.pack(), outcomeLocal
+		}
+	}
+	if r, ok := addresses.answer(q); ok {
+		tracef(ctx, "answered locally: -address")
+		return r.pack(), outcomeLocal
+	}
+	rt := routes[question.Type]
+	if rt != nil && rt.refuse {
+		tracef(ctx, "refused: -route %s=refuse", typeName(question.Type))
+		atomic.AddInt64(&stats.Blocked, 1)
+		return reply(q, rcodeRefused).pack(), outcomeBlocked
+	}
+	upstream := upstreamSet(client)
+	if fwd, rule, cache := vw.forwardFor(question.Name, upstream); fwd != nil {
+		tracef(ctx, "route: %s", rule)
+		rt, upstream = fwd, cache
+	}
+	if source, ok := blocked.matchClient(question.Name, client); ok {
+		tracef(ctx, "blocked: %s", source)
+		atomic.AddInt64(&stats.Blocked, 1)
+		return reply(q, rcodeNXDomain).pack(), outcomeBlocked
+	}
+	if r, ok := search(ctx, q, client); ok {
+		tracef(ctx, "answered via the search list")
+		return r.pack(), outcomeForwarded
+	}
+	if captive.bypassing() {
+		// Not cached: whatever the portal says is only good until
+		// we're past it.
+		tracef(ctx, "behind a captive portal: asking %s", captive.resolver())
+		resp, err := udpExchange(ctx, captive.resolver(), query)
+		if err != nil {
+			log.Printf("captive error: %s: %s", client, err.Error())
+			return reply(q, rcodeServFail).pack(), outcomeError
+		}
+		return resp, outcomeBypassed
+	}
+	if r := responseCache.get(q, upstream); r != nil {
+		tracef(ctx, "cache hit")
+		atomic.AddInt64(&stats.CacheHits, 1)
+		ipsets.add(r)
+		passive.add(r)
+		return r.pack(), outcomeCached
+	}
+	tracef(ctx, "cache miss")
+	atomic.AddInt64(&stats.CacheMisses, 1)
+	if !loops.enter(q.Question[0], client) {
+		tracef(ctx, "loop: already asking upstream for this")
+		log.Printf("loop error: %s: %s %s, giving up", client,
+			q.Question[0].Name, typeName(q.Question[0].Type))
+		return reply(q, rcodeServFail).pack(), outcomeError
+	}
+	defer loops.leave(q.Question[0])
+	resp, maxAge, err := forward(ctx, advertise(q, query), question.Name, client, rt)
+	if err != nil {
+		return resp, outcomeError
+	}
+	r, err := parseMsg(resp)
+	if err != nil || r.ID != q.ID {
+		// Garbage; not ours to fix.
+		tracef(ctx, "unparseable response, passed on as is")
+		return resp, outcomeForwarded
+	}
+	tracef(ctx, "response: %s, %d answers, %d authority, %d additional",
+		rcodeName(r.rcode()), len(r.Answer), len(r.Authority), len(r.Additional))
+	postprocess(ctx, r)
+	if maxAge >= 0 {
+		tracef(ctx, "HTTP max-age: %ds", maxAge)
+	}
+	responseCache.put(r, maxAge, upstream)
+	ipsets.add(r)
+	passive.add(r)
+	return r.pack(), outcomeForwarded
+}
+
+// postprocess applies our policies to a fresh upstream response,
+// before it's cached and relayed.
+func postprocess(ctx context.Context, r *dnsMsg) {
+	filterAnswers(ctx, r)
+	rewrites.apply(ctx, r)
+	flatten(r)
+	minimizeResponse(r)
+	clampTTLs(r)
+	advertiseTo(r)
+}
+
+// forward sends a query upstream, along the route if there's one. If
+// that fails, the response tells the client as much. See rawQuery for
+// maxAge.
+func forward(ctx context.Context, query []byte, name string, client net.Addr, rt *route) (resp []byte, maxAge int, err error) {
+	if rt != nil {
+		tracef(ctx, "routed to %s%s", rt.endpoint, rt.server)
+		resp, maxAge, err = rt.exchange(ctx, query)
+	} else {
+		endpoint := pickEndpointFor(client, name)
+		if name != "" && selectMode.value == "shard" {
+			tracef(ctx, "shard: %s goes to %s", suffixes.registered(name), endpoint)
+		}
+		resp, maxAge, err = dohClient.rawQuery(ctx, endpoint, query)
+		// Asked to back off, or not on the HTTP version we want:
+		// someone else's turn.
+		if err != nil && (throttled(err) || downgraded(err)) {
+			if other := pickEndpointFor(client, name); other != endpoint && retries.spend() {
+				tracef(ctx, "%s, trying %s", err.Error(), other)
+				resp, maxAge, err = dohClient.rawQuery(ctx, other, query)
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		log.Printf("query error: %s: %s", client, err.Error())
+		tracef(ctx, "upstream failed: %s", err.Error())
+		return failure(query, errorRcode(err)), -1, err
+	}
+	return resp, maxAge, nil
+}
+
+// errorRcode tells what went wrong upstream, in DNS terms: a 4xx
+// means the endpoint didn't like the query (or us), anything else is
+// a server failure.
+func errorRcode(err error) int {
+	var status *StatusError
+	if !errors.As(err, &status) {
+		return rcodeServFail
+	}
+	switch {
+	case status.StatusCode == http.StatusBadRequest,
+		status.StatusCode == http.StatusRequestEntityTooLarge,
+		status.StatusCode == http.StatusRequestURITooLong,
+		status.StatusCode == http.StatusUnsupportedMediaType:
+		return rcodeFormErr
+	case status.StatusCode/100 == 4:
+		return rcodeRefused
+	}
+	return rcodeServFail
+}
+
+// failure builds an error response to query, even if we can't make
+// much sense of it; a client with its ID gets an answer, at least.
+func failure(query []byte, rcode int) []byte {
+	if q, err := parseMsg(query); err == nil {
+		return reply(q, rcode).pack()
+	}
+	if len(query) < 12 {
+		return nil
+	}
+	q := &dnsMsg{
+		ID:    binary.BigEndian.Uint16(query),
+		Flags: binary.BigEndian.Uint16(query[2:]),
+	}
+	return reply(q, rcode).pack()
+}
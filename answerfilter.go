@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Answer filters, by address: whatever the name, some addresses
+// shouldn't come back from upstream - a hosting range you'd rather
+// not talk to, or private addresses in public names (DNS rebinding).
+// Applied to upstream responses before they're cached, and before
+// -rewrite:
+//
+//	drop:10.0.0.0/8                 drop the A/AAAA records in there
+//	                                (what's left may be nothing)
+//	block:198.51.100.0/24           a record in there makes the whole
+//	                                response NXDOMAIN
+//	rewrite:203.0.113.0/24=192.0.2.1  swap the address for another,
+//	                                of the same family
+//
+// "bogons" stands for all the private, reserved and documentation
+// ranges, v4 and v6: drop:bogons. Mind the local names that are
+// meant to have local addresses, though.
+
+var answerFilterFlags = &stringsFlag{}
+
+func init() {
+	answerFilterFlags.check = func(v string) error {
+		_, err := parseAnswerFilter(v)
+		return err
+	}
+	flag.Var(answerFilterFlags, "answer-filter",
+		"Filter answers by address: drop:CIDR, block:CIDR, or rewrite:CIDR=IP; CIDR can be \"bogons\" (repeatable)")
+}
+
+// (No ::ffff:0:0/96: the v4 ranges cover the v4-mapped addresses, and
+// net.IPNet would take it for all of IPv4.)
+var bogons = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24",
+	"192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24",
+	"203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "100::/64", "2001:db8::/32",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+type answerFilter struct {
+	rule   string
+	action string
+	nets   []*net.IPNet
+	to     net.IP
+}
+
+var answerFilters []answerFilter
+
+func parseAnswerFilter(v string) (answerFilter, error) {
+	f := answerFilter{rule: v}
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return f, fmt.Errorf("-answer-filter %s: want action:CIDR", v)
+	}
+	f.action = parts[0]
+	cidrs := parts[1]
+	switch f.action {
+	case "drop", "block":
+	case "rewrite":
+		to := strings.SplitN(cidrs, "=", 2)
+		if len(to) != 2 {
+			return f, fmt.Errorf("-answer-filter %s: want rewrite:CIDR=IP", v)
+		}
+		cidrs = to[0]
+		if f.to = net.ParseIP(to[1]); f.to == nil {
+			return f, fmt.Errorf("-answer-filter %s: bad address", v)
+		}
+	default:
+		return f, fmt.Errorf("-answer-filter %s: unknown action %s", v, f.action)
+	}
+	list := []string{cidrs}
+	if cidrs == "bogons" {
+		list = bogons
+	}
+	for _, cidr := range list {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return f, fmt.Errorf("-answer-filter %s: %v", v, err)
+		}
+		if f.to != nil && (ipnet.IP.To4() == nil) != (f.to.To4() == nil) {
+			return f, fmt.Errorf("-answer-filter %s: want an address of the same family", v)
+		}
+		f.nets = append(f.nets, ipnet)
+	}
+	return f, nil
+}
+
+func loadAnswerFilters() error {
+	for _, v := range answerFilterFlags.values {
+		f, err := parseAnswerFilter(v)
+		if err != nil {
+			return err
+		}
+		answerFilters = append(answerFilters, f)
+	}
+	return nil
+}
+
+// matchAnswerFilter finds the first filter for ip.
+func matchAnswerFilter(ip net.IP) *answerFilter {
+	for i := range answerFilters {
+		// A v4 range takes in the v4-mapped v6 addresses, too.
+		for _, ipnet := range answerFilters[i].nets {
+			if ipnet.Contains(ip) {
+				return &answerFilters[i]
+			}
+		}
+	}
+	return nil
+}
+
+// filterAnswers applies the answer filters to r, in place.
+func filterAnswers(ctx context.Context, r *dnsMsg) {
+	if len(answerFilters) == 0 {
+		return
+	}
+	kept := r.Answer[:0]
+	for _, rr := range r.Answer {
+		if rr.Type != typeA && rr.Type != typeAAAA {
+			kept = append(kept, rr)
+			continue
+		}
+		f := matchAnswerFilter(net.IP(rr.Data))
+		if f == nil {
+			kept = append(kept, rr)
+			continue
+		}
+		atomic.AddInt64(&stats.Filtered, 1)
+		tracef(ctx, "answer %s: -answer-filter %s", net.IP(rr.Data), f.rule)
+		switch f.action {
+		case "block":
+			r.setRcode(rcodeNXDomain)
+			r.Answer, r.Authority = nil, nil
+			return
+		case "rewrite":
+			rr.Data = addrData(f.to, rr.Type)
+			kept = append(kept, rr)
+		}
+	}
+	r.Answer = kept
+}
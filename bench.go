@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// "gdoh bench [NAME...]": fire a bunch of queries at each endpoint,
+// and see how long they take. This measures the upstreams (and their
+// caches), not gdoh itself.
+
+type benchResult struct {
+	Endpoint string
+	Times    []time.Duration // sorted
+	Errors   int
+	Elapsed  time.Duration
+}
+
+func (r benchResult) quantile(q float64) time.Duration {
+	if len(r.Times) == 0 {
+		return 0
+	}
+	return r.Times[int(q*float64(len(r.Times)-1))]
+}
+
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	count := fs.Int("n", 50, "Queries per endpoint")
+	concurrency := fs.Int("c", 4, "Queries in flight at once, per endpoint")
+	endpoint := fs.String("endpoint", "",
+		"Benchmark just this endpoint (default: all configured)")
+	qtype := fs.String("type", "A", "Query type")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"Usage: gdoh bench [-n N] [-c N] [-endpoint URL] [-type TYPE] [NAME...]")
+		fs.PrintDefaults()
+	}
+	names, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		names = []string{*canary}
+	}
+	type_, err := typeNumber(*qtype)
+	if err != nil {
+		return err
+	}
+	if *count < 1 || *concurrency < 1 {
+		return errors.New("-n and -c have to be positive")
+	}
+	endpoints := dohClient.Endpoints
+	if *endpoint != "" {
+		endpoints = []string{*endpoint}
+	}
+
+	// One endpoint at a time, so that they don't get in each other's
+	// way.
+	results := []benchResult{}
+	for _, endpoint := range endpoints {
+		results = append(results,
+			benchEndpoint(endpoint, names, type_, *count, *concurrency))
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].quantile(0.5) < results[j].quantile(0.5)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tOK\tERRORS\tMIN\tP50\tP95\tMAX\tQPS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%.1f\n",
+			r.Endpoint, len(r.Times), r.Errors, ms(r.quantile(0)),
+			ms(r.quantile(0.5)), ms(r.quantile(0.95)), ms(r.quantile(1)),
+			float64(len(r.Times))/r.Elapsed.Seconds())
+	}
+	return w.Flush()
+}
+
+func benchEndpoint(endpoint string, names []string, type_ uint16,
+	count, concurrency int) benchResult {
+	result := benchResult{Endpoint: endpoint}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				q := &dnsMsg{
+					ID:    uint16(n),
+					Flags: flagRD,
+					Question: []dnsQuestion{{
+						normalizeName(names[n%len(names)]), type_, classINET,
+					}},
+				}
+				t := time.Now()
+				resp, err := dohClient.RawQueryTo(endpoint, q.pack())
+				if err == nil {
+					_, err = parseMsg(resp)
+				}
+				d := time.Since(t)
+				mu.Lock()
+				if err != nil {
+					result.Errors++
+				} else {
+					result.Times = append(result.Times, d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for n := 0; n < count; n++ {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+	sort.Slice(result.Times, func(i, j int) bool {
+		return result.Times[i] < result.Times[j]
+	})
+	return result
+}
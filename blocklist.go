@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklists: queries for a listed domain, or any of its subdomains,
+// get NXDOMAIN.
+//
+// Lists can be tagged with a category ("-block ads=FILE"), and
+// clients given a policy, naming the categories they get: "-policy
+// 192.168.1.0/24=ads,malware", "-policy 192.168.1.10=" (nothing);
+// or by MAC address, client ID, or listener (see clientid.go).
+// The most specific policy wins; clients without one get all lists.
+// Names blocked via the admin API are blocked for everyone.
+
+var blockFiles = &stringsFlag{}
+var policyFlags = &stringsFlag{}
+
+func init() {
+	blockFiles.check = func(v string) error {
+		_, path := parseBlockFile(v)
+		return checkFile(path)
+	}
+	policyFlags.check = func(v string) error {
+		_, err := parsePolicy(v)
+		return err
+	}
+	flag.Var(blockFiles, "block",
+		"Blocklist file, in hosts format or one domain per line, optionally CATEGORY=FILE (repeatable)")
+	flag.Var(policyFlags, "policy",
+		"Blocklist categories for clients: ADDRESS[/BITS]|MAC|id:NAME|on:LISTENER=CATEGORY,... (repeatable)")
+}
+
+// The category of lists without one.
+const defaultCategory = "default"
+
+// parseBlockFile splits a -block value into category and path.
+func parseBlockFile(v string) (category, path string) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) == 2 && parts[0] != "" && !strings.ContainsAny(parts[0], `/\.`) {
+		return parts[0], parts[1]
+	}
+	return defaultCategory, v
+}
+
+type blockPolicy struct {
+	clients    clientMatcher
+	categories map[string]bool
+}
+
+func parsePolicy(v string) (blockPolicy, error) {
+	p := blockPolicy{categories: map[string]bool{}}
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return p, fmt.Errorf("-policy %s: want ADDRESS[/BITS]=CATEGORY,...", v)
+	}
+	clients, err := parseClientMatcher(parts[0])
+	if err != nil {
+		return p, fmt.Errorf("-policy %s: %v", v, err)
+	}
+	p.clients = clients
+	for _, category := range strings.Split(parts[1], ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			p.categories[category] = true
+		}
+	}
+	return p, nil
+}
+
+// policies, most specific first.
+var policies []blockPolicy
+
+func loadPolicies() error {
+	policies = nil
+	for _, v := range policyFlags.values {
+		p, err := parsePolicy(v)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, p)
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].clients.specificity() > policies[j].clients.specificity()
+	})
+	return nil
+}
+
+// policyFor returns the categories for client; nil means all of them.
+func policyFor(client net.Addr) map[string]bool {
+	if len(policies) == 0 || client == nil {
+		return nil
+	}
+	for _, p := range policies {
+		if p.clients.match(client) {
+			return p.categories
+		}
+	}
+	return nil
+}
+
+// How often to look for changed list files.
+const blocklistCheck = 10 * time.Second
+
+// Names that show up in every hosts file, that we never want to
+// block.
+var neverBlock = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+}
+
+type blocklist struct {
+	sync.RWMutex
+	// source (file name) -> set of domains
+	lists map[string]map[string]bool
+	// source -> category
+	categories map[string]string
+	// source -> modification time, as loaded
+	modTimes map[string]time.Time
+	// domains added at runtime, via the admin API
+	custom  map[string]bool
+	enabled bool
+	// While paused, nothing is blocked, even if enabled.
+	pausedUntil time.Time
+}
+
+var blocked = &blocklist{
+	lists:      map[string]map[string]bool{},
+	categories: map[string]string{},
+	custom:     map[string]bool{},
+	enabled:    true,
+}
+
+// readBlocklist reads a list of domains, one per line; in hosts
+// format ("0.0.0.0 ads.example.com"), the address is skipped.
+func readBlocklist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	domains := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, f := range fields {
+			name := normalizeName(f)
+			if !neverBlock[name] && net.ParseIP(f) == nil {
+				domains[name] = true
+			}
+		}
+	}
+	return domains, s.Err()
+}
+
+// load (re)reads the given list files (-block values). It's all or
+// nothing: if one list can't be read, we keep the old ones.
+func (bl *blocklist) load(files []string) error {
+	lists := map[string]map[string]bool{}
+	categories := map[string]string{}
+	modTimes := map[string]time.Time{}
+	for _, v := range files {
+		category, path := parseBlockFile(v)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		domains, err := readBlocklist(path)
+		if err != nil {
+			return err
+		}
+		lists[path] = domains
+		categories[path] = category
+		modTimes[path] = fi.ModTime()
+	}
+	bl.Lock()
+	bl.lists = lists
+	bl.categories = categories
+	bl.modTimes = modTimes
+	bl.Unlock()
+	return nil
+}
+
+// changed tells if any of the files changed since they were loaded.
+func (bl *blocklist) changed(files []string) bool {
+	bl.RLock()
+	defer bl.RUnlock()
+	for _, v := range files {
+		_, path := parseBlockFile(v)
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Equal(bl.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the lists when the files change. Queries go on
+// meanwhile, against the old lists, and the cache stays.
+func (bl *blocklist) watch(files []string) {
+	if len(files) == 0 {
+		return
+	}
+	for range backgroundTick(blocklistCheck) {
+		if !bl.changed(files) {
+			continue
+		}
+		if err := bl.load(files); err != nil {
+			// Halfway through an update, maybe; try again later.
+			log.Printf("blocklist error: %s", err.Error())
+			continue
+		}
+		log.Print("Reloaded blocklists")
+	}
+}
+
+// match tells whether name is blocked, and by which list ("" for the
+// custom one).
+func (bl *blocklist) match(name string) (source string, ok bool) {
+	return bl.matchCategories(name, nil)
+}
+
+// matchClient is match, going by the client's policy.
+func (bl *blocklist) matchClient(name string, client net.Addr) (source string, ok bool) {
+	return bl.matchCategories(name, policyFor(client))
+}
+
+// matchCategories is match, with only the lists in the given
+// categories (nil meaning all of them).
+func (bl *blocklist) matchCategories(name string, categories map[string]bool) (source string, ok bool) {
+	bl.RLock()
+	defer bl.RUnlock()
+	if !bl.enabled || time.Now().Before(bl.pausedUntil) {
+		return "", false
+	}
+	for _, name := range parentNames(name) {
+		if bl.custom[name] {
+			return "", true
+		}
+		for source, domains := range bl.lists {
+			if categories != nil && !categories[bl.categories[source]] {
+				continue
+			}
+			if domains[name] {
+				return source, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (bl *blocklist) add(name string) {
+	bl.Lock()
+	bl.custom[normalizeName(name)] = true
+	bl.Unlock()
+}
+
+func (bl *blocklist) remove(name string) bool {
+	bl.Lock()
+	defer bl.Unlock()
+	name = normalizeName(name)
+	ok := bl.custom[name]
+	delete(bl.custom, name)
+	return ok
+}
+
+func (bl *blocklist) setEnabled(enabled bool) {
+	bl.Lock()
+	bl.enabled = enabled
+	bl.Unlock()
+}
+
+func (bl *blocklist) isEnabled() bool {
+	bl.RLock()
+	defer bl.RUnlock()
+	return bl.enabled
+}
+
+// pause stops blocking for d; blocking resumes by itself afterwards.
+// A zero d resumes right away.
+func (bl *blocklist) pause(d time.Duration) time.Time {
+	bl.Lock()
+	defer bl.Unlock()
+	bl.pausedUntil = time.Now().Add(d)
+	return bl.pausedUntil
+}
+
+// paused returns when a pause ends, if we're paused.
+func (bl *blocklist) paused() (until time.Time, ok bool) {
+	bl.RLock()
+	defer bl.RUnlock()
+	return bl.pausedUntil, time.Now().Before(bl.pausedUntil)
+}
+
+// summary describes the loaded lists, for the admin API.
+func (bl *blocklist) summary() map[string]interface{} {
+	bl.RLock()
+	defer bl.RUnlock()
+	lists := map[string]int{}
+	for source, domains := range bl.lists {
+		lists[source] = len(domains)
+	}
+	categories := map[string]string{}
+	for source, category := range bl.categories {
+		categories[source] = category
+	}
+	custom := []string{}
+	for name := range bl.custom {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	return map[string]interface{}{
+		"enabled":    bl.enabled,
+		"paused":     time.Now().Before(bl.pausedUntil),
+		"lists":      lists,
+		"categories": categories,
+		"custom":     custom,
+	}
+}
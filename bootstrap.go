@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var bootstrapFormat = &choiceFlag{value: "json", choices: []string{"json", "wire"}}
+
+func init() {
+	flag.Var(bootstrapFormat, "bootstrap-format",
+		"How to ask the bootstrap resolver: json (DNS-JSON) or wire (RFC 8484)")
+}
+
+// Bootstrap cache: endpoint hostnames, resolved through rootDohClient.
+// Entries live for their TTL (within reason), get refreshed in the
+// background before they expire, and when the bootstrap resolver is
+// having a bad day, we keep using the last addresses that worked.
+// Endpoints given with their addresses skip all that.
+//
+// The bootstrap resolver is asked over DNS-JSON, unless
+// -bootstrap-format wire says otherwise; then all our own lookups go
+// in the wire format, the one thing every endpoint has to support.
+
+const (
+	bootstrapMinTTL  = time.Minute
+	bootstrapMaxTTL  = 24 * time.Hour
+	bootstrapRefresh = 30 * time.Second
+)
+
+type bootstrapEntry struct {
+	addrs   []string
+	expires time.Time
+	pinned  bool
+}
+
+// A resolve in progress; see lookup.
+type bootstrapCall struct {
+	done  chan struct{}
+	addrs []string
+	err   error
+}
+
+type bootstrapCache struct {
+	sync.Mutex
+	hosts    map[string]*bootstrapEntry
+	inflight map[string]*bootstrapCall
+}
+
+var bootstrap = &bootstrapCache{
+	hosts:    map[string]*bootstrapEntry{},
+	inflight: map[string]*bootstrapCall{},
+}
+
+// lookup returns the addresses for host, from the cache if they're
+// fresh. A burst of dials to a host we don't know yet (the transport
+// opening a few connections at once) waits on one resolve. The
+// resolve runs on its own time (-request-timeout), so that a caller
+// giving up (when ctx is done) doesn't fail the others, and the answer
+// still makes it into the cache for the next one.
+func (bc *bootstrapCache) lookup(ctx context.Context, host string) ([]string, error) {
+	bc.Lock()
+	e := bc.hosts[host]
+	if e != nil && (e.pinned || time.Now().Before(e.expires)) {
+		bc.Unlock()
+		return e.addrs, nil
+	}
+	call, ok := bc.inflight[host]
+	if !ok {
+		call = &bootstrapCall{done: make(chan struct{})}
+		bc.inflight[host] = call
+		go func() {
+			call.addrs, call.err = bc.resolve(context.Background(), host)
+			bc.Lock()
+			delete(bc.inflight, host)
+			bc.Unlock()
+			close(call.done)
+		}()
+	}
+	bc.Unlock()
+	select {
+	case <-call.done:
+		return call.addrs, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve asks the bootstrap resolver about host, and caches the
+// answer; if there isn't one, it falls back on the last known one.
+func (bc *bootstrapCache) resolve(ctx context.Context, host string) ([]string, error) {
+	query := rootDohClient.queryRecords
+	if bootstrapFormat.value == "wire" {
+		query = rootDohClient.queryRecordsWire
+	}
+	records, err := query(ctx, host, "A")
+	if err == nil && len(records) == 0 {
+		log.Printf("no answers: %s", host)
+		err = ErrResolver
+	}
+	if err != nil {
+		bc.Lock()
+		e := bc.hosts[host]
+		if e != nil {
+			// Don't ask again on every dial; refresh will retry.
+			bc.hosts[host] = &bootstrapEntry{addrs: e.addrs,
+				expires: time.Now().Add(bootstrapRefresh)}
+		}
+		bc.Unlock()
+		if e == nil {
+			return nil, err
+		}
+		log.Printf("bootstrap error: %s: %s; using the last known addresses",
+			host, err.Error())
+		return e.addrs, nil
+	}
+	e := &bootstrapEntry{}
+	ttl := bootstrapMaxTTL
+	for _, rr := range records {
+		e.addrs = append(e.addrs, rr.Data)
+		if d := time.Duration(rr.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	e.expires = time.Now().Add(ttl)
+	log.Printf("translated: %s -> %v", host, e.addrs)
+	bc.Lock()
+	bc.hosts[host] = e
+	bc.Unlock()
+	return e.addrs, nil
+}
+
+// pin sets the addresses for host, for good.
+func (bc *bootstrapCache) pin(host string, addrs []string) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.hosts[host] = &bootstrapEntry{addrs: addrs, pinned: true}
+}
+
+// pinned returns the pinned addresses for host, if any.
+func (bc *bootstrapCache) pinned(host string) ([]string, bool) {
+	bc.Lock()
+	defer bc.Unlock()
+	if e, ok := bc.hosts[host]; ok && e.pinned {
+		return e.addrs, true
+	}
+	return nil, false
+}
+
+// refresh re-resolves the hosts about to expire, so that dialing
+// rarely has to wait for the bootstrap resolver.
+func (bc *bootstrapCache) refresh() {
+	for range backgroundTick(bootstrapRefresh) {
+		for _, host := range bc.expiring(time.Now().Add(2 * bootstrapRefresh)) {
+			bc.resolve(context.Background(), host)
+		}
+	}
+}
+
+// expiring lists the hosts (not pinned) that expire before t.
+func (bc *bootstrapCache) expiring(t time.Time) []string {
+	bc.Lock()
+	defer bc.Unlock()
+	hosts := []string{}
+	for host, e := range bc.hosts {
+		if !e.pinned && e.expires.Before(t) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// refreshAll re-resolves every host, fresh or not: after a network
+// change, the addresses we have may not be the ones to use from here.
+func (bc *bootstrapCache) refreshAll() {
+	for _, host := range bc.expiring(time.Now().Add(bootstrapMaxTTL + time.Hour)) {
+		bc.resolve(context.Background(), host)
+	}
+}
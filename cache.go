@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A response cache, keyed by question (and the endpoint set it went
+// to, see listener.go). Entries live for as long as the lowest TTL in
+// the response says.
+
+var cacheSize = flag.Int("cache-size", 4096,
+	"Maximum number of cached responses (0 disables caching)")
+var rotateAnswers = flag.Bool("rotate-answers", true,
+	"Rotate the order of A/AAAA records each time a cached answer is served")
+
+type cacheKey struct {
+	Name     string
+	Type     uint16
+	Class    uint16
+	Upstream string // "" for the usual endpoints
+}
+
+type cacheEntry struct {
+	msg     *dnsMsg
+	stored  time.Time
+	expires time.Time
+	// How many times we've served this, for rotating answers.
+	served uint32
+	// Roughly how much memory this takes.
+	size int
+}
+
+type cache struct {
+	sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	bytes   int
+	// Entries dropped to make room, and dropped because they were
+	// past their TTL anyway.
+	evictions, expired int64
+}
+
+// cacheStats is what the admin API and /metrics show of the cache.
+// Hits and misses are counted in the stats.
+//
+// The cache doesn't serve stale answers (RFC 8767), or prefetch the
+// popular ones before they expire: an expired entry is a miss. The
+// counters are there, at 0, so that a dashboard built for a cache
+// that does says so, rather than showing nothing.
+type cacheStats struct {
+	Entries     int     `json:"entries"`
+	Capacity    int     `json:"capacity"`
+	Bytes       int     `json:"bytes"` // estimated
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRatio    float64 `json:"hit_ratio"`
+	Evictions   int64   `json:"evictions"`
+	Expired     int64   `json:"expired"`
+	StaleServed int64   `json:"stale_served"` // always 0
+	Prefetched  int64   `json:"prefetched"`   // always 0
+}
+
+// Per-entry bookkeeping, on top of the response itself, for the
+// memory estimate; a guess, give or take.
+const cacheEntryOverhead = 200
+
+var responseCache = &cache{entries: map[cacheKey]*cacheEntry{}}
+
+func keyOf(q dnsQuestion, upstream string) cacheKey {
+	return cacheKey{normalizeName(q.Name), q.Type, q.Class, upstream}
+}
+
+// get returns a cached response to q, from upstream (an endpoint set,
+// see upstreamSet), if any, with its ID set to match, and its TTLs
+// counted down.
+func (c *cache) get(q *dnsMsg, upstream string) *dnsMsg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	c.Lock()
+	e, ok := c.entries[keyOf(q.Question[0], upstream)]
+	c.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	age := uint32(now.Sub(e.stored) / time.Second)
+	m := e.msg.copy()
+	m.ID = q.ID
+	for _, section := range m.sections() {
+		for i := range *section {
+			rr := &(*section)[i]
+			if rr.Type == typeOPT {
+				continue
+			}
+			if rr.TTL > age {
+				rr.TTL -= age
+			} else {
+				rr.TTL = 0
+			}
+		}
+	}
+	if *rotateAnswers {
+		rotate(m.Answer, int(atomic.AddUint32(&e.served, 1)))
+	}
+	return m
+}
+
+// put caches a response from upstream, if it's a cacheable one.
+func (c *cache) put(r *dnsMsg, maxAge int, upstream string) {
+	if *cacheSize <= 0 || len(r.Question) != 1 || r.Flags&flagTC != 0 {
+		return
+	}
+	if rcode := r.rcode(); rcode != rcodeSuccess && rcode != rcodeNXDomain {
+		return
+	}
+	ttl, ok := cacheTTL(r, maxAge)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	key := keyOf(r.Question[0], upstream)
+	e := &cacheEntry{
+		msg:     r.copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+		size:    len(r.pack()) + len(key.Name) + cacheEntryOverhead,
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.remove(key)
+	if len(c.entries) >= *cacheSize {
+		c.evict(now)
+	}
+	c.entries[key] = e
+	c.bytes += e.size
+}
+
+// remove drops an entry, if it's there. Call with the lock held.
+func (c *cache) remove(k cacheKey) bool {
+	e, ok := c.entries[k]
+	if ok {
+		c.bytes -= e.size
+		delete(c.entries, k)
+	}
+	return ok
+}
+
+// evict makes room for at least one new entry: first by dropping
+// everything expired, then, if that wasn't enough, whatever map
+// iteration order hands us first. Call with the lock held.
+func (c *cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			c.remove(k)
+			c.expired++
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < *cacheSize {
+			break
+		}
+		c.remove(k)
+		c.evictions++
+	}
+}
+
+// flush removes all entries for name (of any type), or everything if
+// name is empty. It returns the number of entries removed.
+func (c *cache) flush(name string) int {
+	c.Lock()
+	defer c.Unlock()
+	if name == "" {
+		n := len(c.entries)
+		c.entries = map[cacheKey]*cacheEntry{}
+		c.bytes = 0
+		return n
+	}
+	name = normalizeName(name)
+	n := 0
+	for k := range c.entries {
+		if k.Name == name {
+			c.remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+// flushUpstream removes the entries cached for upstream (see keyOf),
+// and returns how many.
+func (c *cache) flushUpstream(upstream string) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for k := range c.entries {
+		if k.Upstream == upstream {
+			c.remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *cache) stats() cacheStats {
+	counters := stats.snapshot()
+	c.Lock()
+	defer c.Unlock()
+	s := cacheStats{
+		Entries:   len(c.entries),
+		Capacity:  *cacheSize,
+		Bytes:     c.bytes,
+		Hits:      counters.CacheHits,
+		Misses:    counters.CacheMisses,
+		Evictions: c.evictions,
+		Expired:   c.expired,
+	}
+	if n := s.Hits + s.Misses; n > 0 {
+		s.HitRatio = float64(s.Hits) / float64(n)
+	}
+	return s
+}
+
+func (c *cache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+// rotate shifts each run of A or AAAA records for the same name by n
+// places, so that clients which always pick the first address spread
+// out over all of them.
+func rotate(rrs []dnsRR, n int) {
+	for i := 0; i < len(rrs); {
+		j := i + 1
+		if rrs[i].Type == typeA || rrs[i].Type == typeAAAA {
+			for j < len(rrs) && rrs[j].Type == rrs[i].Type &&
+				strings.EqualFold(rrs[j].Name, rrs[i].Name) {
+				j++
+			}
+		}
+		if run := rrs[i:j]; len(run) > 1 {
+			k := n % len(run)
+			rotated := append(append([]dnsRR{}, run[k:]...), run[:k]...)
+			copy(run, rotated)
+		}
+		i = j
+	}
+}
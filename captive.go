@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Captive portals: on hotel and airport Wi-Fi, nothing gets out until
+// you've clicked "I agree" on a page that you can't find, because
+// finding it takes DNS, and DoH is blocked until you've clicked.
+//
+// With -captive on, when all the endpoints fail, gdoh fetches
+// -captive-probe, via the network's own resolver. Anything but the
+// expected 204 means there's someone in the way; until the endpoints
+// work again, queries go to the network's resolver, so that the
+// portal can be found.
+
+var captiveMode = &choiceFlag{value: "off", choices: []string{"off", "on"}}
+var captiveProbe = flag.String("captive-probe",
+	"http://connectivitycheck.gstatic.com/generate_204",
+	"URL that answers 204 No Content, unless there's a captive portal")
+
+func init() {
+	flag.Var(captiveMode, "captive",
+		"Detect captive portals, and bypass the endpoints while behind one: off or on")
+}
+
+// How often to check on the portal.
+const captiveInterval = 10 * time.Second
+
+type captivePortal struct {
+	sync.Mutex
+	server string // the network's resolver, while bypassing
+}
+
+var captive = &captivePortal{}
+
+func (cp *captivePortal) bypassing() bool {
+	return cp.resolver() != ""
+}
+
+func (cp *captivePortal) resolver() string {
+	cp.Lock()
+	defer cp.Unlock()
+	return cp.server
+}
+
+func (cp *captivePortal) bypass(server string) {
+	cp.Lock()
+	defer cp.Unlock()
+	cp.server = server
+}
+
+// watchCaptive switches the bypass on and off.
+func watchCaptive() {
+	if captiveMode.value == "off" {
+		return
+	}
+	for range backgroundTick(captiveInterval) {
+		if captive.bypassing() {
+			if endpointsWork() {
+				captive.bypass("")
+				alert("captive_portal_gone",
+					"Endpoints work again, leaving bypass mode", nil)
+			}
+			continue
+		}
+		if len(dohClient.health.healthy(dohClient.endpoints())) > 0 {
+			continue
+		}
+		server, err := ddrResolverAddr()
+		if err != nil {
+			log.Printf("captive error: %s", err.Error())
+			continue
+		}
+		portal, err := behindPortal(server)
+		if err != nil {
+			log.Printf("captive error: %s", err.Error())
+			continue
+		}
+		if portal {
+			captive.bypass(server)
+			alert("captive_portal",
+				"Captive portal detected, forwarding to "+server+
+					" until the endpoints work", map[string]string{
+					"resolver": server,
+				})
+		}
+	}
+}
+
+// endpointsWork probes the endpoints, directly.
+func endpointsWork() bool {
+	probe := probeQuery()
+	for _, endpoint := range dohClient.endpoints() {
+		if _, err := dohClient.RawQueryTo(endpoint, probe); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// behindPortal fetches the probe URL, looking its host up with server.
+func behindPortal(server string) (bool, error) {
+	u, err := url.Parse(*captiveProbe)
+	if err != nil {
+		return false, err
+	}
+	q := &dnsMsg{
+		ID:       randomID(),
+		Flags:    flagRD,
+		Question: []dnsQuestion{{normalizeName(u.Hostname()), typeA, classINET}},
+	}
+	r, err := udpQuery(server, q)
+	if err != nil {
+		return false, err
+	}
+	var addr string
+	for _, rr := range r.Answer {
+		if rr.Type == typeA {
+			addr = net.IP(rr.Data).String()
+			break
+		}
+	}
+	if addr == "" {
+		// No address for the probe: someone's meddling with DNS,
+		// which is what portals do.
+		return true, nil
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				_, port, _ := net.SplitHostPort(address)
+				return (&net.Dialer{Timeout: *dialTimeout}).DialContext(ctx,
+					network, net.JoinHostPort(addr, port))
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: *requestTimeout,
+	}
+	resp, err := client.Get(*captiveProbe)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// Nothing gets out; not a portal we could help with.
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNoContent, nil
+}
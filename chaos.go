@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// CHAOS class TXT queries: "dig @gdoh CH TXT version.bind". Monitoring
+// uses these to tell resolver instances apart; we answer them
+// ourselves, rather than passing on upstream's idea of who it is.
+
+var chaos = flag.Bool("chaos", true,
+	"Answer CHAOS TXT version.bind, version.server and hostname.bind")
+var chaosVersion = flag.String("chaos-version", "gdoh "+version,
+	"Answer to version.bind and version.server")
+var chaosHostname = flag.String("chaos-hostname", "",
+	"Answer to hostname.bind and id.server (default: the system hostname)")
+
+// chaosAnswer answers a CHAOS query, if it's one we know about.
+func chaosAnswer(q *dnsMsg) (*dnsMsg, bool) {
+	question := q.Question[0]
+	if !*chaos || question.Class != classCHAOS {
+		return nil, false
+	}
+	var text string
+	switch normalizeName(question.Name) {
+	case "version.bind.", "version.server.":
+		text = *chaosVersion
+	case "hostname.bind.", "id.server.":
+		text = *chaosHostname
+		if text == "" {
+			text, _ = os.Hostname()
+		}
+	default:
+		return reply(q, rcodeRefused), true
+	}
+	r := reply(q, rcodeSuccess)
+	r.Flags |= flagAA
+	if question.Type == typeTXT || question.Type == typeANY {
+		r.Answer = []dnsRR{{Name: question.Name, Type: typeTXT,
+			Class: classCHAOS, Data: txtData(text)}}
+	}
+	return r, true
+}
+
+// txtData encodes s as TXT record data, in 255 byte strings.
+func txtData(s string) []byte {
+	b := []byte{}
+	for {
+		n := len(s)
+		if n > 255 {
+			n = 255
+		}
+		b = append(b, byte(n))
+		b = append(b, s[:n]...)
+		s = s[n:]
+		if s == "" {
+			return b
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// "gdoh check": probe every endpoint, and print what we found, fastest
+// first, to help pick the upstreams.
+
+type checkResult struct {
+	Endpoint  string
+	Connect   time.Duration
+	Handshake time.Duration
+	Proto     string
+	TLS       string
+	Wire      time.Duration // RFC 8484 POST; 0 if unsupported
+	JSON      time.Duration // DNS-JSON GET; 0 if unsupported
+	Subject   string
+	Expires   time.Time
+	Err       error
+}
+
+func checkCommand(args []string) error {
+	var wg sync.WaitGroup
+	results := make([]checkResult, len(dohClient.Endpoints))
+	for i, endpoint := range dohClient.Endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			results[i] = checkEndpoint(endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		return a.Wire+a.JSON < b.Wire+b.JSON
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tCONNECT\tTLS\tPROTO\tWIRE\tJSON\tCERT\tEXPIRES")
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s\terror: %s\n", r.Endpoint, r.Err.Error())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Endpoint, ms(r.Connect), ms(r.Handshake),
+			r.Proto+" "+r.TLS, ms(r.Wire), ms(r.JSON), r.Subject,
+			fmt.Sprintf("%dd", int(time.Until(r.Expires).Hours()/24)))
+	}
+	return w.Flush()
+}
+
+func ms(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", d.Seconds()*1000)
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+// checkEndpoint probes a single endpoint, over a fresh connection (so
+// that we see the handshake), set up the same way the server does it.
+func checkEndpoint(endpoint string) checkResult {
+	result := checkResult{Endpoint: endpoint}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	transport := dohClient.Client.Transport.(*endpointTransports).
+		forHost(u.Hostname()).Clone()
+	client := &http.Client{Transport: cleanHeaders{transport}, Timeout: *requestTimeout}
+	defer transport.CloseIdleConnections()
+
+	var connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(_, _ string) { connectStart = time.Now() },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				result.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			result.Handshake = time.Since(tlsStart)
+			result.TLS = tlsVersions[cs.Version]
+			if len(cs.PeerCertificates) > 0 {
+				cert := cs.PeerCertificates[0]
+				result.Subject = cert.Subject.CommonName
+				result.Expires = cert.NotAfter
+			}
+		},
+	}
+
+	// RFC 8484 first; this also sets up the connection.
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{normalizeName(*canary), typeA, classINET}},
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(q.pack()))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	addEndpointHeaders(req)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	start := time.Now()
+	r, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	elapsed := time.Since(start) - result.Connect - result.Handshake
+	result.Proto = r.Proto
+	if err := checkProto(endpoint, u.Hostname(), r.Proto, r.ProtoMajor); err != nil {
+		result.Err = err
+		return result
+	}
+	if _, perr := parseMsg(body); err == nil && perr == nil && r.StatusCode == 200 {
+		result.Wire = elapsed
+	}
+
+	// Then DNS-JSON, over the same connection.
+	u.RawQuery = url.Values{"name": {*canary}, "type": {"A"}}.Encode()
+	req, err = http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	addEndpointHeaders(req)
+	start = time.Now()
+	r, err = client.Do(req)
+	if err != nil {
+		return result
+	}
+	defer r.Body.Close()
+	var v struct{ Status *int }
+	if json.NewDecoder(r.Body).Decode(&v) == nil && v.Status != nil &&
+		r.StatusCode == 200 {
+		result.JSON = time.Since(start)
+	}
+	return result
+}
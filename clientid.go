@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telling clients apart by more than their address, which DHCP hands
+// out anew every so often. Wherever a rule takes a client address
+// (-policy, -block-type), it also takes:
+//
+//	aa:bb:cc:dd:ee:ff     a MAC address: from the neighbor table, when
+//	                      gdoh runs on the router (Linux only), or from
+//	                      the query, as dnsmasq's --add-mac puts it
+//	id:NAME               a client ID the query comes with, as
+//	                      dnsmasq's --add-cpe-id puts it
+//	on:NAME               whoever comes in on a named listener (see
+//	                      listener.go)
+//
+// The EDNS options carrying them stop here: upstream has no business
+// knowing the MAC addresses on the LAN.
+
+const (
+	optMAC      = 65001 // dnsmasq --add-mac, binary
+	optClientID = 65074 // dnsmasq --add-cpe-id, text
+)
+
+// identifiedAddr is a client address, with whatever else the query
+// told us about the client. It prints (and logs) as the address.
+type identifiedAddr struct {
+	net.Addr
+	mac      net.HardwareAddr
+	id       string
+	listener string
+}
+
+// identify picks the client ID options out of q, removing them, and
+// returns the client with what they said; stripped tells whether q
+// changed.
+func identify(q *dnsMsg, client net.Addr) (net.Addr, bool) {
+	opt := q.opt()
+	if opt == nil || len(opt.Data) == 0 {
+		return client, false
+	}
+	opts, err := parseOptions(opt.Data)
+	if err != nil {
+		return client, false
+	}
+	ia := &identifiedAddr{Addr: client}
+	if on, ok := client.(*identifiedAddr); ok {
+		ia = &identifiedAddr{Addr: on.Addr, listener: on.listener}
+	}
+	kept := opts[:0]
+	for _, o := range opts {
+		switch {
+		case o.Code == optMAC && (len(o.Data) == 6 || len(o.Data) == 8):
+			ia.mac = append(net.HardwareAddr(nil), o.Data...)
+		case o.Code == optClientID && len(o.Data) > 0:
+			ia.id = string(o.Data)
+		default:
+			kept = append(kept, o)
+		}
+	}
+	if len(kept) == len(opts) {
+		return client, false
+	}
+	opt.Data = packOptions(kept)
+	return ia, true
+}
+
+// clientMatcher is the client part of a rule: an address range, a
+// MAC address, a client ID, or a listener.
+type clientMatcher struct {
+	ipnet    *net.IPNet
+	mac      net.HardwareAddr
+	id       string
+	listener string
+}
+
+func parseClientMatcher(v string) (clientMatcher, error) {
+	if strings.HasPrefix(v, "id:") && len(v) > 3 {
+		return clientMatcher{id: v[3:]}, nil
+	}
+	if strings.HasPrefix(v, "on:") && len(v) > 3 {
+		return clientMatcher{listener: v[3:]}, nil
+	}
+	if mac, err := net.ParseMAC(v); err == nil {
+		neighbors.wanted = true
+		return clientMatcher{mac: mac}, nil
+	}
+	if !strings.Contains(v, "/") {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+			v += "/32"
+		} else {
+			v += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(v)
+	if err != nil {
+		return clientMatcher{}, err
+	}
+	return clientMatcher{ipnet: ipnet}, nil
+}
+
+// specificity orders the matchers: the longer the prefix, the more
+// specific, and a MAC or an ID beats any address; a listener, none.
+func (m clientMatcher) specificity() int {
+	if m.listener != "" {
+		return -1
+	}
+	if m.ipnet == nil {
+		return 129
+	}
+	bits, _ := m.ipnet.Mask.Size()
+	return bits
+}
+
+func (m clientMatcher) match(client net.Addr) bool {
+	if client == nil {
+		return false
+	}
+	ia, _ := client.(*identifiedAddr)
+	switch {
+	case m.listener != "":
+		return ia != nil && ia.listener == m.listener
+	case m.id != "":
+		return ia != nil && ia.id == m.id
+	case m.mac != nil:
+		mac := net.HardwareAddr(nil)
+		if ia != nil {
+			mac = ia.mac
+		}
+		if mac == nil {
+			mac = neighbors.lookup(clientHost(client.String()))
+		}
+		return bytes.Equal(mac, m.mac)
+	}
+	ip := net.ParseIP(clientHost(client.String()))
+	return ip != nil && m.ipnet.Contains(ip)
+}
+
+// Read the neighbor table again after this long.
+const neighborsFresh = 30 * time.Second
+
+// neighborTable is the kernel's ARP and NDP tables, as of lately.
+type neighborTable struct {
+	sync.Mutex
+	wanted bool // set when a rule wants a MAC address
+	macs   map[string]net.HardwareAddr
+	read   time.Time
+}
+
+var neighbors = &neighborTable{}
+
+func (nt *neighborTable) lookup(ip string) net.HardwareAddr {
+	if !nt.wanted {
+		return nil
+	}
+	nt.Lock()
+	defer nt.Unlock()
+	if time.Since(nt.read) > neighborsFresh {
+		nt.macs = readNeighbors()
+		nt.read = time.Now()
+	}
+	return nt.macs[ip]
+}
+
+// readNeighbors reads the neighbor tables: /proc/net/arp for IPv4,
+// and "ip -6 neigh" for IPv6 (there's no /proc file for that one).
+// Whatever isn't there, isn't.
+func readNeighbors() map[string]net.HardwareAddr {
+	macs := map[string]net.HardwareAddr{}
+	if f, err := os.Open("/proc/net/arp"); err == nil {
+		s := bufio.NewScanner(f)
+		s.Scan() // the header
+		for s.Scan() {
+			// IP address, HW type, Flags, HW address, Mask, Device
+			fields := strings.Fields(s.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			if mac, err := net.ParseMAC(fields[3]); err == nil && !zeroMAC(mac) {
+				macs[fields[0]] = mac
+			}
+		}
+		f.Close()
+	}
+	out, err := exec.Command("ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return macs
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// fe80::1 dev eth0 lladdr aa:bb:cc:dd:ee:ff REACHABLE
+		fields := strings.Fields(line)
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			ip := net.ParseIP(fields[0])
+			mac, err := net.ParseMAC(fields[i+1])
+			if ip != nil && err == nil {
+				macs[ip.String()] = mac
+			}
+		}
+	}
+	return macs
+}
+
+func zeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// describeClient is what the traces say about who's asking.
+func describeClient(client net.Addr) string {
+	ia, ok := client.(*identifiedAddr)
+	if !ok {
+		return fmt.Sprint(client)
+	}
+	s := ia.Addr.String()
+	if ia.mac != nil {
+		s += " mac " + ia.mac.String()
+	}
+	if ia.id != "" {
+		s += " id " + ia.id
+	}
+	if ia.listener != "" {
+		s += " on " + ia.listener
+	}
+	return s
+}
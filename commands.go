@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+)
+
+// Subcommands. The global flags go before the command name (or after
+// it, for serve); commands with flags of their own take them after:
+//
+//	gdoh -config /etc/gdoh.conf query -json example.com AAAA
+
+// version is set at build time, with:
+//
+//	go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+type command struct {
+	name  string
+	usage string
+	// Whether the command needs the configuration loaded (see setup).
+	setup bool
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	// In init(), since help refers back to the list.
+	commands = []command{
+		{"serve", "serve         run the server (the default)", true, serveCommand},
+		{"query", "query         NAME [TYPE]: a one-off lookup", true, queryCommand},
+		{"check", "check         probe the endpoints", true, checkCommand},
+		{"resolve", "resolve       [-f FILE]: look up a list of names, in bulk", true, resolveCommand},
+		{"bench", "bench         NAME...: measure the endpoints' latency", true, benchCommand},
+		{"trace", "trace         NAME [TYPE]: show what happens to a query, step by step", true, traceCommand},
+		{"replay", "replay        FILE: run recorded queries through the config", true, replayCommand},
+		{"ddr", "ddr           discover the network's designated resolvers", false, ddrCommand},
+		{"mockserver", "mockserver    FILE: serve canned answers, for testing", false, mockServerCommand},
+		{"config", "config        validate: check the configuration", false, configCommand},
+		{"cache", "cache         flush [NAME]: flush the running server's cache", false, cacheCommand},
+		{"healthcheck", "healthcheck   ask the running server whether it's well, for containers", false, healthcheckCommand},
+		{"reload-lists", "reload-lists  reload the running server's blocklists", false, reloadListsCommand},
+		{"pause", "pause         DURATION: pause filtering on the running server", false, pauseCommand},
+		{"vpn", "vpn           [NAME up [ADDRESS] | NAME down]: switch a -vpn on the running server", false, vpnCommand},
+		{"activate", "activate      point the system resolver at gdoh", false, noArgs(activate)},
+		{"deactivate", "deactivate    undo activate", false, noArgs(deactivate)},
+		{"version", "version       print the version", false, versionCommand},
+		{"help", "help          this text", false, helpCommand},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func noArgs(f func() error) func([]string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errors.New("No arguments expected")
+		}
+		return f()
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: gdoh [flags] [command] [args]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintln(out, "  "+cmd.usage)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func helpCommand(args []string) error {
+	flag.CommandLine.SetOutput(os.Stdout)
+	usage()
+	return nil
+}
+
+func versionCommand(args []string) error {
+	fmt.Printf("gdoh %s (%s %s/%s)\n", version, runtime.Version(),
+		runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// reloadListsCommand implements "gdoh reload-lists".
+func reloadListsCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("Usage: gdoh reload-lists")
+	}
+	body, err := adminCall("POST", "/api/blocklist/reload", nil)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	return nil
+}
+
+// cacheCommand implements "gdoh cache flush [NAME]".
+func cacheCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 || args[0] != "flush" {
+		return errors.New("Usage: gdoh cache flush [NAME]")
+	}
+	params := url.Values{}
+	if len(args) == 2 {
+		params.Set("name", args[1])
+	}
+	body, err := adminCall("POST", "/api/cache/flush", params)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	return nil
+}
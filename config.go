@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Configuration is just flags: the -config file sets them too, one
+// per line, as in:
+//
+//	# Comments start with a hash.
+//	listen 127.0.0.1:53
+//	block = /etc/gdoh/ads.txt
+//	flatten-cnames
+//	include /etc/gdoh/conf.d/*.conf
+//
+// Flags given on the command line win over the file. An include is
+// read in place, its files in lexical order, so that packages and
+// configuration management can drop in fragments (a blocklist, the
+// local leases) without editing the main file: a repeatable flag
+// collects the values of all the files, and for the others, the last
+// word wins. A relative include is relative to the file it's in; a
+// pattern that matches nothing is no error, a path that isn't there
+// is.
+
+var configFile = flag.String("config", "",
+	"Read flags from this file: one per line, name value")
+
+// stringsFlag is a repeatable string flag. The first value given
+// replaces the default, any further ones append. If check is set,
+// every value has to pass it.
+type stringsFlag struct {
+	values []string
+	set    bool
+	check  func(string) error
+}
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	if f.check != nil {
+		if err := f.check(v); err != nil {
+			return err
+		}
+	}
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	f.values = append(f.values, v)
+	return nil
+}
+
+// choiceFlag is a string flag, that only takes one of a few values.
+type choiceFlag struct {
+	value   string
+	choices []string
+}
+
+func (f *choiceFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *choiceFlag) Set(v string) error {
+	for _, c := range f.choices {
+		if v == c {
+			f.value = v
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: want one of: %s", v, strings.Join(f.choices, ", "))
+}
+
+// configLine is a flag setting read from a file.
+type configLine struct {
+	file  string
+	line  int
+	name  string
+	value string
+}
+
+func (l configLine) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.file, l.line,
+		fmt.Sprintf(format, args...))
+}
+
+// Includes nested deeper than this are a loop, most likely one we
+// failed to spot.
+const maxIncludeDepth = 8
+
+func readConfig(path string) ([]configLine, error) {
+	return readConfigFile(path, map[string]bool{})
+}
+
+// readConfigFile reads a config file, and the ones it includes; seen
+// are the files it's been included from.
+func readConfigFile(path string, seen map[string]bool) ([]configLine, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("%s: included from itself", path)
+	}
+	if len(seen) >= maxIncludeDepth {
+		// Through a symlink, say; or just that many files deep.
+		return nil, fmt.Errorf("%s: includes nested more than %d deep", path, maxIncludeDepth)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := []configLine{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l := configLine{file: path, line: n}
+		i := strings.IndexAny(line, " \t=")
+		if i < 0 {
+			// A bare boolean flag.
+			l.name, l.value = line, "true"
+		} else {
+			l.name = line[:i]
+			l.value = strings.TrimSpace(line[i:])
+			l.value = strings.TrimSpace(strings.TrimPrefix(l.value, "="))
+		}
+		l.name = strings.TrimLeft(l.name, "-")
+		if l.name == "include" {
+			included, err := readInclude(l, seen)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, included...)
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, s.Err()
+}
+
+// readInclude reads the files an include line names.
+func readInclude(l configLine, seen map[string]bool) ([]configLine, error) {
+	pattern := l.value
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(l.file), pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, l.errorf("include %s: %v", l.value, err)
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 && !strings.ContainsAny(l.value, "*?[") {
+		return nil, l.errorf("include %s: no such file", l.value)
+	}
+	lines := []configLine{}
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			continue
+		}
+		included, err := readConfigFile(path, seen)
+		if err != nil {
+			return nil, l.errorf("include %s: %v", l.value, err)
+		}
+		lines = append(lines, included...)
+	}
+	return lines, nil
+}
+
+// loadConfig applies the -config file, if any.
+func loadConfig() error {
+	if *configFile == "" {
+		return nil
+	}
+	lines, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	onCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	// Report every bad line, not just the first one.
+	errs := []error{}
+	for _, l := range lines {
+		switch {
+		case l.name == "config":
+			errs = append(errs, l.errorf("config can't be set from a config file"))
+		case flag.Lookup(l.name) == nil:
+			errs = append(errs, l.errorf("unknown setting: %s", l.name))
+		case onCommandLine[l.name]:
+		default:
+			if err := flag.Set(l.name, l.value); err != nil {
+				errs = append(errs, l.errorf("%v", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var endpointFlags = &stringsFlag{values: []string{
+	"https://1.0.0.1/dns-query",
+	"https://1.1.1.1/dns-query",
+	"https://dns.google.com/experimental",
+	"https://doh.cleanbrowsing.org/doh/security-filter/",
+	// TODO: IPv6?
+	// "https://[2606:4700:4700::1001]/dns-query",
+	// "https://[2606:4700:4700::1111]/dns-query",
+}}
+
+func init() {
+	endpointFlags.check = func(v string) error {
+		if v == "adguard:" {
+			// Wants -device-name, which may come later; setup checks.
+			return nil
+		}
+		_, _, err := normalizeEndpoint(v)
+		return err
+	}
+	flag.Var(endpointFlags, "endpoint",
+		"DoH endpoint URL (repeatable; replaces the defaults)")
+}
+
+// normalizeEndpoint cleans up an endpoint URL: "dns.example.net"
+// becomes "https://dns.example.net/dns-query". An endpoint can also
+// come with its addresses, "https://dns.quad9.net/dns-query@9.9.9.9,
+// 149.112.112.112", which are returned separately.
+func normalizeEndpoint(endpoint string) (string, []string, error) {
+	var addrs []string
+	if i := strings.LastIndex(endpoint, "@"); i >= 0 {
+		for _, addr := range strings.Split(endpoint[i+1:], ",") {
+			addr = strings.Trim(addr, "[]")
+			if net.ParseIP(addr) == nil {
+				addrs = nil
+				break
+			}
+			addrs = append(addrs, addr)
+		}
+		if addrs != nil {
+			endpoint = endpoint[:i]
+		}
+	}
+	if expanded, ok, err := expandProfile(endpoint); err != nil {
+		return "", nil, err
+	} else if ok {
+		endpoint = expanded
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Scheme != "https" {
+		return "", nil, fmt.Errorf("%s: not https", endpoint)
+	}
+	if u.Hostname() == "" {
+		return "", nil, fmt.Errorf("%s: no host", endpoint)
+	}
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	return u.String(), addrs, nil
+}
+
+// checkAddress is a check for -listen and alike.
+func checkAddress(v string) error {
+	_, _, err := net.SplitHostPort(v)
+	return err
+}
+
+// checkFile is a check for flags naming a file we'll read later.
+func checkFile(v string) error {
+	f, err := os.Open(v)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkConfig validates the configuration as a whole, and reads the
+// files it refers to. It writes nothing, and stays off the network:
+// that's for setup.
+func checkConfig() error {
+	if err := loadSecrets(); err != nil {
+		return err
+	}
+	dohClient.Endpoints = nil
+	for _, v := range endpointFlags.values {
+		endpoint, addrs, err := normalizeEndpoint(v)
+		if err != nil {
+			return err
+		}
+		if addrs != nil {
+			u, _ := url.Parse(endpoint)
+			bootstrap.pin(u.Hostname(), addrs)
+		}
+		dohClient.Endpoints = append(dohClient.Endpoints, endpoint)
+	}
+	if len(dohClient.Endpoints) == 0 {
+		return errors.New("No endpoints configured")
+	}
+	if err := loadOutbound(); err != nil {
+		return err
+	}
+	if err := checkResolverList(); err != nil {
+		return err
+	}
+	if err := loadListeners(); err != nil {
+		return err
+	}
+	if err := loadProxyProtocol(); err != nil {
+		return err
+	}
+	if err := loadRoutes(); err != nil {
+		return err
+	}
+	if err := loadViews(); err != nil {
+		return err
+	}
+	if err := loadVPNs(); err != nil {
+		return err
+	}
+	if err := loadSearch(); err != nil {
+		return err
+	}
+	if err := leases.load(leaseFlags.values, leaseFiles.values); err != nil {
+		return err
+	}
+	if err := dhcpLeases.load(); err != nil {
+		return err
+	}
+	if err := dynamicZone.load(); err != nil {
+		return err
+	}
+	if err := addresses.load(addressFlags.values); err != nil {
+		return err
+	}
+	if err := checkLoops(); err != nil {
+		return err
+	}
+	if err := loadPins(); err != nil {
+		return err
+	}
+	if err := loadCAs(); err != nil {
+		return err
+	}
+	if err := loadClientCerts(); err != nil {
+		return err
+	}
+	if err := loadTLSOptions(); err != nil {
+		return err
+	}
+	loadPower()
+	if err := loadTransportOptions(); err != nil {
+		return err
+	}
+	if err := loadEndpointHeaders(); err != nil {
+		return err
+	}
+	if err := checkTimeouts(); err != nil {
+		return err
+	}
+	if err := checkTTLs(); err != nil {
+		return err
+	}
+	if err := checkEDNS(); err != nil {
+		return err
+	}
+	if err := checkPadding(); err != nil {
+		return err
+	}
+	if err := loadDecoys(); err != nil {
+		return err
+	}
+	if err := loadSuffixes(); err != nil {
+		return err
+	}
+	loadSeed()
+	if err := loadAnswerFilters(); err != nil {
+		return err
+	}
+	if err := rewrites.load(rewriteFlags.values); err != nil {
+		return err
+	}
+	if err := blocked.load(blockFiles.values); err != nil {
+		return err
+	}
+	if err := loadPolicies(); err != nil {
+		return err
+	}
+	if err := loadTypeBlocks(); err != nil {
+		return err
+	}
+	if err := ipsets.load(ipsetFlags.values); err != nil {
+		return err
+	}
+	if err := passive.load(); err != nil {
+		return err
+	}
+	if err := loadReputation(); err != nil {
+		return err
+	}
+	if err := checkQueryLog(); err != nil {
+		return err
+	}
+	if err := checkStatsd(); err != nil {
+		return err
+	}
+	return watched.load(alertOn.values, alertLists.values)
+}
+
+// setup is checkConfig, and then the rest: the resolver list, DDR,
+// the ECH and TLSA records for the endpoints, and the query log.
+func setup() error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	if err := loadResolverList(); err != nil {
+		return err
+	}
+	if err := loadDDR(); err != nil {
+		return err
+	}
+	if err := loadECH(); err != nil {
+		return err
+	}
+	if err := loadDANE(); err != nil {
+		return err
+	}
+	return queryLog.open()
+}
+
+// configCommand implements "gdoh config validate": check everything,
+// and report. Offline: an endpoint that doesn't resolve today may
+// well tomorrow.
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return errors.New("Usage: gdoh [-config FILE] config validate")
+	}
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	for _, endpoint := range dohClient.Endpoints {
+		u, _ := url.Parse(endpoint)
+		if addrs, ok := bootstrap.pinned(u.Hostname()); ok {
+			fmt.Printf("endpoint %s (%s)\n", endpoint, strings.Join(addrs, ", "))
+			continue
+		}
+		fmt.Printf("endpoint %s\n", endpoint)
+	}
+	for _, v := range blockFiles.values {
+		category, path := parseBlockFile(v)
+		fmt.Printf("blocklist %s (%s): %d domains\n", path, category,
+			len(blocked.lists[path]))
+	}
+	fmt.Println("Config OK")
+	return nil
+}
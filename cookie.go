@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"sync"
+)
+
+// DNS Cookies (RFC 7873), on the plain DNS leg (-route dns:ADDR,
+// -search-via, captive portals, DDR): we send a client cookie, and
+// only take responses that echo it back, which an off-path spoofer
+// can't do. Once a server has sent us its own cookie, we send that
+// along, and insist on getting one in return.
+//
+// The clients' own queries get our cookie in place of theirs (theirs
+// was for us), and their responses come back the way they asked:
+// without our cookie, and without EDNS if they didn't use it.
+
+var dnsCookies = flag.Bool("dns-cookies", true,
+	"Use DNS cookies with plain DNS servers")
+
+const (
+	optCookie = 10
+	// Cookies are 8 bytes ours, and 8 to 32 bytes the server's.
+	clientCookieSize = 8
+	rcodeBadCookie   = 23
+)
+
+type cookieJar struct {
+	sync.Mutex
+	client map[string][]byte // server -> our cookie
+	server map[string][]byte // server -> its cookie
+}
+
+var cookies = &cookieJar{
+	client: map[string][]byte{},
+	server: map[string][]byte{},
+}
+
+// cookie returns what to send server.
+func (j *cookieJar) cookie(server string) []byte {
+	j.Lock()
+	defer j.Unlock()
+	c, ok := j.client[server]
+	if !ok {
+		c = make([]byte, clientCookieSize)
+		if _, err := rand.Read(c); err != nil {
+			panic(err)
+		}
+		j.client[server] = c
+	}
+	return append(append([]byte(nil), c...), j.server[server]...)
+}
+
+// check tells whether r came from server, learning its cookie if so.
+func (j *cookieJar) check(server string, r *dnsMsg) bool {
+	var got []byte
+	if opt := r.opt(); opt != nil {
+		opts, err := parseOptions(opt.Data)
+		if err != nil {
+			return false
+		}
+		for _, o := range opts {
+			if o.Code == optCookie {
+				got = o.Data
+			}
+		}
+	}
+	j.Lock()
+	defer j.Unlock()
+	if got == nil {
+		// Fine, unless it's done cookies with us before.
+		return j.server[server] == nil
+	}
+	if len(got) < clientCookieSize+8 || len(got) > clientCookieSize+32 ||
+		!bytes.Equal(got[:clientCookieSize], j.client[server]) {
+		return false
+	}
+	j.server[server] = append([]byte(nil), got[clientCookieSize:]...)
+	return true
+}
+
+// withCookie returns q with server's cookie in an OPT record (in
+// place of any cookie q had).
+func withCookie(q *dnsMsg, server string) *dnsMsg {
+	m := q.copy()
+	opt := m.opt()
+	if opt == nil {
+		m.Additional = append(m.Additional, dnsRR{
+			Name: ".", Type: typeOPT, Class: ednsPayload()})
+		opt = m.opt()
+	}
+	opts, _ := parseOptions(opt.Data)
+	opts = append(withoutCookie(opts), ednsOption{optCookie, cookies.cookie(server)})
+	opt.Data = packOptions(opts)
+	return m
+}
+
+func withoutCookie(opts []ednsOption) []ednsOption {
+	kept := []ednsOption{}
+	for _, o := range opts {
+		if o.Code != optCookie {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// extendedRcode is r's rcode, with the upper bits from EDNS.
+func extendedRcode(r *dnsMsg) int {
+	rcode := r.rcode()
+	if opt := r.opt(); opt != nil {
+		rcode |= int(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// cookieExchange is udpExchange, with cookies. The response is for the
+// client who sent q: no cookie, and no EDNS unless q had it.
+func cookieExchange(ctx context.Context, server string, q *dnsMsg) ([]byte, error) {
+	accept := func(resp []byte) bool {
+		r, err := parseMsg(resp)
+		return err == nil && cookies.check(server, r)
+	}
+	var r *dnsMsg
+	// One more try on BADCOOKIE: the response tells us the cookie
+	// the server wants now.
+	for try := 0; try < 2; try++ {
+		if try > 0 && ctx.Err() != nil {
+			// Too late for another go.
+			return nil, ctx.Err()
+		}
+		resp, err := exchangeUDP(ctx, server, withCookie(q, server).pack(), accept)
+		if err != nil {
+			return nil, err
+		}
+		r, err = parseMsg(resp)
+		if err != nil {
+			return nil, err
+		}
+		if r.rcode() == rcodeFormErr && q.opt() == nil {
+			// Doesn't do EDNS at all, it seems.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return exchangeUDP(ctx, server, q.pack(), nil)
+		}
+		if extendedRcode(r) != rcodeBadCookie {
+			break
+		}
+	}
+	if opt := r.opt(); opt != nil {
+		if q.opt() == nil {
+			additional := []dnsRR{}
+			for _, rr := range r.Additional {
+				if rr.Type != typeOPT {
+					additional = append(additional, rr)
+				}
+			}
+			r.Additional = additional
+		} else if opts, err := parseOptions(opt.Data); err == nil {
+			opt.Data = packOptions(withoutCookie(opts))
+		}
+	}
+	return r.pack(), nil
+}
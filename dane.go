@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DANE (RFC 6698, RFC 7671): check the endpoint's certificate against
+// the TLSA records of its name, looked up through the bootstrap
+// resolver. Only records the resolver vouches for with DNSSEC (the AD
+// bit) count; this is on top of the usual certificate checks, so a
+// DANE-only (self-signed) certificate won't do.
+//
+// With -dane on, endpoints with TLSA records must match them; with
+// -dane require, endpoints without any aren't used at all. The records
+// are looked up for the endpoints at startup, for the new ones when
+// the resolver list changes, and again when their TTL runs out.
+
+var daneMode = &choiceFlag{value: "off", choices: []string{"off", "on", "require"}}
+
+func init() {
+	flag.Var(daneMode, "dane",
+		"Check endpoint certificates against DNSSEC-signed TLSA records: off, on (where available), or require")
+}
+
+var (
+	// ErrNoDANE is returned by endpoints without TLSA records, under
+	// -dane require.
+	ErrNoDANE = errors.New("Endpoint has no DNSSEC-signed TLSA records")
+	// ErrDANEMismatch is returned when the certificate doesn't match
+	// any TLSA record.
+	ErrDANEMismatch = errors.New("Certificate doesn't match TLSA records")
+)
+
+const (
+	typeTLSA = 52
+	// The DO bit, in the OPT record's TTL.
+	ednsDO = 1 << 15
+)
+
+type tlsaRecord struct {
+	usage, selector, matching byte
+	data                      []byte
+}
+
+// TLSA records, by host:port, until they expire; an empty list is a
+// host without any.
+type tlsaEntry struct {
+	records []tlsaRecord
+	expires time.Time
+}
+
+var tlsaRecords = struct {
+	sync.Mutex
+	hosts map[string]tlsaEntry
+	// The port each endpoint host is on, when it's not 443.
+	ports map[string]string
+}{hosts: map[string]tlsaEntry{}, ports: map[string]string{}}
+
+// TTLs: the records' own, within reason; for no records, this.
+const (
+	minTLSATTL      = time.Minute
+	noTLSATTL       = 5 * time.Minute
+	tlsRecordsCheck = time.Minute
+)
+
+// loadDANE fetches the TLSA records of every endpoint.
+func loadDANE() error {
+	daneFor(dohClient.endpoints())
+	return nil
+}
+
+// daneFor fetches the TLSA records of the endpoints that don't have
+// fresh ones: for a new set of endpoints, before they're used, and
+// when the records expire.
+func daneFor(endpoints []string) {
+	if daneMode.value == "off" {
+		return
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			continue
+		}
+		host, port := strings.ToLower(u.Hostname()), u.Port()
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		if port == "" {
+			port = "443"
+		}
+		tlsaRecords.Lock()
+		tlsaRecords.ports[host] = port
+		tlsaRecords.Unlock()
+		if _, fresh := cachedTLSA(host, port); !fresh {
+			fetchTLSA(host, port)
+		}
+	}
+}
+
+func cachedTLSA(host, port string) (records []tlsaRecord, fresh bool) {
+	tlsaRecords.Lock()
+	defer tlsaRecords.Unlock()
+	e, ok := tlsaRecords.hosts[net.JoinHostPort(host, port)]
+	return e.records, ok && time.Now().Before(e.expires)
+}
+
+// fetchTLSA looks up host:port's TLSA records; if that fails, the old
+// ones, if any, stay.
+func fetchTLSA(host, port string) []tlsaRecord {
+	records, ttl, err := lookupTLSA(host, port)
+	if err != nil {
+		log.Printf("dane error: %s: %s", host, err.Error())
+		old, _ := cachedTLSA(host, port)
+		return old
+	}
+	if len(records) == 0 {
+		log.Printf("No TLSA records for %s", host)
+		ttl = noTLSATTL
+	}
+	if ttl < minTLSATTL {
+		ttl = minTLSATTL
+	}
+	tlsaRecords.Lock()
+	tlsaRecords.hosts[net.JoinHostPort(host, port)] = tlsaEntry{records, time.Now().Add(ttl)}
+	tlsaRecords.Unlock()
+	return records
+}
+
+// tlsaFor is host:port's TLSA records, looked up if they're not known
+// yet, or expired.
+func tlsaFor(host, port string) []tlsaRecord {
+	if records, fresh := cachedTLSA(host, port); fresh {
+		return records
+	}
+	return fetchTLSA(host, port)
+}
+
+// refreshTLSRecords keeps the endpoints' TLSA records and ECH
+// configurations fresh.
+func refreshTLSRecords() {
+	if daneMode.value == "off" && echMode.value == "off" {
+		return
+	}
+	for range backgroundTick(tlsRecordsCheck) {
+		endpoints := dohClient.endpoints()
+		daneFor(endpoints)
+		echFor(endpoints)
+	}
+}
+
+// lookupTLSA finds the DNSSEC-validated TLSA records for host:port,
+// and for how long they're good.
+func lookupTLSA(host, port string) ([]tlsaRecord, time.Duration, error) {
+	q := &dnsMsg{
+		Flags: flagRD | flagAD,
+		Question: []dnsQuestion{{
+			"_" + port + "._tcp." + normalizeName(host), typeTLSA, classINET}},
+		Additional: []dnsRR{{Name: ".", Type: typeOPT,
+			Class: ednsPayload(), TTL: ednsDO}},
+	}
+	resp, err := rootDohClient.RawQuery(q.pack())
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Flags&flagAD == 0 {
+		return nil, 0, nil
+	}
+	records := []tlsaRecord{}
+	ttl := time.Duration(0)
+	for _, rr := range r.Answer {
+		if rr.Type != typeTLSA || len(rr.Data) < 4 {
+			continue
+		}
+		records = append(records, tlsaRecord{
+			rr.Data[0], rr.Data[1], rr.Data[2], rr.Data[3:]})
+		if d := time.Duration(rr.TTL) * time.Second; ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	return records, ttl, nil
+}
+
+// verifyDANE checks the connection to host:port against its TLSA
+// records.
+func verifyDANE(host, port string, cs tls.ConnectionState) error {
+	if daneMode.value == "off" || net.ParseIP(host) != nil {
+		return nil
+	}
+	records := tlsaFor(host, port)
+	if len(records) == 0 {
+		if daneMode.value == "require" {
+			return ErrNoDANE
+		}
+		return nil
+	}
+	for _, rec := range records {
+		// PKIX-EE and DANE-EE are about the server's own certificate;
+		// PKIX-TA and DANE-TA about an issuer, anywhere in a chain
+		// that checks out - not just any certificate the server
+		// sent along.
+		if rec.usage == 1 || rec.usage == 3 {
+			if len(cs.PeerCertificates) > 0 && tlsaMatch(rec, cs.PeerCertificates[0]) {
+				return nil
+			}
+			continue
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if tlsaMatch(rec, cert) {
+					return nil
+				}
+			}
+		}
+	}
+	log.Printf("dane error: %s: no matching TLSA record, refusing to talk", host)
+	return ErrDANEMismatch
+}
+
+// endpointPort is the port host is connected to on, as an endpoint.
+func endpointPort(host string) string {
+	tlsaRecords.Lock()
+	defer tlsaRecords.Unlock()
+	if port, ok := tlsaRecords.ports[host]; ok {
+		return port
+	}
+	return "443"
+}
+
+func tlsaMatch(rec tlsaRecord, cert *x509.Certificate) bool {
+	var data []byte
+	switch rec.selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch rec.matching {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return string(data) == string(rec.data)
+}
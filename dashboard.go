@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// The dashboard: a single page, served from the admin listener,
+// which polls the admin API. No external resources, so it works on
+// an offline router just as well.
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allow(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+func adminRecent(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	writeJSON(w, recent.list(intParam(r, "n", 50)))
+}
+
+func adminTop(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	writeJSON(w, aggregated.report(intParam(r, "n", 10)))
+}
+
+// intParam reads a positive integer form value, or returns def.
+func intParam(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>gdoh</title>
+<style>
+body { font: 14px sans-serif; margin: 1em auto; max-width: 60em; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.2em 0.5em; }
+tr:nth-child(even) { background: #f4f4f4; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.big { font-size: 2em; }
+.tiles { display: flex; gap: 2em; flex-wrap: wrap; }
+.bad { color: #b00; }
+#spark { font-family: monospace; letter-spacing: -1px; }
+</style>
+</head>
+<body>
+<h1>gdoh</h1>
+<div class="tiles">
+<div><div class="big" id="rate">-</div>queries/s <span id="spark"></span></div>
+<div><div class="big" id="total">-</div>queries</div>
+<div><div class="big" id="blocked">-</div>blocked</div>
+<div><div class="big" id="hits">-</div>cache hits</div>
+</div>
+<h2>Endpoints</h2>
+<table id="endpoints"></table>
+<div class="tiles">
+<div style="flex: 1"><h2>Top domains</h2><table id="top"></table></div>
+<div style="flex: 1"><h2>Top blocked</h2><table id="topblocked"></table></div>
+<div style="flex: 1"><h2>Top clients</h2><table id="topclients"></table></div>
+</div>
+<h2>Recent queries</h2>
+<table id="recent"></table>
+<script>
+var last = null, rates = [];
+function pct(a, b) { return b ? (100 * a / b).toFixed(1) + "%" : "-"; }
+function esc(s) {
+	return String(s).replace(/[&<>"]/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+	});
+}
+function client(addr, device) {
+	return device ? esc(device) + " <small>" + esc(addr) + "</small>" : esc(addr);
+}
+function table(id, head, rows) {
+	var h = "<tr>" + head.map(function(c) { return "<th>" + c + "</th>"; }).join("") + "</tr>";
+	rows.forEach(function(r) {
+		h += "<tr>" + r.map(function(c) {
+			return typeof c === "number" ? '<td class="num">' + c + "</td>" : "<td>" + c + "</td>";
+		}).join("") + "</tr>";
+	});
+	document.getElementById(id).innerHTML = h;
+}
+function get(path) {
+	return fetch(path, {credentials: "same-origin"}).then(function(r) { return r.json(); });
+}
+function update() {
+	get("api/stats").then(function(s) {
+		var c = s.counters, now = Date.now();
+		if (last) {
+			var rate = (c.queries - last.c.queries) * 1000 / (now - last.t);
+			document.getElementById("rate").textContent = rate.toFixed(1);
+			rates.push(rate);
+			if (rates.length > 30) rates.shift();
+			var max = Math.max.apply(null, rates) || 1;
+			document.getElementById("spark").textContent = rates.map(function(r) {
+				return "▁▂▃▄▅▆▇█"[Math.round(7 * r / max)];
+			}).join("");
+		}
+		last = {c: c, t: now};
+		document.getElementById("total").textContent = c.queries;
+		document.getElementById("blocked").textContent = pct(c.blocked, c.queries);
+		document.getElementById("hits").textContent = pct(c.cache_hits, c.cache_hits + c.cache_misses);
+	});
+	get("api/endpoints").then(function(es) {
+		table("endpoints", ["Endpoint", "Health", "p50 (ms)", "p95", "p99", "Queries", "Errors", "Recent errors"],
+			es.map(function(e) {
+				return [esc(e.endpoint),
+					e.healthy ? "ok" : '<span class="bad">down</span>',
+					e.p50_ms, e.p95_ms, e.p99_ms, e.queries, e.errors,
+					pct(e.error_rate, 1)];
+			}));
+	});
+	get("api/top").then(function(t) {
+		var row = function(nc) { return [esc(nc.name), nc.count]; };
+		table("top", ["Name", "Queries"], t.domains.map(row));
+		table("topblocked", ["Name", "Queries"], t.blocked.map(row));
+		table("topclients", ["Client", "Queries"], t.clients.map(function(nc) {
+			return [client(nc.name, (t.devices || {})[nc.name]), nc.count];
+		}));
+	});
+	get("api/recent?n=50").then(function(qs) {
+		table("recent", ["Time", "Client", "Name", "Type", "Outcome", "ms"],
+			qs.map(function(q) {
+				return [new Date(q.time).toLocaleTimeString(), client(q.client, q.device),
+					esc(q.name), esc(q.type),
+					q.outcome === "error" ? '<span class="bad">error</span>' : esc(q.outcome),
+					Math.round(q.duration_ms)];
+			}));
+	});
+}
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
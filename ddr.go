@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery of Designated Resolvers (RFC 9462): ask the network's own
+// resolver (the one DHCP handed out) about "_dns.resolver.arpa", and
+// see if it has an encrypted twin. We only take one which proves it's
+// the same resolver: its certificate has to cover the address we
+// asked (the "verified discovery" of section 4.2).
+//
+// With -ddr prefer, designated resolvers found at startup take the
+// place of the configured endpoints; "gdoh ddr" just shows them.
+
+var ddrMode = &choiceFlag{value: "off", choices: []string{"off", "prefer"}}
+var ddrResolver = flag.String("ddr-resolver", "",
+	"Network resolver to discover designated resolvers from (default: from /etc/resolv.conf, or the DHCP client's)")
+
+func init() {
+	flag.Var(ddrMode, "ddr",
+		"Discovery of Designated Resolvers: off, or prefer (use them instead of -endpoint)")
+}
+
+// SVCB SvcParamKeys (RFC 9460, RFC 9461).
+const (
+	typeSVCB        = 64
+	svcParamALPN    = 1
+	svcParamPort    = 3
+	svcParamIPv4    = 4
+	svcParamIPv6    = 6
+	svcParamDoHPath = 7
+)
+
+type designatedResolver struct {
+	Endpoint string
+	Addrs    []string
+}
+
+// Where else the network's resolver may be written down, when
+// resolv.conf only has us (after "gdoh activate"), or a local stub:
+// our own backup, the upstreams of systemd-resolved, NetworkManager
+// and resolvconf, and the DHCP client's leases.
+var resolverFiles = []string{
+	resolvConfBackup,
+	"/run/systemd/resolve/resolv.conf",
+	"/run/NetworkManager/no-stub-resolv.conf",
+	"/run/resolvconf/interface/*",
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/dhclient/dhclient*.leases",
+}
+
+// ddrResolverAddr picks the network resolver: the first non-local
+// nameserver in resolv.conf, or failing that, in resolverFiles,
+// unless given.
+func ddrResolverAddr() (string, error) {
+	if *ddrResolver != "" {
+		return *ddrResolver, nil
+	}
+	if server, ok := networkResolverIn(resolvConf); ok {
+		return server, nil
+	}
+	for _, pattern := range resolverFiles {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			if strings.HasSuffix(path, "/"+resolvconfIface) {
+				continue
+			}
+			if server, ok := networkResolverIn(path); ok {
+				return server, nil
+			}
+		}
+	}
+	return "", errors.New("No network resolver found in /etc/resolv.conf, " +
+		"or the DHCP client's files; set -ddr-resolver")
+}
+
+// networkResolverIn finds the first non-local nameserver in a
+// resolv.conf, or a dhclient lease file (the last lease's, which is
+// the latest).
+func networkResolverIn(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	found := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "option domain-name-servers ") {
+			// option domain-name-servers 192.168.1.1, 192.168.1.2;
+			servers := strings.TrimSuffix(line[len("option domain-name-servers "):], ";")
+			for _, server := range strings.Split(servers, ",") {
+				server = strings.TrimSpace(server)
+				if ip := net.ParseIP(server); ip != nil && !localAddr(ip) {
+					found = server
+					break
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && !localAddr(ip) {
+			return fields[1], true
+		}
+	}
+	return found, found != ""
+}
+
+// udpQuery asks a plain old DNS server.
+func udpQuery(server string, q *dnsMsg) (*dnsMsg, error) {
+	resp, err := udpExchange(context.Background(), server, q.pack())
+	if err != nil {
+		return nil, err
+	}
+	return parseMsg(resp)
+}
+
+// udpExchange sends a query to a plain old DNS server (port 53,
+// unless given), and waits for the response with its ID; see also
+// cookieExchange.
+func udpExchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, ErrResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	if *dnsCookies {
+		if q, err := parseMsg(query); err == nil {
+			return cookieExchange(ctx, server, q)
+		}
+	}
+	return exchangeUDP(ctx, server, query, nil)
+}
+
+// exchangeUDP does the actual exchange, taking the first response
+// with the right ID that accept (if given) likes. It gives up when
+// ctx does: the client has, by then.
+func exchangeUDP(ctx context.Context, server string, query []byte, accept func([]byte) bool) ([]byte, error) {
+	conn, err := (&net.Dialer{Timeout: *dialTimeout}).DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(*requestTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 12 && buf[0] == query[0] && buf[1] == query[1] &&
+			(accept == nil || accept(buf[:n])) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// discoverResolvers finds the network resolver's verified designated
+// DoH resolvers.
+func discoverResolvers() ([]designatedResolver, error) {
+	server, err := ddrResolverAddr()
+	if err != nil {
+		return nil, err
+	}
+	q := &dnsMsg{
+		ID:         randomID(),
+		Flags:      flagRD,
+		Question:   []dnsQuestion{{"_dns.resolver.arpa.", typeSVCB, classINET}},
+		Additional: []dnsRR{{Name: ".", Type: typeOPT, Class: ednsPayload()}},
+	}
+	r, err := udpQuery(server, q)
+	if err != nil {
+		return nil, err
+	}
+	found := []designatedResolver{}
+	for _, rr := range r.Answer {
+		if rr.Type != typeSVCB {
+			continue
+		}
+		dr, err := parseDesignated(rr.Data)
+		if err != nil {
+			continue
+		}
+		if err := verifyDesignated(dr, server); err != nil {
+			log.Printf("ddr error: %s: %s", dr.Endpoint, err.Error())
+			continue
+		}
+		found = append(found, dr)
+	}
+	return found, nil
+}
+
+// parseDesignated makes a DoH endpoint out of SVCB record data, if
+// it describes one.
+func parseDesignated(data []byte) (designatedResolver, error) {
+	dr := designatedResolver{}
+	if len(data) < 2 || binary.BigEndian.Uint16(data) == 0 {
+		return dr, errors.New("alias mode")
+	}
+	target, _, err := readName(data, 2)
+	if err != nil {
+		return dr, err
+	}
+	path := string(svcParam(data, svcParamDoHPath))
+	if path == "" {
+		return dr, errors.New("not DoH")
+	}
+	path = strings.SplitN(path, "{", 2)[0]
+	host := strings.TrimSuffix(target, ".")
+	if port := svcParam(data, svcParamPort); len(port) == 2 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	}
+	dr.Endpoint = "https://" + host + path
+	for _, hint := range []struct {
+		key  uint16
+		size int
+	}{{svcParamIPv4, net.IPv4len}, {svcParamIPv6, net.IPv6len}} {
+		b := svcParam(data, hint.key)
+		for len(b) >= hint.size {
+			dr.Addrs = append(dr.Addrs, net.IP(b[:hint.size]).String())
+			b = b[hint.size:]
+		}
+	}
+	return dr, nil
+}
+
+// verifyDesignated connects to dr, and checks that the certificate
+// is good for its name, and for the address of the network resolver.
+func verifyDesignated(dr designatedResolver, server string) error {
+	host, port := designatedHostPort(dr.Endpoint)
+	addr := host
+	if len(dr.Addrs) > 0 {
+		addr = dr.Addrs[0]
+	}
+	dialer := &net.Dialer{Timeout: *dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(addr, port),
+		&tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if err := cert.VerifyHostname(server); err != nil {
+		return fmt.Errorf("not designated by %s: %v", server, err)
+	}
+	return nil
+}
+
+func designatedHostPort(endpoint string) (string, string) {
+	hostport := strings.SplitN(strings.TrimPrefix(endpoint, "https://"), "/", 2)[0]
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		return host, port
+	}
+	return hostport, "443"
+}
+
+// loadDDR swaps the endpoints for the designated resolvers, if asked
+// to, and if there are any.
+func loadDDR() error {
+	if ddrMode.value == "off" {
+		return nil
+	}
+	found, err := discoverResolvers()
+	if err != nil {
+		log.Printf("ddr error: %s", err.Error())
+		return nil
+	}
+	if len(found) == 0 {
+		log.Print("No designated resolvers, using the configured endpoints")
+		return nil
+	}
+	dohClient.Endpoints = nil
+	for _, dr := range found {
+		if len(dr.Addrs) > 0 {
+			host, _ := designatedHostPort(dr.Endpoint)
+			bootstrap.pin(host, dr.Addrs)
+		}
+		log.Printf("Using designated resolver %s", dr.Endpoint)
+		dohClient.Endpoints = append(dohClient.Endpoints, dr.Endpoint)
+	}
+	return nil
+}
+
+// ddrCommand implements "gdoh ddr".
+func ddrCommand(args []string) error {
+	found, err := discoverResolvers()
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		fmt.Println("No designated resolvers")
+	}
+	for _, dr := range found {
+		fmt.Printf("%s@%s\n", dr.Endpoint, strings.Join(dr.Addrs, ","))
+	}
+	return nil
+}
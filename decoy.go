@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Decoys: chaff for whoever's keeping a profile of what we ask, the
+// endpoint's operator or someone watching the (padded) traffic. With
+// -decoys, gdoh asks about names from a list of popular ones, at
+// random times, -decoy-rate a minute on average, the way a browser
+// would (A, AAAA and HTTPS, at once):
+//
+//	gdoh -decoys /etc/gdoh/top-1m.csv -decoy-rate 4
+//
+// The list is a name per line, or Tranco/Alexa style CSV ("1,google.com").
+// Decoys only go out while real queries do - with nobody asking
+// anything, they'd stand out, rather than in - and nothing comes of
+// the answers: they aren't cached, or logged.
+
+var decoyList = flag.String("decoys", "",
+	"File with popular domains to send decoy queries for (off by default)")
+var decoyRate = flag.Float64("decoy-rate", 2,
+	"Decoy queries per minute, on average (see -decoys)")
+
+var decoys struct {
+	names []string
+	sent  int64
+}
+
+// Most of a top-sites list is never visited; the top of it is plenty.
+const maxDecoys = 100000
+
+func loadDecoys() error {
+	if *decoyList == "" {
+		return nil
+	}
+	if *decoyRate <= 0 || *decoyRate > 60 {
+		return fmt.Errorf("-decoy-rate %g: want more than 0, and at most 60", *decoyRate)
+	}
+	names, err := readDecoys(*decoyList)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("-decoys %s: no names", *decoyList)
+	}
+	decoys.names = names
+	return nil
+}
+
+func readDecoys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() && len(names) < maxDecoys {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.LastIndex(line, ","); i >= 0 {
+			line = strings.TrimSpace(line[i+1:])
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.ContainsAny(line, " \t/:") {
+			continue
+		}
+		names = append(names, normalizeName(line))
+	}
+	return names, s.Err()
+}
+
+// sendDecoys sends the decoys, for as long as there are queries to
+// hide them among.
+func sendDecoys() {
+	if len(decoys.names) == 0 {
+		return
+	}
+	mean := float64(time.Minute) / *decoyRate
+	seen := atomic.LoadInt64(&stats.Queries)
+	for {
+		// Exponential gaps: no rhythm to spot.
+		time.Sleep(time.Duration(-math.Log(1-random.Float64()) * mean))
+		if atomic.LoadInt64(&stats.Queries) == seen {
+			waitForQuery(seen)
+			// Not right on the heels of the query: that's a tell,
+			// too.
+			time.Sleep(time.Duration(random.Float64() * mean))
+		}
+		seen = atomic.LoadInt64(&stats.Queries)
+		sendDecoy(decoys.names[random.Intn(len(decoys.names))])
+	}
+}
+
+// sendDecoy asks about name, like a browser about to connect to it.
+func sendDecoy(name string) {
+	// Where the real thing would go (see -select): an endpoint that
+	// never sees a site but for the decoys knows them for what they
+	// are.
+	endpoint := dohClient.pickForName(name)
+	for _, type_ := range []uint16{typeA, typeAAAA, typeHTTPS} {
+		go func(type_ uint16) {
+			q := &dnsMsg{
+				ID:         randomID(),
+				Flags:      flagRD,
+				Question:   []dnsQuestion{{name, type_, classINET}},
+				Additional: []dnsRR{{Name: ".", Type: typeOPT, Class: ednsPayload()}},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
+			defer cancel()
+			_, _, err := dohClient.rawQuery(ctx, endpoint, q.pack())
+			var paused *PausedError
+			if !errors.As(err, &paused) {
+				atomic.AddInt64(&decoys.sent, 1)
+			}
+		}(type_)
+	}
+}
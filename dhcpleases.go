@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device names, from the DHCP server's lease file, so that the query
+// log, /api/recent, /api/top and the dashboard say "kids-tablet"
+// rather than 192.168.1.57:
+//
+//	-dhcp-leases /var/lib/misc/dnsmasq.leases
+//	-dhcp-leases /var/lib/dhcp/dhcpd.leases
+//
+// dnsmasq's and ISC dhcpd's formats are both understood, whichever the
+// file; the names of -lease and -leases devices come for free. The
+// files are read again when they change.
+
+var dhcpLeaseFiles = &stringsFlag{}
+
+func init() {
+	dhcpLeaseFiles.check = checkFile
+	flag.Var(dhcpLeaseFiles, "dhcp-leases",
+		"DHCP lease file (dnsmasq or ISC dhcpd), for device names in logs and stats (repeatable)")
+}
+
+// How often to look for changed lease files.
+const dhcpLeasesCheck = 10 * time.Second
+
+type dhcpLeaseTable struct {
+	sync.Mutex
+	names   map[string]map[string]string // file -> address -> name
+	mtimes  map[string]time.Time
+	checked time.Time
+}
+
+var dhcpLeases = &dhcpLeaseTable{
+	names:  map[string]map[string]string{},
+	mtimes: map[string]time.Time{},
+}
+
+// load reads the lease files, failing if any can't be read; after
+// that, a file that goes bad keeps its old names.
+func (dt *dhcpLeaseTable) load() error {
+	dt.Lock()
+	defer dt.Unlock()
+	for _, path := range dhcpLeaseFiles.values {
+		if err := dt.read(path); err != nil {
+			return err
+		}
+	}
+	dt.checked = time.Now()
+	return nil
+}
+
+func (dt *dhcpLeaseTable) read(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(dt.mtimes[path]) {
+		return nil
+	}
+	names, err := readDHCPLeases(path)
+	if err != nil {
+		return err
+	}
+	dt.names[path] = names
+	dt.mtimes[path] = fi.ModTime()
+	return nil
+}
+
+// name returns the device name for ip, or "".
+func (dt *dhcpLeaseTable) name(ip string) string {
+	ip = canonicalIP(ip)
+	if ip == "" {
+		return ""
+	}
+	if len(dhcpLeaseFiles.values) > 0 {
+		dt.Lock()
+		if time.Since(dt.checked) > dhcpLeasesCheck {
+			dt.checked = time.Now()
+			for _, path := range dhcpLeaseFiles.values {
+				if err := dt.read(path); err != nil {
+					log.Printf("dhcp leases error: %s", err.Error())
+				}
+			}
+		}
+		for _, path := range dhcpLeaseFiles.values {
+			if name, ok := dt.names[path][ip]; ok {
+				dt.Unlock()
+				return name
+			}
+		}
+		dt.Unlock()
+	}
+	if l, ok := leases.reverse[reverseName(net.ParseIP(ip))]; ok {
+		return strings.TrimSuffix(l.name, ".")
+	}
+	return ""
+}
+
+// canonicalIP spells ip the one way net.IP does, or "" if it's no
+// address.
+func canonicalIP(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// deviceFor returns the device name for a client address, or "".
+func deviceFor(client net.Addr) string {
+	if client == nil {
+		return ""
+	}
+	return dhcpLeases.name(clientHost(client.String()))
+}
+
+// clientLabel is the client's address, with its name if it has one,
+// for the logs.
+func clientLabel(client net.Addr) string {
+	host := clientHost(client.String())
+	if name := deviceFor(client); name != "" {
+		return host + " (" + name + ")"
+	}
+	return host
+}
+
+// readDHCPLeases reads a lease file, in either format.
+func readDHCPLeases(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := map[string]string{}
+	now := time.Now()
+	s := bufio.NewScanner(f)
+	// ISC dhcpd: blocks of "lease ADDRESS { ... }", the later ones
+	// overriding the earlier ones.
+	var isc, active bool
+	var addr, name string
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case line == "" || line[0] == '#':
+		case len(fields) == 3 && fields[0] == "lease" && fields[2] == "{":
+			isc, active = true, true
+			addr, name = canonicalIP(fields[1]), ""
+		case isc && line == "}":
+			if addr != "" {
+				delete(names, addr)
+				if active && name != "" {
+					names[addr] = name
+				}
+			}
+			addr = ""
+		case isc:
+			switch {
+			case len(fields) >= 2 && fields[0] == "client-hostname":
+				name = strings.Trim(strings.TrimSpace(strings.TrimSuffix(
+					strings.TrimPrefix(line, "client-hostname"), ";")), `"`)
+			case len(fields) >= 3 && fields[0] == "binding" && fields[1] == "state":
+				active = fields[2] == "active"
+			}
+		case len(fields) >= 4:
+			// dnsmasq: EXPIRY MAC|IAID ADDRESS NAME CLIENT-ID, with
+			// "*" for no name, and 0 for never expires.
+			expiry, err := strconv.ParseInt(fields[0], 10, 64)
+			addr := canonicalIP(fields[2])
+			if err != nil || fields[3] == "*" || addr == "" {
+				continue
+			}
+			if expiry == 0 || time.Unix(expiry, 0).After(now) {
+				names[addr] = fields[3]
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return names, nil
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Just enough of the DNS wire format (RFC 1035) to look inside the
+// queries and responses passing through, and to make up our own.
+
+// ErrMessage signifies a malformed DNS message.
+var ErrMessage = errors.New("Malformed DNS message")
+
+// Record types we care about; see also typeNameToNumber.
+const (
+	typeA     = 1
+	typeNS    = 2
+	typeCNAME = 5
+	typeSOA   = 6
+	typePTR   = 12
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+	typeOPT   = 41
+	typeHTTPS = 65
+	typeANY   = 255
+)
+
+const (
+	classINET  = 1
+	classCHAOS = 3
+)
+
+const (
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+// Header flags.
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+	flagAD = 1 << 5
+	flagCD = 1 << 4
+)
+
+// The default UDP payload size we advertise (DNS Flag Day 2020); see
+// -edns-size.
+const ednsUDPSize = 1232
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRR is a resource record. Names inside Data are always stored
+// uncompressed, so records can be moved between messages as-is.
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+type dnsMsg struct {
+	ID         uint16
+	Flags      uint16
+	Question   []dnsQuestion
+	Answer     []dnsRR
+	Authority  []dnsRR
+	Additional []dnsRR
+}
+
+func (m *dnsMsg) rcode() int {
+	return int(m.Flags & 0xf)
+}
+
+func (m *dnsMsg) setRcode(rcode int) {
+	m.Flags = m.Flags&^0xf | uint16(rcode&0xf)
+}
+
+// opt returns the EDNS pseudo-record, if any.
+func (m *dnsMsg) opt() *dnsRR {
+	for i := range m.Additional {
+		if m.Additional[i].Type == typeOPT {
+			return &m.Additional[i]
+		}
+	}
+	return nil
+}
+
+// sections returns all the sections holding real records.
+func (m *dnsMsg) sections() []*[]dnsRR {
+	return []*[]dnsRR{&m.Answer, &m.Authority, &m.Additional}
+}
+
+// minTTL finds the lowest TTL in the message, which is how long the
+// message as a whole may be cached. ok is false if there are no
+// records (other than OPT).
+func (m *dnsMsg) minTTL() (ttl uint32, ok bool) {
+	for _, section := range m.sections() {
+		for _, rr := range *section {
+			if rr.Type == typeOPT {
+				continue
+			}
+			if !ok || rr.TTL < ttl {
+				ttl, ok = rr.TTL, true
+			}
+			if rr.Type == typeSOA && len(m.Answer) == 0 {
+				// Negative answer (RFC 2308): the SOA's
+				// MINIMUM field bounds the TTL too.
+				if n := len(rr.Data); n >= 4 {
+					min := binary.BigEndian.Uint32(rr.Data[n-4:])
+					if min < ttl {
+						ttl = min
+					}
+				}
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// copy returns a deep enough copy of m to modify its records.
+func (m *dnsMsg) copy() *dnsMsg {
+	c := *m
+	c.Question = append([]dnsQuestion{}, m.Question...)
+	c.Answer = append([]dnsRR{}, m.Answer...)
+	c.Authority = append([]dnsRR{}, m.Authority...)
+	c.Additional = append([]dnsRR{}, m.Additional...)
+	return &c
+}
+
+// reply makes an empty response to q, with the given rcode.
+func reply(q *dnsMsg, rcode int) *dnsMsg {
+	r := &dnsMsg{
+		ID:       q.ID,
+		Flags:    flagQR | q.Flags&(0xf<<11|flagRD|flagCD) | flagRA,
+		Question: q.Question,
+	}
+	r.setRcode(rcode)
+	if q.opt() != nil {
+		r.Additional = []dnsRR{{Name: ".", Type: typeOPT,
+			Class: ednsPayload()}}
+	}
+	return r
+}
+
+func parseMsg(b []byte) (*dnsMsg, error) {
+	if len(b) < 12 {
+		return nil, ErrMessage
+	}
+	m := &dnsMsg{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])),
+		int(binary.BigEndian.Uint16(b[10:])),
+	}
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, ErrMessage
+		}
+		m.Question = append(m.Question, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for i, section := range m.sections() {
+		for j := 0; j < counts[i]; j++ {
+			rr, next, err := readRR(b, off)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, rr)
+			off = next
+		}
+	}
+	return m, nil
+}
+
+func readRR(b []byte, off int) (dnsRR, int, error) {
+	var rr dnsRR
+	name, off, err := readName(b, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(b) {
+		return rr, 0, ErrMessage
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(b[off:])
+	rr.Class = binary.BigEndian.Uint16(b[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(b[off+4:])
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return rr, 0, ErrMessage
+	}
+	rr.Data, err = readRData(b, off, n, rr.Type)
+	if err != nil {
+		return rr, 0, err
+	}
+	return rr, off + n, nil
+}
+
+// readRData copies out the record data, decompressing any names in
+// it; the layout is: fixed bytes before, names, fixed bytes after.
+func readRData(b []byte, off, n int, type_ uint16) ([]byte, error) {
+	var before, names int
+	switch type_ {
+	case typeNS, typeCNAME, typePTR:
+		names = 1
+	case typeMX:
+		before, names = 2, 1
+	case typeSRV:
+		before, names = 6, 1
+	case typeSOA:
+		names = 2
+	default:
+		return append([]byte{}, b[off:off+n]...), nil
+	}
+	end := off + n
+	if off+before > end {
+		return nil, ErrMessage
+	}
+	data := append([]byte{}, b[off:off+before]...)
+	off += before
+	for i := 0; i < names; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next > end {
+			return nil, ErrMessage
+		}
+		data = appendName(data, name)
+		off = next
+	}
+	return append(data, b[off:end]...), nil
+}
+
+// readName reads a (possibly compressed) name at off, returning it in
+// presentation format ("example.com.") along with the offset right
+// after it.
+func readName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for hops := 0; ; {
+		if off >= len(b) {
+			return "", 0, ErrMessage
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) || hops > 16 {
+				return "", 0, ErrMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			hops++
+		case n&0xc0 != 0:
+			return "", 0, ErrMessage
+		default:
+			if off+1+n > len(b) {
+				return "", 0, ErrMessage
+			}
+			labels = append(labels, escapeLabel(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func escapeLabel(label []byte) string {
+	var s strings.Builder
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c < '!' || c > '~':
+			fmt.Fprintf(&s, "\\%03d", c)
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+// splitName splits a presentation format name into wire format
+// labels, undoing escapeLabel.
+func splitName(name string) [][]byte {
+	labels := [][]byte{}
+	label := []byte{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\' && i+3 < len(name) && isDigit(name[i+1]):
+			var d int
+			fmt.Sscanf(name[i+1:i+4], "%03d", &d)
+			label = append(label, byte(d))
+			i += 3
+		case c == '\\' && i+1 < len(name):
+			label = append(label, name[i+1])
+			i++
+		case c == '.':
+			if len(label) > 0 {
+				labels = append(labels, label)
+			}
+			label = []byte{}
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// appendName appends name, uncompressed, in wire format.
+func appendName(b []byte, name string) []byte {
+	for _, label := range splitName(name) {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// packer builds a message, compressing owner names as it goes.
+type packer struct {
+	b     []byte
+	names map[string]int
+}
+
+func (p *packer) name(name string) {
+	labels := splitName(name)
+	for i := range labels {
+		key := strings.ToLower(string(joinLabels(labels[i:])))
+		if off, ok := p.names[key]; ok {
+			p.b = append(p.b, byte(0xc0|off>>8), byte(off))
+			return
+		}
+		if len(p.b) < 0x4000 {
+			p.names[key] = len(p.b)
+		}
+		label := labels[i]
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		p.b = append(p.b, byte(len(label)))
+		p.b = append(p.b, label...)
+	}
+	p.b = append(p.b, 0)
+}
+
+func joinLabels(labels [][]byte) []byte {
+	b := []byte{}
+	for _, label := range labels {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return b
+}
+
+func (p *packer) uint16(n uint16) {
+	p.b = append(p.b, byte(n>>8), byte(n))
+}
+
+func (p *packer) uint32(n uint32) {
+	p.b = append(p.b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (m *dnsMsg) pack() []byte {
+	p := &packer{b: make([]byte, 0, 512), names: map[string]int{}}
+	p.uint16(m.ID)
+	p.uint16(m.Flags)
+	p.uint16(uint16(len(m.Question)))
+	p.uint16(uint16(len(m.Answer)))
+	p.uint16(uint16(len(m.Authority)))
+	p.uint16(uint16(len(m.Additional)))
+	for _, q := range m.Question {
+		p.name(q.Name)
+		p.uint16(q.Type)
+		p.uint16(q.Class)
+	}
+	for _, section := range m.sections() {
+		for _, rr := range *section {
+			p.name(rr.Name)
+			p.uint16(rr.Type)
+			p.uint16(rr.Class)
+			p.uint32(rr.TTL)
+			p.uint16(uint16(len(rr.Data)))
+			p.b = append(p.b, rr.Data...)
+		}
+	}
+	return p.b
+}
+
+// normalizeName lowercases a name and makes sure it is fully
+// qualified, for use as a map key.
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// parentNames returns name and all its parent domains, down to (but
+// excluding) the root: "a.b.c." -> "a.b.c.", "b.c.", "c.".
+func parentNames(name string) []string {
+	name = normalizeName(name)
+	names := []string{}
+	for name != "." && name != "" {
+		names = append(names, name)
+		i := strings.Index(name, ".")
+		name = name[i+1:]
+	}
+	return names
+}
+
+// typeName returns the mnemonic for a record type, or the generic
+// "TYPE123" form (RFC 3597) for the ones we don't know.
+func typeName(t uint16) string {
+	for name, n := range typeNameToNumber {
+		if n == int(t) {
+			return name
+		}
+	}
+	switch t {
+	case typeOPT:
+		return "OPT"
+	case typeANY:
+		return "ANY"
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+var rcodeNames = []string{
+	"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED",
+}
+
+func rcodeName(rcode int) string {
+	if 0 <= rcode && rcode < len(rcodeNames) {
+		return rcodeNames[rcode]
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// typeNumber parses a record type: a mnemonic ("AAAA"), the generic
+// form ("TYPE28"), or just a number.
+func typeNumber(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if n, ok := typeNameToNumber[s]; ok {
+		return uint16(n), nil
+	}
+	switch s {
+	case "ANY":
+		return typeANY, nil
+	case "OPT":
+		return typeOPT, nil
+	}
+	var n uint16
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, "TYPE"), "%d", &n); err != nil {
+		return 0, fmt.Errorf("Unknown record type: %s", s)
+	}
+	return n, nil
+}
+
+func className(class uint16) string {
+	switch class {
+	case classINET:
+		return "IN"
+	case classCHAOS:
+		return "CH"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+// rdataString formats record data the way it looks in a zone file,
+// or in the generic form (RFC 3597) for types we don't know.
+func rdataString(rr dnsRR) string {
+	d := rr.Data
+	name := func(off int) (string, int) {
+		n, next, err := readName(d, off)
+		if err != nil {
+			return "?", len(d)
+		}
+		return n, next
+	}
+	u16 := func(off int) uint16 { return binary.BigEndian.Uint16(d[off:]) }
+	switch {
+	case rr.Type == typeA && len(d) == 4,
+		rr.Type == typeAAAA && len(d) == 16:
+		return net.IP(d).String()
+	case rr.Type == typeCNAME || rr.Type == typeNS || rr.Type == typePTR:
+		n, _ := name(0)
+		return n
+	case rr.Type == typeMX && len(d) > 2:
+		n, _ := name(2)
+		return fmt.Sprintf("%d %s", u16(0), n)
+	case rr.Type == typeSRV && len(d) > 6:
+		n, _ := name(6)
+		return fmt.Sprintf("%d %d %d %s", u16(0), u16(2), u16(4), n)
+	case rr.Type == typeSOA:
+		mname, off := name(0)
+		rname, off := name(off)
+		if off+20 > len(d) {
+			break
+		}
+		u32 := func(i int) uint32 {
+			return binary.BigEndian.Uint32(d[off+4*i:])
+		}
+		return fmt.Sprintf("%s %s %d %d %d %d %d",
+			mname, rname, u32(0), u32(1), u32(2), u32(3), u32(4))
+	case rr.Type == typeTXT:
+		parts := []string{}
+		for i := 0; i < len(d); {
+			n := int(d[i])
+			if i+1+n > len(d) {
+				break
+			}
+			parts = append(parts, strconv.Quote(string(d[i+1:i+1+n])))
+			i += 1 + n
+		}
+		return strings.Join(parts, " ")
+	}
+	return fmt.Sprintf("\\# %d %x", len(d), d)
+}
+
+// rrString formats a record like a zone file line.
+func rrString(rr dnsRR) string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.Name, rr.TTL,
+		className(rr.Class), typeName(rr.Type), rdataString(rr))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted Client Hello: hide even the endpoint's name (the SNI)
+// from the network. The ECH configuration comes from the endpoint's
+// HTTPS record (RFC 9460), looked up through the bootstrap resolver.
+//
+// With -ech on, endpoints that publish a configuration get ECH, the
+// others don't; with -ech require, those others aren't used at all.
+
+var echMode = &choiceFlag{value: "off", choices: []string{"off", "on", "require"}}
+
+func init() {
+	flag.Var(echMode, "ech",
+		"Encrypted Client Hello: off, on (where available), or require")
+}
+
+// ErrNoECH is returned by endpoints without ECH, under -ech require.
+var ErrNoECH = errors.New("Endpoint doesn't support ECH")
+
+// The SvcParamKey for ECH configs in HTTPS records.
+const svcParamECH = 5
+
+// ECH configurations by host, and when to look again; a nil one is a
+// host without.
+type echEntry struct {
+	config  []byte
+	expires time.Time
+}
+
+var echConfigs = struct {
+	sync.Mutex
+	hosts map[string]echEntry
+}{hosts: map[string]echEntry{}}
+
+// loadECH fetches the ECH configuration of every endpoint.
+func loadECH() error {
+	echFor(dohClient.endpoints())
+	return nil
+}
+
+// echFor fetches the ECH configurations of the endpoints that don't
+// have a fresh one (see daneFor). A changed one is for new
+// connections.
+func echFor(endpoints []string) {
+	if echMode.value == "off" {
+		return
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		echConfigs.Lock()
+		e, ok := echConfigs.hosts[host]
+		echConfigs.Unlock()
+		if ok && time.Now().Before(e.expires) {
+			continue
+		}
+		config, ttl, err := lookupECH(host)
+		if err != nil {
+			log.Printf("ech error: %s: %s", host, err.Error())
+			continue
+		}
+		if config == nil {
+			log.Printf("No ECH for %s", host)
+			ttl = noTLSATTL
+		}
+		if ttl < minTLSATTL {
+			ttl = minTLSATTL
+		}
+		echConfigs.Lock()
+		echConfigs.hosts[host] = echEntry{config, time.Now().Add(ttl)}
+		echConfigs.Unlock()
+		if ok && string(config) != string(e.config) {
+			if et, isET := dohClient.Client.Transport.(*endpointTransports); isET {
+				et.resetHost(host)
+			}
+		}
+	}
+}
+
+func setECH(host string, config []byte) {
+	echConfigs.Lock()
+	defer echConfigs.Unlock()
+	e := echConfigs.hosts[host]
+	e.config = config
+	echConfigs.hosts[host] = e
+}
+
+func getECH(host string) []byte {
+	echConfigs.Lock()
+	defer echConfigs.Unlock()
+	return echConfigs.hosts[host].config
+}
+
+// lookupECH finds the ECHConfigList in host's HTTPS record, if any,
+// and for how long it's good.
+func lookupECH(host string) ([]byte, time.Duration, error) {
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{normalizeName(host), typeHTTPS, classINET}},
+	}
+	resp, err := rootDohClient.RawQuery(q.pack())
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rr := range r.Answer {
+		if rr.Type != typeHTTPS {
+			continue
+		}
+		if config := svcParam(rr.Data, svcParamECH); config != nil {
+			return config, time.Duration(rr.TTL) * time.Second, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// svcParam digs a parameter out of SVCB/HTTPS record data: priority,
+// target name, then key/length/value triplets.
+func svcParam(data []byte, key uint16) []byte {
+	if len(data) < 2 {
+		return nil
+	}
+	_, off, err := readName(data, 2)
+	if err != nil {
+		return nil
+	}
+	for off+4 <= len(data) {
+		k := binary.BigEndian.Uint16(data[off:])
+		n := int(binary.BigEndian.Uint16(data[off+2:]))
+		off += 4
+		if off+n > len(data) {
+			return nil
+		}
+		if k == key {
+			return data[off : off+n]
+		}
+		off += n
+	}
+	return nil
+}
+
+// configureECH sets up ECH for host, if it has it.
+func configureECH(host string, config *tls.Config) {
+	if echMode.value == "off" || net.ParseIP(host) != nil {
+		return
+	}
+	if ech := getECH(host); ech != nil {
+		config.EncryptedClientHelloConfigList = ech
+		// ECH is TLS 1.3 only.
+		config.MinVersion = tls.VersionTLS13
+	}
+}
+
+// echRetry handles the server rejecting our ECH configuration (say,
+// after a key rotation): it usually sends a fresh one along, which we
+// take, drop the transport, and try the request once more with.
+func (et *endpointTransports) echRetry(r *http.Request, err error) (*http.Response, error) {
+	var rejected *tls.ECHRejectionError
+	if !errors.As(err, &rejected) || len(rejected.RetryConfigList) == 0 ||
+		(r.Body != nil && r.GetBody == nil) {
+		return nil, err
+	}
+	host := strings.ToLower(r.URL.Hostname())
+	log.Printf("ECH rejected by %s, retrying with its new config", host)
+	setECH(host, rejected.RetryConfigList)
+	et.resetHost(host)
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r = r.Clone(r.Context())
+		r.Body = body
+	}
+	return et.forHost(host).RoundTrip(r)
+}
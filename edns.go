@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+)
+
+// The EDNS UDP payload size: what we advertise upstream (rewriting the
+// clients' own), and to clients; and what UDP responses are kept
+// under. A response that doesn't fit what the client can take (512
+// without EDNS) goes out truncated, and the client asks again over
+// TCP - rather than relying on IP fragmentation, which is what the
+// 1232 default is about.
+
+var ednsSize = flag.Int("edns-size", ednsUDPSize,
+	"EDNS UDP payload size to advertise, and to keep UDP responses under")
+
+// Largest UDP response we'll read, whatever we asked for.
+const maxUDPSize = 65535
+
+func checkEDNS() error {
+	if *ednsSize < 512 || *ednsSize > 4096 {
+		return fmt.Errorf("-edns-size %d: want 512 to 4096", *ednsSize)
+	}
+	return nil
+}
+
+func ednsPayload() uint16 {
+	return uint16(*ednsSize)
+}
+
+// advertise returns query, with our payload size in place of the
+// client's.
+func advertise(q *dnsMsg, query []byte) []byte {
+	if opt := q.opt(); opt == nil || opt.Class == ednsPayload() {
+		return query
+	}
+	m := q.copy()
+	m.opt().Class = ednsPayload()
+	return m.pack()
+}
+
+// advertiseTo puts our payload size in an upstream response, in place
+// of the upstream's: that's between it and us.
+func advertiseTo(r *dnsMsg) {
+	if opt := r.opt(); opt != nil {
+		opt.Class = ednsPayload()
+	}
+}
+
+// udpLimit is the largest UDP response the client can take.
+func udpLimit(query []byte) int {
+	q, err := parseMsg(query)
+	if err != nil {
+		return 512
+	}
+	opt := q.opt()
+	if opt == nil || opt.Class < 512 {
+		return 512
+	}
+	if int(opt.Class) < *ednsSize {
+		return int(opt.Class)
+	}
+	return *ednsSize
+}
+
+// truncate makes resp fit in a UDP response to query: if it's too big,
+// the client gets the question, with TC set, and nothing else.
+func truncate(resp, query []byte) []byte {
+	if len(resp) <= 512 {
+		return resp
+	}
+	limit := udpLimit(query)
+	if len(resp) <= limit {
+		return resp
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		// Just the header, then.
+		b := append([]byte(nil), resp[:12]...)
+		b[2] |= flagTC >> 8
+		for i := 4; i < 12; i++ {
+			b[i] = 0
+		}
+		return b
+	}
+	r.Flags |= flagTC
+	r.Answer, r.Authority = nil, nil
+	additional := []dnsRR{}
+	if opt := r.opt(); opt != nil {
+		additional = append(additional, *opt)
+	}
+	r.Additional = additional
+	return r.pack()
+}
+
+// An EDNS option, from the OPT record's data.
+type ednsOption struct {
+	Code uint16
+	Data []byte
+}
+
+func parseOptions(data []byte) ([]ednsOption, error) {
+	opts := []ednsOption{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrMessage
+		}
+		code := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+n {
+			return nil, ErrMessage
+		}
+		opts = append(opts, ednsOption{code, data[4 : 4+n]})
+		data = data[4+n:]
+	}
+	return opts, nil
+}
+
+func packOptions(opts []ednsOption) []byte {
+	b := []byte{}
+	for _, o := range opts {
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b
+}
@@ -0,0 +1,46 @@
+package main
+
+import "flag"
+
+// CNAME flattening, for broken IoT clients and firewall policies that
+// can't follow a chain: "www.example.com CNAME cdn.example.net, A
+// 192.0.2.1" becomes "www.example.com A 192.0.2.1".
+
+var flattenCNAMEs = flag.Bool("flatten-cnames", false,
+	"Return just the final A/AAAA records of CNAME chains, under the queried name")
+
+func flatten(r *dnsMsg) {
+	if !*flattenCNAMEs || len(r.Question) != 1 {
+		return
+	}
+	q := r.Question[0]
+	if q.Type != typeA && q.Type != typeAAAA {
+		return
+	}
+	chain, first := false, true
+	ttl := uint32(0)
+	final := []dnsRR{}
+	for _, rr := range r.Answer {
+		switch rr.Type {
+		case typeCNAME:
+			chain = true
+		case q.Type:
+			final = append(final, rr)
+		default:
+			continue
+		}
+		// The flattened records can't outlive any link in the
+		// chain.
+		if first || rr.TTL < ttl {
+			ttl, first = rr.TTL, false
+		}
+	}
+	if !chain || len(final) == 0 {
+		return
+	}
+	for i := range final {
+		final[i].Name = q.Name
+		final[i].TTL = ttl
+	}
+	r.Answer = final
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"net/http"
+	"net/url"
+)
+
+// RFC 8484 GET: the query goes in the URL, base64url-encoded, with its
+// ID zeroed, so that the same question makes the same URL, every time;
+// a cache at the provider's edge can answer it without bothering the
+// resolver behind. POST is the default: it keeps the query out of the
+// access logs, and some endpoints only do POST.
+
+var wireMethod = &choiceFlag{value: "POST", choices: []string{"POST", "GET"}}
+
+func init() {
+	flag.Var(wireMethod, "method",
+		"HTTP method for wire format queries: POST or GET (cacheable)")
+}
+
+// getRequest makes a GET request for query.
+func getRequest(ctx context.Context, endpoint string, query []byte) (*http.Request, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	zeroed := append([]byte(nil), query...)
+	if len(zeroed) >= 2 {
+		zeroed[0], zeroed[1] = 0, 0
+	}
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(zeroed))
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	return req, nil
+}
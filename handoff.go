@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Restarts without dropping a query. On SIGUSR2, gdoh starts a new
+// copy of itself - of the binary on disk now, so this is how to
+// upgrade - handing it the listening sockets. Once the new one is
+// listening, the old one stops reading, answers what it already has,
+// and exits; the queries that came in meanwhile wait in the sockets
+// for whichever reads them first. SIGTERM (and ^C) stops the same
+// way, minus the new copy.
+//
+//	kill -USR2 $(pidof gdoh)
+//
+// The new copy reads the configuration afresh; listeners it no longer
+// has are closed, and new ones bound.
+
+const (
+	// The sockets handed over: "udp :53=3;tcp 127.0.0.1:8053=4".
+	listenersEnv = "GDOH_LISTENERS"
+	// Where the new copy says it's listening.
+	readyEnv = "GDOH_READY_FD"
+	// How long the new copy has to get going.
+	handoffTimeout = time.Minute
+)
+
+// A socket that can be handed over.
+type handoffSocket struct {
+	key  string // "udp :53"
+	file func() (*os.File, error)
+}
+
+var handoff = struct {
+	sync.Mutex
+	sockets   []handoffSocket
+	inherited map[string]*os.File
+	stopping  chan struct{}
+	stopped   int32
+	// What's left to finish, once stopping.
+	serving, working, connections sync.WaitGroup
+}{
+	inherited: inheritedSockets(),
+	stopping:  make(chan struct{}),
+}
+
+// inheritedSockets are the sockets the old copy handed us, if we're
+// the new one.
+func inheritedSockets() map[string]*os.File {
+	files := map[string]*os.File{}
+	for _, s := range strings.Split(os.Getenv(listenersEnv), ";") {
+		i := strings.LastIndex(s, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			continue
+		}
+		files[s[:i]] = os.NewFile(uintptr(fd), s[:i])
+	}
+	os.Unsetenv(listenersEnv)
+	return files
+}
+
+// inherited returns the socket handed over for proto and address, if
+// there is one.
+func inherited(proto, address string) *os.File {
+	handoff.Lock()
+	defer handoff.Unlock()
+	key := proto + " " + address
+	f := handoff.inherited[key]
+	delete(handoff.inherited, key)
+	return f
+}
+
+// keepSocket remembers a listening socket, for the next handoff.
+func keepSocket(proto, address string, file func() (*os.File, error)) {
+	handoff.Lock()
+	defer handoff.Unlock()
+	handoff.sockets = append(handoff.sockets, handoffSocket{proto + " " + address, file})
+}
+
+// handedOver tells the old copy we're up, if there is one, and closes
+// the sockets it handed over that we've no use for.
+func handedOver() {
+	handoff.Lock()
+	for key, f := range handoff.inherited {
+		log.Printf("Closing %s, no longer configured", key)
+		f.Close()
+	}
+	handoff.inherited = nil
+	handoff.Unlock()
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	os.Unsetenv(readyEnv)
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// upgrade starts a new copy, with our sockets, and stops this one
+// once it's listening.
+func upgrade() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("upgrade error: %s", err.Error())
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("upgrade error: %s", err.Error())
+		return
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	keys := []string{}
+	handoff.Lock()
+	for _, s := range handoff.sockets {
+		f, err := s.file()
+		if err != nil {
+			handoff.Unlock()
+			log.Printf("upgrade error: %s: %s", s.key, err.Error())
+			return
+		}
+		// The child's fds are 3 (the pipe), 4, and on.
+		keys = append(keys, fmt.Sprintf("%s=%d", s.key, 3+len(files)))
+		files = append(files, f)
+	}
+	handoff.Unlock()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(keys, ";"), readyEnv+"=3")
+	if err := cmd.Start(); err != nil {
+		log.Printf("upgrade error: %s", err.Error())
+		return
+	}
+	log.Printf("Upgrading: started %s, pid %d", exe, cmd.Process.Pid)
+	// Ours is the read end only: EOF means the child is gone.
+	w.Close()
+	files = files[1:]
+	done := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		done <- n == 1
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			cmd.Wait()
+			log.Printf("upgrade error: the new process exited (%s); carrying on", cmd.ProcessState)
+			return
+		}
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		log.Printf("upgrade error: the new process isn't listening after %s; carrying on", handoffTimeout)
+		return
+	}
+	log.Printf("Upgraded: pid %d is listening; draining", cmd.Process.Pid)
+	// It's theirs now; don't wait for them.
+	cmd.Process.Release()
+	stopServing()
+}
+
+// stopServing makes the server stop reading, and drain.
+func stopServing() {
+	if atomic.CompareAndSwapInt32(&handoff.stopped, 0, 1) {
+		close(handoff.stopping)
+	}
+}
+
+// stopping tells whether we're on the way out (so that the listeners
+// closing under the serving loops isn't an error).
+func stopping() bool {
+	return atomic.LoadInt32(&handoff.stopped) == 1
+}
+
+// drain waits to be stopped, then stops reading from the listeners,
+// and waits for whatever's in flight to get its answer.
+func drain(udp []*net.UDPConn, streams []net.Listener) {
+	<-handoff.stopping
+	for _, ln := range udp {
+		// Not closed: the workers still write to it.
+		ln.SetReadDeadline(time.Now())
+	}
+	for _, ln := range streams {
+		ln.Close()
+	}
+	handoff.serving.Wait()
+	close(packets)
+	handoff.working.Wait()
+	// Connections idle out on their own, soon enough.
+	done := make(chan struct{})
+	go func() {
+		handoff.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(tcpIdleTimeout):
+	}
+	if queryLog.w != nil {
+		queryLog.flush()
+	}
+	if err := saveReputation(); err != nil {
+		log.Printf("reputation error: %s", err.Error())
+	}
+	log.Printf("Drained; bye")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+// Header hygiene: what goes to a resolver is the query, and no more.
+// No User-Agent (Go's would say which HTTP library, and version, is
+// asking) unless -user-agent gives one; no cookies, ever, nor any
+// header besides the ones DoH needs and -endpoint-header's; and any
+// Set-Cookie the resolver sends back is dropped on the floor, before
+// anything (say, query -json) gets to see it.
+
+var userAgent = flag.String("user-agent", "",
+	"User-Agent to send the endpoints (none by default)")
+
+// What a request to a resolver may carry, besides -endpoint-header.
+var requestHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"Content-Type":    true,
+	"Content-Length":  true,
+}
+
+// cleanRequest returns r with only the headers it may carry, and the
+// -user-agent (an empty one, the transports leave out).
+func cleanRequest(r *http.Request) *http.Request {
+	extra := endpointHeaders[strings.ToLower(r.URL.Hostname())]
+	h := http.Header{}
+	for name, values := range r.Header {
+		if _, ok := extra[name]; ok || requestHeaders[name] {
+			h[name] = values
+		}
+	}
+	h["User-Agent"] = []string{*userAgent}
+	// Shallow: the body is still the caller's, to read once.
+	clean := new(http.Request)
+	*clean = *r
+	clean.Header = h
+	return clean
+}
+
+// cleanResponse drops the cookies resp came with, if any.
+func cleanResponse(resp *http.Response) {
+	if resp != nil {
+		resp.Header.Del("Set-Cookie")
+		resp.Header.Del("Set-Cookie2")
+	}
+}
+
+// cleanHeaders is an http.RoundTripper that keeps the headers clean,
+// for the clients that don't go through endpointTransports.
+type cleanHeaders struct {
+	http.RoundTripper
+}
+
+func (ch cleanHeaders) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := ch.RoundTripper.RoundTrip(cleanRequest(r))
+	cleanResponse(resp)
+	return resp, err
+}
+
+func (ch cleanHeaders) CloseIdleConnections() {
+	if t, ok := ch.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
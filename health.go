@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness and readiness. We're ready once the listeners are bound,
+// and for as long as at least one endpoint is reachable.
+//
+// "gdoh healthcheck" asks a running gdoh, and exits 0 or 1 - for a
+// Docker HEALTHCHECK or a Kubernetes exec probe, with no dig in the
+// image: over DNS (the root NS, on the first -listen address), or with
+// -readyz, the admin API's /readyz.
+
+// listening is set (to 1) once all listeners are bound.
+var listening int32
+
+// An endpoint that answered this recently counts as reachable,
+// without probing it again.
+const readyFresh = 30 * time.Second
+
+// How long the probes get, if it comes to that: less than the
+// healthcheck's (or a kubelet's) patience.
+const readyProbeTimeout = time.Second
+
+func adminHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func adminReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&listening) == 0 {
+		http.Error(w, "not listening", http.StatusServiceUnavailable)
+		return
+	}
+	if !upstreamReachable(r.Context()) {
+		http.Error(w, "no reachable endpoints",
+			http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// upstreamReachable tells whether any endpoint works, going by recent
+// traffic if there was any, probing them all at once if not: the
+// first to answer will do.
+func upstreamReachable(ctx context.Context) bool {
+	for _, h := range dohClient.health.snapshot(dohClient.endpoints()) {
+		if h.Healthy && time.Since(h.LastOKAt) < readyFresh {
+			return true
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	endpoints := dohClient.endpoints()
+	results := make(chan error, len(endpoints))
+	probe := probeQuery()
+	for _, endpoint := range endpoints {
+		go func(endpoint string) {
+			_, _, err := dohClient.rawQuery(ctx, endpoint, probe)
+			results <- err
+		}(endpoint)
+	}
+	for i := range endpoints {
+		if <-results == nil {
+			// The others get to finish: cut short, they'd count
+			// against the endpoints.
+			go func(n int) {
+				for ; n > 0; n-- {
+					<-results
+				}
+				cancel()
+			}(len(endpoints) - i - 1)
+			return true
+		}
+	}
+	cancel()
+	return false
+}
+
+// probeQuery asks for the root NS set, which every resolver can
+// answer (probably from cache).
+func probeQuery() []byte {
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{".", typeNS, classINET}},
+	}
+	return q.pack()
+}
+
+func healthcheckCommand(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	server := fs.String("server", "",
+		"Address to query (default: the first -listen address, on loopback)")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait")
+	readyz := fs.Bool("readyz", false, "Ask the admin API's /readyz (per -admin) instead")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gdoh healthcheck [-server ADDR] [-timeout 2s] [-readyz]")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		fs.Usage()
+		return errors.New("Bad arguments")
+	}
+	if *readyz {
+		http.DefaultClient.Timeout = *timeout
+		_, err = adminCall("GET", "/readyz", nil)
+	} else {
+		if *server == "" && len(listen.values) > 0 {
+			*server = loopbackAddr(listenAddresses(listen.values)[0])
+		}
+		err = healthcheck(*server, *timeout)
+	}
+	if err != nil {
+		log.Printf("healthcheck error: %s", err.Error())
+		return exitCode(1)
+	}
+	return nil
+}
+
+// healthcheck asks server for the root NS set over UDP: anything
+// short of SERVFAIL (or REFUSED) will do.
+func healthcheck(server string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	q, _ := parseMsg(probeQuery())
+	q.ID = randomID()
+	if _, err := conn.Write(q.pack()); err != nil {
+		return err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		r, err := parseMsg(buf[:n])
+		if err != nil || r.ID != q.ID {
+			continue
+		}
+		switch r.rcode() {
+		case rcodeServFail, rcodeRefused:
+			return fmt.Errorf("%s: %s", server, rcodeName(r.rcode()))
+		}
+		return nil
+	}
+}
+
+// loopbackAddr is where to reach a listen address from this machine.
+func loopbackAddr(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
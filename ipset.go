@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firewall sets: addresses from the answers for some domains go into
+// an nftables set or an ipset, with a timeout matching the TTL, so
+// that the firewall can say "only *.example.com gets out":
+//
+//	-ipset nft:inet/filter/allowed,allowed6=example.com,example.net
+//	-ipset ipset:allowed=@/etc/gdoh/allowed.txt
+//
+// The first set gets the IPv4 addresses, the second one (if any) the
+// IPv6 ones; the sets have to exist, with timeouts enabled. A file
+// is read like -block.
+//
+// The addresses are in before the answer goes out - the client is
+// about to connect to one - and an address answered again, with a
+// TTL outlasting its timeout, goes back in with the new one.
+
+var ipsetFlags = &stringsFlag{}
+
+func init() {
+	ipsetFlags.check = func(v string) error {
+		_, err := parseIPSet(v)
+		return err
+	}
+	flag.Var(ipsetFlags, "ipset",
+		"Add addresses answered for DOMAINS to a firewall set: nft:FAMILY/TABLE/SET[,SET6]=DOMAINS or ipset:SET[,SET6]=DOMAINS; DOMAINS is a list, or @FILE (repeatable)")
+}
+
+// How often to forget the addresses the firewall has timed out.
+const ipsetExpire = time.Minute
+
+type ipsetTarget struct {
+	kind          string // "nft" or "ipset"
+	family, table string // nft only
+	set4, set6    string
+	domains       map[string]bool
+}
+
+func parseIPSet(v string) (*ipsetTarget, error) {
+	parts := strings.SplitN(v, "=", 2)
+	kind := strings.SplitN(parts[0], ":", 2)
+	if len(parts) != 2 || len(kind) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("-ipset %s: want KIND:SET=DOMAINS", v)
+	}
+	t := &ipsetTarget{kind: kind[0], domains: map[string]bool{}}
+	sets := kind[1]
+	switch t.kind {
+	case "nft":
+		path := strings.Split(sets, "/")
+		if len(path) != 3 {
+			return nil, fmt.Errorf("-ipset %s: want nft:FAMILY/TABLE/SET", v)
+		}
+		t.family, t.table, sets = path[0], path[1], path[2]
+	case "ipset":
+	default:
+		return nil, fmt.Errorf("-ipset %s: unknown kind %s", v, t.kind)
+	}
+	names := strings.Split(sets, ",")
+	if len(names) > 2 || names[0] == "" {
+		return nil, fmt.Errorf("-ipset %s: want one or two sets", v)
+	}
+	t.set4 = names[0]
+	if len(names) == 2 {
+		t.set6 = names[1]
+	}
+	if strings.HasPrefix(parts[1], "@") {
+		domains, err := readBlocklist(parts[1][1:])
+		if err != nil {
+			return nil, err
+		}
+		t.domains = domains
+		return t, nil
+	}
+	for _, domain := range strings.Split(parts[1], ",") {
+		t.domains[normalizeName(domain)] = true
+	}
+	return t, nil
+}
+
+// match tells if the name is under one of the target's domains.
+func (t *ipsetTarget) match(name string) bool {
+	for _, parent := range parentNames(name) {
+		if t.domains[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// script returns the commands adding the elements, for "nft -f -" or
+// "ipset restore".
+func (t *ipsetTarget) script(elements []ipsetElement) []byte {
+	var b bytes.Buffer
+	for _, e := range elements {
+		if t.kind == "nft" {
+			// "add" leaves an element's timeout as it was; so add
+			// it (if it's not there, the delete would fail the
+			// lot), delete it, and add it again.
+			for _, op := range []string{"add", "delete"} {
+				fmt.Fprintf(&b, "%s element %s %s %s { %s }\n",
+					op, t.family, t.table, e.set, e.ip)
+			}
+			fmt.Fprintf(&b, "add element %s %s %s { %s timeout %ds }\n",
+				t.family, t.table, e.set, e.ip, e.ttl)
+		} else {
+			fmt.Fprintf(&b, "add %s %s timeout %d -exist\n", e.set, e.ip, e.ttl)
+		}
+	}
+	return b.Bytes()
+}
+
+func (t *ipsetTarget) command() *exec.Cmd {
+	if t.kind == "nft" {
+		return exec.Command("nft", "-f", "-")
+	}
+	return exec.Command("ipset", "restore")
+}
+
+type ipsetElement struct {
+	set     string
+	ip      string
+	ttl     uint32
+	expires time.Time
+}
+
+type ipsetHook struct {
+	sync.Mutex
+	targets []*ipsetTarget
+	// (set, address) -> when the firewall forgets it
+	added map[[2]string]time.Time
+}
+
+var ipsets = &ipsetHook{
+	added: map[[2]string]time.Time{},
+}
+
+func (h *ipsetHook) load(values []string) error {
+	for _, v := range values {
+		t, err := parseIPSet(v)
+		if err != nil {
+			return err
+		}
+		h.targets = append(h.targets, t)
+	}
+	return nil
+}
+
+// add hands the addresses in a response over to the firewall, for
+// the targets that want them, and waits for it. Addresses already in
+// a set aren't added again, unless they'd time out sooner than the
+// TTL says now.
+func (h *ipsetHook) add(r *dnsMsg) {
+	if len(h.targets) == 0 || len(r.Question) != 1 {
+		return
+	}
+	for t, elements := range h.wanted(r) {
+		cmd := t.command()
+		cmd.Stdin = bytes.NewReader(t.script(elements))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("ipset error: %s: %s", err.Error(),
+				strings.TrimSpace(string(out)))
+			continue
+		}
+		h.Lock()
+		for _, e := range elements {
+			key := [2]string{e.set, e.ip}
+			if e.expires.After(h.added[key]) {
+				h.added[key] = e.expires
+			}
+		}
+		h.Unlock()
+	}
+}
+
+// wanted are the elements of r that the targets don't have, or would
+// forget too soon.
+func (h *ipsetHook) wanted(r *dnsMsg) map[*ipsetTarget][]ipsetElement {
+	wanted := map[*ipsetTarget][]ipsetElement{}
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	for _, t := range h.targets {
+		if !t.match(r.Question[0].Name) {
+			continue
+		}
+		for _, rr := range r.Answer {
+			set := t.set4
+			if rr.Type == typeAAAA {
+				set = t.set6
+			} else if rr.Type != typeA {
+				continue
+			}
+			if set == "" || rr.TTL == 0 {
+				continue
+			}
+			ip := net.IP(rr.Data).String()
+			expires := now.Add(time.Duration(rr.TTL) * time.Second)
+			// A cache hit's TTL, rounded, may be a second over.
+			if !expires.After(h.added[[2]string{set, ip}].Add(time.Second)) {
+				continue
+			}
+			wanted[t] = append(wanted[t], ipsetElement{set, ip, rr.TTL, expires})
+		}
+	}
+	return wanted
+}
+
+// run forgets the addresses the firewall has timed out.
+func (h *ipsetHook) run() {
+	if len(h.targets) == 0 {
+		return
+	}
+	for now := range backgroundTick(ipsetExpire) {
+		h.Lock()
+		for key, expires := range h.added {
+			if !expires.After(now) {
+				delete(h.added, key)
+			}
+		}
+		h.Unlock()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "math"
+
+// Latency histograms, with exponentially growing buckets: 1ms to
+// about a minute, each bucket 25% wider than the previous one, which
+// keeps percentiles within 25% of the truth at any scale.
+
+var latencyBounds = func() []float64 {
+	bounds := []float64{}
+	for ms := 1.0; ms < 60000; ms *= 1.25 {
+		bounds = append(bounds, ms)
+	}
+	return bounds
+}()
+
+// Once this many samples have been seen, all counts are halved, so
+// that the histogram reflects the last few thousand queries rather
+// than all of history.
+const histogramDecay = 2000
+
+type latencyHistogram struct {
+	// counts[i] is the number of samples <= latencyBounds[i]; the
+	// last one collects everything beyond.
+	counts []float64
+	total  float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]float64, len(latencyBounds)+1)}
+}
+
+func (h *latencyHistogram) observe(ms float64) {
+	i := 0
+	for i < len(latencyBounds) && ms > latencyBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+	if h.total >= histogramDecay {
+		h.total /= 2
+		for i := range h.counts {
+			h.counts[i] /= 2
+		}
+	}
+}
+
+// quantile returns the (upper bound of the bucket holding the) q-th
+// quantile, or 0 if there's no data.
+func (h *latencyHistogram) quantile(q float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	want, sum := q*h.total, 0.0
+	for i, n := range h.counts {
+		sum += n
+		if sum >= want && n > 0 {
+			if i == len(latencyBounds) {
+				// Off the scale; this is as good as
+				// infinite.
+				i--
+			}
+			return math.Round(latencyBounds[i]*10) / 10
+		}
+	}
+	return 0
+}
+
+type histogramBucket struct {
+	LessEqualMS float64 `json:"le_ms"`
+	Count       float64 `json:"count"`
+}
+
+// buckets returns the non-empty buckets, for plotting.
+func (h *latencyHistogram) buckets() []histogramBucket {
+	bs := []histogramBucket{}
+	for i, n := range h.counts {
+		if n == 0 || i == len(latencyBounds) {
+			continue
+		}
+		bs = append(bs, histogramBucket{
+			math.Round(latencyBounds[i]*10) / 10, n,
+		})
+	}
+	return bs
+}
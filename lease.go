@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Static leases: LAN devices, declared once, answered for both ways,
+// A/AAAA and PTR, like dnsmasq's dhcp-host (minus the DHCP):
+//
+//	-lease nas.lan=192.168.1.10,fd00::10,aa:bb:cc:dd:ee:ff
+//
+// or a -leases file, with a device per line ("nas.lan 192.168.1.10
+// fd00::10 aa:bb:cc:dd:ee:ff", "#" for comments).
+
+var leaseFlags = &stringsFlag{}
+var leaseFiles = &stringsFlag{}
+
+func init() {
+	leaseFlags.check = func(v string) error {
+		_, err := parseLeaseFlag(v)
+		return err
+	}
+	leaseFiles.check = checkFile
+	flag.Var(leaseFlags, "lease",
+		"Static lease: NAME=ADDRESS[,ADDRESS...][,MAC] (repeatable)")
+	flag.Var(leaseFiles, "leases",
+		"File with a static lease per line: NAME ADDRESS... [MAC] (repeatable)")
+}
+
+// TTL for the records of leases.
+const leaseTTL = 60
+
+type lease struct {
+	name  string
+	addrs []net.IP
+	mac   net.HardwareAddr
+}
+
+func parseLeaseFlag(v string) (*lease, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("-lease %s: want NAME=ADDRESS,...", v)
+	}
+	return parseLease(append(parts[:1], strings.Split(parts[1], ",")...))
+}
+
+// parseLease parses NAME ADDRESS... [MAC].
+func parseLease(fields []string) (*lease, error) {
+	v := strings.Join(fields, " ")
+	if len(fields) < 2 || fields[0] == "" {
+		return nil, fmt.Errorf("lease %s: want NAME ADDRESS... [MAC]", v)
+	}
+	l := &lease{name: normalizeName(fields[0])}
+	for _, f := range fields[1:] {
+		if ip := net.ParseIP(f); ip != nil {
+			l.addrs = append(l.addrs, ip)
+			continue
+		}
+		mac, err := net.ParseMAC(f)
+		if err != nil || l.mac != nil {
+			return nil, fmt.Errorf("lease %s: bad address %s", v, f)
+		}
+		l.mac = mac
+	}
+	if len(l.addrs) == 0 {
+		return nil, fmt.Errorf("lease %s: no addresses", v)
+	}
+	return l, nil
+}
+
+type leaseTable struct {
+	names   map[string]*lease // name -> lease
+	reverse map[string]*lease // reverse name -> lease
+}
+
+var leases = &leaseTable{
+	names:   map[string]*lease{},
+	reverse: map[string]*lease{},
+}
+
+func (lt *leaseTable) add(l *lease) {
+	lt.names[l.name] = l
+	for _, ip := range l.addrs {
+		lt.reverse[reverseName(ip)] = l
+	}
+}
+
+func (lt *leaseTable) load(values, files []string) error {
+	for _, v := range values {
+		l, err := parseLeaseFlag(v)
+		if err != nil {
+			return err
+		}
+		lt.add(l)
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := s.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if len(strings.Fields(line)) == 0 {
+				continue
+			}
+			l, err := parseLease(strings.Fields(line))
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			lt.add(l)
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for ip.
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		return b.String() + "in-addr.arpa."
+	}
+	ip16 := ip.To16()
+	for i := 15; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	return b.String() + "ip6.arpa."
+}
+
+// answer answers for the leases, if the question is about one.
+func (lt *leaseTable) answer(q *dnsMsg) (*dnsMsg, bool) {
+	question := q.Question[0]
+	if question.Class != classINET {
+		return nil, false
+	}
+	name := normalizeName(question.Name)
+	r := reply(q, rcodeSuccess)
+	r.Flags |= flagAA
+	if l, ok := lt.names[name]; ok {
+		for _, ip := range l.addrs {
+			type_ := uint16(typeAAAA)
+			if ip.To4() != nil {
+				type_ = typeA
+			}
+			if question.Type == type_ || question.Type == typeANY {
+				r.Answer = append(r.Answer, dnsRR{Name: question.Name,
+					Type: type_, Class: classINET, TTL: leaseTTL,
+					Data: addrData(ip, type_)})
+			}
+		}
+		return r, true
+	}
+	if l, ok := lt.reverse[name]; ok {
+		if question.Type == typePTR || question.Type == typeANY {
+			r.Answer = []dnsRR{{Name: question.Name, Type: typePTR,
+				Class: classINET, TTL: leaseTTL,
+				Data: appendName(nil, l.name)}}
+		}
+		return r, true
+	}
+	return nil, false
+}
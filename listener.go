@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Listeners with a name, and settings of their own, so that one gdoh
+// can serve the servers' VLAN unfiltered, and the kids' filtered:
+//
+//	-listen :53 -listen kids=192.168.20.1:53
+//	-listener-endpoint kids=https://family.cloudflare-dns.com/dns-query
+//	-policy on:kids=ads,adult
+//
+// (-listen-tcp takes names, too.) A named listener's queries go to
+// its own -listener-endpoint set, if it has one, with a cache of its
+// own; and -policy and -block-type take its clients as on:NAME, an
+// address of theirs still being more specific.
+
+var listenerEndpointFlags = &stringsFlag{}
+
+func init() {
+	listenerEndpointFlags.check = func(v string) error {
+		_, _, err := parseListenerEndpoint(v)
+		return err
+	}
+	flag.Var(listenerEndpointFlags, "listener-endpoint",
+		"Endpoint for the queries to a named listener: NAME=URL (repeatable)")
+}
+
+// splitListen splits a -listen value into the listener's name (if
+// any) and address.
+func splitListen(v string) (name, address string) {
+	if i := strings.Index(v, "="); i > 0 && !strings.ContainsAny(v[:i], ":[") {
+		return v[:i], v[i+1:]
+	}
+	return "", v
+}
+
+func checkListen(v string) error {
+	_, address := splitListen(v)
+	return checkAddress(address)
+}
+
+// listenAddresses are the addresses of the -listen or -listen-tcp
+// values, without the names.
+func listenAddresses(values []string) []string {
+	addresses := []string{}
+	for _, v := range values {
+		_, address := splitListen(v)
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func parseListenerEndpoint(v string) (name, endpoint string, err error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("-listener-endpoint %s: want NAME=URL", v)
+	}
+	rt, err := parseDestination(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("-listener-endpoint %s: %v", v, err)
+	}
+	if rt.server != "" {
+		return "", "", fmt.Errorf("-listener-endpoint %s: want a DoH endpoint", v)
+	}
+	return parts[0], rt.endpoint, nil
+}
+
+// The endpoint sets of the named listeners that have one.
+var listenerEndpoints = map[string][]string{}
+
+func loadListeners() error {
+	names := map[string]bool{}
+	for _, v := range append(append([]string{}, listen.values...), listenTCP.values...) {
+		if name, _ := splitListen(v); name != "" {
+			names[name] = true
+		}
+	}
+	for _, v := range listenerEndpointFlags.values {
+		name, endpoint, err := parseListenerEndpoint(v)
+		if err != nil {
+			return err
+		}
+		if !names[name] {
+			return fmt.Errorf("-listener-endpoint %s: no listener named %s", v, name)
+		}
+		listenerEndpoints[name] = append(listenerEndpoints[name], endpoint)
+	}
+	return nil
+}
+
+// listenerLabel is how the logs name a listener.
+func listenerLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " (" + name + ")"
+}
+
+// onListener is client, as having come in on the named listener.
+func onListener(client net.Addr, name string) net.Addr {
+	if name == "" {
+		return client
+	}
+	return &identifiedAddr{Addr: client, listener: name}
+}
+
+// listenerOf returns the name of the listener client came in on, or
+// "".
+func listenerOf(client net.Addr) string {
+	if ia, ok := client.(*identifiedAddr); ok {
+		return ia.listener
+	}
+	return ""
+}
+
+// upstreamSet names the endpoint set client's queries go to: its
+// listener, if that has one of its own, or "" for the usual ones.
+func upstreamSet(client net.Addr) string {
+	name := listenerOf(client)
+	if _, ok := listenerEndpoints[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// pickEndpointFor picks an endpoint from client's set, for a query
+// about name ("" if it's not known).
+func pickEndpointFor(client net.Addr, name string) string {
+	endpoints, ok := listenerEndpoints[upstreamSet(client)]
+	if !ok {
+		endpoints = dohClient.endpoints()
+	}
+	return dohClient.pickFrom(endpoints, name)
+}
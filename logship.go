@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Log shipping: send the query log (the same sample, see -query-log-sample)
+// in batches to somewhere else, as JSON lines POSTed to a URL, or to
+// Loki's push API. Events wait in memory while the sink is away, up to
+// a point; past that, the oldest go.
+//
+//	gdoh -log-ship http://logs.lan:8080/ingest
+//	gdoh -log-ship http://loki.lan:3100/loki/api/v1/push -log-ship-format loki
+
+var logShipURL = flag.String("log-ship", "",
+	"URL to POST query log batches to (off by default)")
+var logShipFormat = &choiceFlag{value: "jsonl", choices: []string{"jsonl", "loki"}}
+
+func init() {
+	flag.Var(logShipFormat, "log-ship-format",
+		"Format of the shipped batches: jsonl or loki")
+}
+
+const (
+	// How often to send a batch, and how big it can get.
+	logShipInterval = 5 * time.Second
+	logShipBatch    = 1000
+	// How many events to hold on to while the sink is down.
+	logShipBuffer = 100000
+	// Longest wait between retries.
+	logShipMaxBackoff = 5 * time.Minute
+	// How long a sink that's stopped reading gets, before it counts
+	// as down: meanwhile, nothing else gets shipped.
+	logShipTimeout = 30 * time.Second
+)
+
+var logShipClient = &http.Client{Timeout: logShipTimeout}
+
+type logShipper struct {
+	sync.Mutex
+	pending []queryEntry
+	dropped int // since the last successful send
+	shifted int // since the last take
+}
+
+var logShip = &logShipper{}
+
+func (ls *logShipper) enabled() bool {
+	return *logShipURL != ""
+}
+
+func (ls *logShipper) add(e queryEntry) {
+	if !ls.enabled() {
+		return
+	}
+	ls.Lock()
+	defer ls.Unlock()
+	if len(ls.pending) >= logShipBuffer {
+		ls.pending = ls.pending[1:]
+		ls.dropped++
+		ls.shifted++
+	}
+	ls.pending = append(ls.pending, e)
+}
+
+// take returns the next batch, without removing it.
+func (ls *logShipper) take() []queryEntry {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.shifted = 0
+	n := len(ls.pending)
+	if n > logShipBatch {
+		n = logShipBatch
+	}
+	return append([]queryEntry(nil), ls.pending[:n]...)
+}
+
+// done removes a batch that's been sent. Whatever got dropped in the
+// meantime came off the front, too.
+func (ls *logShipper) done(n int) (dropped int) {
+	ls.Lock()
+	defer ls.Unlock()
+	if n > ls.shifted {
+		ls.pending = ls.pending[n-ls.shifted:]
+	}
+	dropped, ls.dropped = ls.dropped, 0
+	return dropped
+}
+
+func (ls *logShipper) run() {
+	if !ls.enabled() {
+		return
+	}
+	wait, failing := logShipInterval, false
+	for {
+		time.Sleep(wait)
+		batch := ls.take()
+		if len(batch) == 0 {
+			continue
+		}
+		if err := ls.send(batch); err != nil {
+			if !failing {
+				log.Printf("log ship error: %s", err.Error())
+			}
+			failing = true
+			wait *= 2
+			if wait > logShipMaxBackoff {
+				wait = logShipMaxBackoff
+			}
+			continue
+		}
+		if dropped := ls.done(len(batch)); dropped > 0 {
+			log.Printf("log ship: dropped %d events", dropped)
+		}
+		if failing {
+			log.Printf("log ship: sending again")
+		}
+		wait, failing = logShipInterval, false
+	}
+}
+
+func (ls *logShipper) send(batch []queryEntry) error {
+	var body []byte
+	var err error
+	contentType := "application/x-ndjson"
+	switch logShipFormat.value {
+	case "jsonl":
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, e := range batch {
+			enc.Encode(e)
+		}
+		body = buf.Bytes()
+	case "loki":
+		body, err = lokiPush(batch)
+		contentType = "application/json"
+	}
+	if err != nil {
+		return err
+	}
+	// Like the alerts, through the system resolver: the sink is
+	// likely on the local network, and we'd rather not log our own
+	// lookups of it.
+	r, err := logShipClient.Post(*logShipURL, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", *logShipURL, r.Status)
+	}
+	return nil
+}
+
+// lokiPush makes a Loki push request: one stream, labelled with the
+// outcome, so that the blocked queries are easy to pick out.
+func lokiPush(batch []queryEntry) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	var order []string
+	for _, e := range batch {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := streams[e.Outcome]
+		if !ok {
+			s = &stream{Stream: map[string]string{
+				"job": "gdoh", "outcome": e.Outcome}}
+			streams[e.Outcome] = s
+			order = append(order, e.Outcome)
+		}
+		s.Values = append(s.Values, [2]string{
+			strconv.FormatInt(e.Time.UnixNano(), 10), string(line)})
+	}
+	var push struct {
+		Streams []*stream `json:"streams"`
+	}
+	for _, outcome := range order {
+		push.Streams = append(push.Streams, streams[outcome])
+	}
+	return json.Marshal(push)
+}
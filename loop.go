@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Forwarding loops: an endpoint on this machine (a local DoH proxy,
+// say) that forwards back to gdoh would have queries going round and
+// round, until something runs out. We catch the obvious cases when
+// loading the config, and break the rest with SERVFAIL: a loop shows
+// up as the same question coming in from this machine, while we're
+// already forwarding it a few times over.
+//
+// The obvious cases are the endpoints, and the -route, -forward,
+// -view-forward and -vpn-forward destinations: DoH on one of our TCP
+// ports, or plain DNS to one of our -listen or -listen-tcp addresses.
+
+// How many identical questions in flight are still a coincidence.
+const loopHops = 4
+
+// LoopError is returned for endpoints that point back at us.
+type LoopError struct {
+	Endpoint string
+}
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("%s: forwarding loop: that's gdoh itself", e.Endpoint)
+}
+
+// localAddr tells if ip belongs to this machine.
+func localAddr(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenPorts are the TCP ports we listen on.
+func listenPorts() map[string]bool {
+	ports := map[string]bool{}
+	addresses := append([]string{*admin}, listenAddresses(listenTCP.values)...)
+	for _, address := range addresses {
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			ports[port] = true
+		}
+	}
+	return ports
+}
+
+// listensOn tells if one of the addresses (ours) is ip:port; bound to
+// all addresses counts.
+func listensOn(addresses []string, ip net.IP, port string) bool {
+	for _, address := range addresses {
+		host, p, err := net.SplitHostPort(address)
+		if err != nil || p != port {
+			continue
+		}
+		if bound := net.ParseIP(host); host == "" || bound.IsUnspecified() || bound.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinations are the routes queries may be sent along, besides the
+// endpoints.
+func destinations() []*route {
+	all := []*route{}
+	for _, rt := range routes {
+		all = append(all, rt)
+	}
+	rules := []forwardRules{forwards}
+	for _, vw := range views {
+		rules = append(rules, vw.forwards)
+	}
+	for _, vp := range vpns.list {
+		rules = append(rules, vp.forwards)
+	}
+	for _, fr := range rules {
+		for _, rt := range fr {
+			all = append(all, rt)
+		}
+	}
+	return all
+}
+
+// checkLoops looks for endpoints, and DNS servers, on this machine:
+// on one of our own ports, that's an error; otherwise, a warning.
+func checkLoops() error {
+	ours := listenPorts()
+	endpoints := append([]string{}, dohClient.Endpoints...)
+	servers := map[string]bool{}
+	for _, rt := range destinations() {
+		if rt.server != "" {
+			servers[rt.server] = true
+		} else if rt.endpoint != "" {
+			endpoints = append(endpoints, rt.endpoint)
+		}
+	}
+	seen := map[string]bool{}
+	for _, endpoint := range endpoints {
+		if seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		host, port := u.Hostname(), u.Port()
+		if port == "" {
+			port = "443"
+		}
+		addrs := []string{host}
+		if pinned, ok := bootstrap.pinned(host); ok {
+			addrs = pinned
+		}
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if strings.ToLower(addr) == "localhost" {
+				ip = net.IPv6loopback
+			}
+			if ip == nil || !localAddr(ip) {
+				continue
+			}
+			if ours[port] {
+				return &LoopError{endpoint}
+			}
+			log.Printf("Endpoint %s is on this machine; "+
+				"make sure it doesn't forward back to us", endpoint)
+		}
+	}
+	// Plain DNS: over UDP, and TCP when truncated.
+	listening := append(listenAddresses(listen.values), listenAddresses(listenTCP.values)...)
+	for server := range servers {
+		host, port := server, "53"
+		if h, p, err := net.SplitHostPort(server); err == nil {
+			host, port = h, p
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !localAddr(ip) {
+			continue
+		}
+		if listensOn(listening, ip, port) {
+			return &LoopError{"dns:" + server}
+		}
+		log.Printf("DNS server %s is on this machine; "+
+			"make sure it doesn't forward back to us", server)
+	}
+	return nil
+}
+
+type loopGuard struct {
+	sync.Mutex
+	inflight map[dnsQuestion]int
+}
+
+var loops = &loopGuard{inflight: map[dnsQuestion]int{}}
+
+// enter notes that we're forwarding q, unless that looks like a loop.
+// Call leave when done.
+func (g *loopGuard) enter(q dnsQuestion, client net.Addr) bool {
+	q.Name = normalizeName(q.Name)
+	g.Lock()
+	defer g.Unlock()
+	if g.inflight[q] >= loopHops {
+		if ip := net.ParseIP(clientHost(client.String())); ip != nil && localAddr(ip) {
+			return false
+		}
+	}
+	g.inflight[q]++
+	return true
+}
+
+func (g *loopGuard) leave(q dnsQuestion) {
+	q.Name = normalizeName(q.Name)
+	g.Lock()
+	defer g.Unlock()
+	if g.inflight[q]--; g.inflight[q] <= 0 {
+		delete(g.inflight, q)
+	}
+}
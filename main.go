@@ -1,18 +1,23 @@
 package main
 
 import (
-	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,11 +29,30 @@ import (
 type DoHClient struct {
 	*http.Client
 	Endpoints []string
+	// Guards Endpoints, which may change while serving; see
+	// endpoints and setEndpoints.
+	mu sync.RWMutex
+	// If set, the outcome of every query is recorded here.
+	health *endpointTracker
 }
 
 // ErrResolver signifies an internal resolver error.
 var ErrResolver = errors.New("Resolver error")
 
+// StatusError is returned when an endpoint answers with anything but
+// 200 OK.
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+	// From the Retry-After header, for 429 and 503; see throttled.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Endpoint, e.StatusCode,
+		http.StatusText(e.StatusCode))
+}
+
 // The DNS-JSON format uses the "human readable" record type names in
 // requests, but the wire format's opaque numbers in responses; we
 // need to translate them back.
@@ -39,48 +63,227 @@ var typeNameToNumber = map[string]int{
 	"NS":    2,
 	"CNAME": 5,
 	"SOA":   6,
+	"NULL":  10,
 	"PTR":   12,
 	"MX":    15,
 	"TXT":   16,
 	"AAAA":  28,
 	"SRV":   33,
+	"SVCB":  64,
+	"HTTPS": 65,
 }
 
 // pickEndpoint chooses an endpoint at random, so that 1. we
 // load-balance; 2. we do not send 100% of our DNS traffic to a single
-// entity.
+// entity. Healthy endpoints first, though, if we know.
 func (c *DoHClient) pickEndpoint() string {
-	return c.Endpoints[rand.Int()%len(c.Endpoints)]
+	return c.pickFrom(c.endpoints(), "")
+}
+
+// pickForName is pickEndpoint, for a query about name (see -select).
+func (c *DoHClient) pickForName(name string) string {
+	return c.pickFrom(c.endpoints(), name)
+}
+
+// pickFrom is pickForName, among the given endpoints; with no name, it
+// picks at random.
+func (c *DoHClient) pickFrom(endpoints []string, name string) string {
+	if c.health != nil {
+		if healthy := c.health.healthy(endpoints); len(healthy) > 0 {
+			endpoints = healthy
+		}
+	}
+	switch {
+	case selectMode.value == "failover":
+		return endpoints[0]
+	case name != "" && selectMode.value == "shard":
+		return shard(endpoints, name)
+	}
+	return endpoints[random.Intn(len(endpoints))]
+}
+
+func (c *DoHClient) endpoints() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Endpoints
+}
+
+func (c *DoHClient) setEndpoints(endpoints []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Endpoints = endpoints
 }
 
 // RawQuery performs a raw DNS query, using the wire format.
 func (c *DoHClient) RawQuery(query []byte) ([]byte, error) {
-	r, err := c.Client.Post(
-		c.pickEndpoint(),
-		"application/dns-udpwireformat",
-		bytes.NewBuffer(query),
-	)
+	return c.RawQueryTo(c.pickEndpoint(), query)
+}
+
+// RawQueryTo is RawQuery, sent to the given endpoint.
+func (c *DoHClient) RawQueryTo(endpoint string, query []byte) ([]byte, error) {
+	resp, _, err := c.rawQuery(context.Background(), endpoint, query)
+	return resp, err
+}
+
+// rawQuery is RawQueryTo, that also tells for how many more seconds
+// the HTTP headers say the response is fresh; -1 if they don't say.
+func (c *DoHClient) rawQuery(ctx context.Context, endpoint string, query []byte) (resp []byte, maxAge int, err error) {
+	r, err := c.RawQueryFull(ctx, endpoint, query)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
+	}
+	return r.Msg, r.MaxAge, nil
+}
+
+// RawResponse is a wire format response, and how it got here.
+type RawResponse struct {
+	Msg      []byte
+	Endpoint string
+	Status   int    // HTTP status
+	Proto    string // HTTP version, e.g. "HTTP/2.0"
+	Latency  time.Duration
+	Header   http.Header
+	// For how many more seconds the HTTP headers say the response
+	// is fresh; -1 if they don't say.
+	MaxAge int
+}
+
+// RawQueryFull is RawQueryTo, with all there is to know about the
+// response; with an empty endpoint, it picks one. Errors come with
+// what's known so far (say, the status, for a StatusError), but no
+// Msg.
+func (c *DoHClient) RawQueryFull(ctx context.Context, endpoint string, query []byte) (resp *RawResponse, err error) {
+	if endpoint == "" {
+		endpoint = c.pickEndpoint()
+	}
+	resp = &RawResponse{Endpoint: endpoint, MaxAge: -1}
+	// Not the endpoint's fault; doesn't go in its health record.
+	if c.health != nil {
+		if until, ok := c.health.pausedUntil(endpoint); ok {
+			return resp, &PausedError{endpoint, until}
+		}
+	}
+	if err := upstreamLimit.wait(ctx, endpoint); err != nil {
+		return resp, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *requestTimeout)
+	defer cancel()
+	padded := pad(query)
+	start := time.Now()
+	defer func() {
+		resp.Latency = time.Since(start)
+		if c.health != nil {
+			c.health.record(endpoint, resp.Latency, err)
+			c.health.transferred(endpoint, len(padded), len(resp.Msg))
+		}
+	}()
+	retries.earn()
+	tracef(ctx, "%s %s", wireMethod.value, endpoint)
+	r, reused, err := c.send(ctx, endpoint, padded)
+	if err != nil && reused && staleConnection(err) && retries.spend() {
+		// The connection went away while idle; try a fresh one.
+		log.Printf("retrying: %s: %s", endpoint, err.Error())
+		tracef(ctx, "stale connection (%s), retrying", err.Error())
+		c.closeIdle(endpoint)
+		r, _, err = c.send(ctx, endpoint, padded)
+	}
+	if err != nil {
+		return resp, err
 	}
 	defer r.Body.Close()
+	resp.Status, resp.Proto, resp.Header = r.StatusCode, r.Proto, r.Header
+	tracef(ctx, "%s %d, in %s", r.Proto, r.StatusCode, time.Since(start).Round(time.Microsecond))
+	if c.health != nil {
+		c.health.spoke(endpoint, r.Proto, r.ProtoMajor)
+	}
+	if err := checkProto(endpoint, r.Request.URL.Hostname(), r.Proto, r.ProtoMajor); err != nil {
+		return resp, err
+	}
 	if r.StatusCode != 200 {
-		log.Printf("response: %#v", r)
-		return nil, ErrResolver
+		err := &StatusError{Endpoint: endpoint, StatusCode: r.StatusCode}
+		if r.StatusCode == http.StatusTooManyRequests ||
+			r.StatusCode == http.StatusServiceUnavailable {
+			err.RetryAfter = retryAfter(r.Header, time.Now())
+		}
+		return resp, err
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return resp, err
 	}
-	return body, nil
+	if wireMethod.value == "GET" && len(body) >= 2 && len(query) >= 2 {
+		// Sent with ID 0; put the real one back.
+		copy(body[:2], query[:2])
+	}
+	resp.Msg, resp.MaxAge = unpad(body, query), freshness(r.Header)
+	return resp, nil
+}
+
+// freshness is what's left of the response's max-age (RFC 8484,
+// section 5.1: it should be no more than the smallest TTL), or -1.
+func freshness(h http.Header) int {
+	maxAge := -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			n, err := strconv.Atoi(directive[len("max-age="):])
+			if err == nil && n >= 0 {
+				maxAge = n
+			}
+		}
+	}
+	if maxAge < 0 {
+		return -1
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		maxAge -= age
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return maxAge
 }
 
 // Query performs a DNS-JSON query.
-func (c *DoHClient) Query(name, type_ string) ([]string, error) {
+func (c *DoHClient) Query(name, type_ string) (answers []string, err error) {
+	records, err := c.QueryRecords(name, type_)
+	if err != nil {
+		return nil, err
+	}
+	answers = []string{}
+	for _, rr := range records {
+		answers = append(answers, rr.Data)
+	}
+	return answers, nil
+}
+
+// JSONRecord is an answer from a DNS-JSON query.
+type JSONRecord struct {
+	Type int
+	TTL  uint32
+	Data string
+}
+
+// QueryRecords is Query, with the TTLs.
+func (c *DoHClient) QueryRecords(name, type_ string) ([]JSONRecord, error) {
+	return c.queryRecords(context.Background(), name, type_)
+}
+
+func (c *DoHClient) queryRecords(ctx context.Context, name, type_ string) (answers []JSONRecord, err error) {
 	if _, ok := typeNameToNumber[type_]; !ok {
 		return nil, ErrResolver
 	}
-	u, err := url.Parse(c.pickEndpoint())
+	endpoint := c.pickForName(name)
+	if c.health != nil {
+		start := time.Now()
+		defer func() {
+			c.health.record(endpoint, time.Since(start), err)
+		}()
+	}
+	u, err := url.Parse(endpoint)
 	if err != nil {
 		panic(err)
 	}
@@ -89,11 +292,19 @@ func (c *DoHClient) Query(name, type_ string) ([]string, error) {
 		url.QueryEscape(name),
 		url.QueryEscape(type_),
 	)
-	req, err := http.NewRequest("GET", u.String(), nil)
+	padURL(u)
+	ctx, cancel := context.WithTimeout(ctx, *requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Accept", "application/dns-json")
+	// JSON compresses rather well. http.Transport would ask for gzip by
+	// itself, but not with DisableCompression, or on a transport we
+	// don't know about; so we ask, and unpack, ourselves.
+	req.Header.Add("Accept-Encoding", "gzip")
+	addEndpointHeaders(req)
 	r, err := c.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -103,21 +314,59 @@ func (c *DoHClient) Query(name, type_ string) ([]string, error) {
 		log.Printf("response: %#v", r)
 		return nil, ErrResolver
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
+	if c.health != nil {
+		c.health.transferred(endpoint, 0, len(body))
+	}
 	var v struct {
-		Answer []struct {
-			Type int
-			Data string
-		}
+		Answer []JSONRecord
 	}
 	json.Unmarshal(body, &v)
-	answers := []string{}
+	answers = []JSONRecord{}
 	for _, a := range v.Answer {
 		if a.Type == typeNameToNumber[type_] {
-			answers = append(answers, a.Data)
+			answers = append(answers, a)
+		}
+	}
+	return answers, nil
+}
+
+// queryRecordsWire is QueryRecords, over the wire format, for the
+// endpoints that don't speak DNS-JSON.
+func (c *DoHClient) queryRecordsWire(ctx context.Context, name, type_ string) (answers []JSONRecord, err error) {
+	qtype, ok := typeNameToNumber[type_]
+	if !ok {
+		return nil, ErrResolver
+	}
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{normalizeName(name), uint16(qtype), classINET}},
+	}
+	resp, _, err := c.rawQuery(ctx, c.pickForName(q.Question[0].Name), q.pack())
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return nil, err
+	}
+	answers = []JSONRecord{}
+	for _, rr := range r.Answer {
+		if int(rr.Type) == qtype {
+			answers = append(answers, JSONRecord{
+				Type: qtype, TTL: rr.TTL, Data: rdataString(rr)})
 		}
 	}
 	return answers, nil
@@ -129,7 +378,7 @@ func (c *DoHClient) Query(name, type_ string) ([]string, error) {
 // 1.0.0.1 and 1.1.1.1, we can resolve dns.google.com and such,
 // without hitting outbound UDP port 53.
 var rootDohClient = &DoHClient{
-	Client: http.DefaultClient,
+	Client: &http.Client{Transport: cleanHeaders{http.DefaultTransport}},
 	Endpoints: []string{
 		"https://1.0.0.1/dns-query",
 		"https://1.1.1.1/dns-query",
@@ -140,98 +389,316 @@ var rootDohClient = &DoHClient{
 }
 
 // dialContext is a special flavor of DialContext, that figures out if
-// we have to skip the system's DNS resolver, and uses DNS-JSON with
-// rootDohClient above to establish a connection to the given address.
+// we have to skip the system's DNS resolver, and uses rootDohClient
+// above (see bootstrap) to establish a connection to the given
+// address. ctx bounds all of it, the lookup included.
 func dialContext(ctx context.Context,
 	network, address string) (net.Conn, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
-	if net.ParseIP(host) == nil {
-		// Yep, this looks like a hostname, let's DoH it.
-		// TODO: IPv6?
-		answers, err := rootDohClient.Query(host, "A")
-		if err != nil {
-			return nil, err
+	if net.ParseIP(host) != nil {
+		return dialer(*dialTimeout, host).DialContext(ctx, network, address)
+	}
+	// Yep, this looks like a hostname, let's DoH it.
+	// TODO: IPv6?
+	answers, err := bootstrap.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// Start at a random answer, to spread the load, and go down the
+	// list until one connects. Like net.Dialer does with its own
+	// lists, each gets its share of what's left of the time, so that
+	// a dead first address doesn't use it all up. The caller may be
+	// in more of a hurry than -dial-timeout.
+	deadline := time.Now().Add(*dialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	first := random.Int()
+	for i := range answers {
+		answer := answers[(first+i)%len(answers)]
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		timeout := left / time.Duration(len(answers)-i)
+		if timeout < dialMinShare {
+			timeout = dialMinShare
+		}
+		if timeout > left {
+			timeout = left
+		}
+		conn, dialErr := dialer(timeout, answer).DialContext(ctx, network,
+			net.JoinHostPort(answer, port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		if err == nil {
+			err = dialErr
 		}
-		if len(answers) == 0 {
-			log.Printf("no answers: %s", host)
-			return nil, ErrResolver
+		if ctx.Err() != nil {
+			break
 		}
-		// Pick a random answer
-		answer := answers[rand.Int()%len(answers)]
-		log.Printf("translated: %s -> %s", host, answer)
-		address = net.JoinHostPort(answer, port)
 	}
-	return (&net.Dialer{
-		Timeout:   5 * time.Second,
-		KeepAlive: 30 * time.Second,
+	if err == nil {
+		err = fmt.Errorf("dial %s: %w", address, context.DeadlineExceeded)
+	}
+	return nil, err
+}
+
+// Each address gets at least this long, if there's that much time.
+const dialMinShare = 2 * time.Second
+
+// dialer makes a net.Dialer, for connecting to host (an IP address),
+// the -outbound way.
+func dialer(timeout time.Duration, host string) *net.Dialer {
+	return bindOutbound(&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: tcpKeepAlive(),
 		DualStack: true,
-	}).DialContext(ctx, network, address)
+	}, host)
 }
 
 // The "public" client instance.
 var dohClient = &DoHClient{
 	Client: &http.Client{
-		Transport: &http.Transport{
-			DialContext:           dialContext,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+		Transport: &endpointTransports{
+			// Timeouts: see configureTransport.
+			base: &http.Transport{
+				DialContext:           dialContext,
+				MaxIdleConns:          10,
+				ExpectContinueTimeout: 1 * time.Second,
+			},
+			hosts: map[string]*http.Transport{},
 		},
 	},
-	Endpoints: []string{
-		"https://1.0.0.1/dns-query",
-		"https://1.1.1.1/dns-query",
-		"https://dns.google.com/experimental",
-		"https://doh.cleanbrowsing.org/doh/security-filter/",
-		// TODO: IPv6?
-		// "https://[2606:4700:4700::1001]/dns-query",
-		// "https://[2606:4700:4700::1111]/dns-query",
-	},
+	// Endpoints: see -endpoint, and setup.
+	health: newEndpointTracker(),
 }
 
-var listen = flag.String("listen", ":53", "UDP address to listen on")
+var listen = &stringsFlag{values: []string{":53"}}
 
-func main() {
-	if len(dohClient.Endpoints) == 0 {
-		log.Fatal("No endpoints configured")
-	}
-	flag.Parse()
-	laddr, err := net.ResolveUDPAddr("udp", *listen)
+func init() {
+	listen.check = checkListen
+	flag.Var(listen, "listen", "UDP address to listen on, optionally NAME=ADDRESS (repeatable);\n"+
+		"0.0.0.0:53 is IPv4-only, [::]:53 IPv6-only, :53 dual-stack")
+}
+
+var workers = flag.Int("workers", 256,
+	"Number of goroutines answering UDP queries")
+var queueSize = flag.Int("queue", 1024,
+	"How many UDP queries can wait for a worker; any more are dropped")
+
+// network picks the socket family from the address itself: an IPv4
+// literal gets an IPv4-only socket, an IPv6 literal (possibly
+// link-local, with a zone: [fe80::1%eth0]:53) an IPv6-only one, and
+// an empty host a dual-stack one. Hostnames are left to the system.
+func network(proto, address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	ln, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Fatal(err)
+	if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+		if ip.To4() != nil {
+			return proto + "4", nil
+		}
+		return proto + "6", nil
+	}
+	return proto, nil
+}
+
+// listenUDP binds a UDP listener, see network above; or takes the
+// one handed over (see handoff.go).
+func listenUDP(address string) (*net.UDPConn, error) {
+	var ln *net.UDPConn
+	if f := inherited("udp", address); f != nil {
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ln = pc.(*net.UDPConn)
+	} else {
+		network, err := network("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		laddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = net.ListenUDP(network, laddr); err != nil {
+			return nil, err
+		}
 	}
-	log.Printf("Listening on %s", laddr.String())
-	defer ln.Close()
+	keepSocket("udp", address, ln.File)
+	return ln, nil
+}
+
+// A UDP query, waiting for a worker.
+type packet struct {
+	ln       *net.UDPConn
+	listener string // the name, if it has one
+	query    []byte
+	addr     *net.UDPAddr
+}
 
+// The queue, shared by all the UDP listeners. Most of a worker's life
+// is spent waiting on upstream, so there are many more of them than
+// CPUs; but a fixed number, so that a flood costs dropped queries
+// (which the clients will retry) rather than all our memory.
+var packets chan packet
+
+func startWorkers() error {
+	if *workers < 1 || *queueSize < 0 {
+		return errors.New("-workers must be at least 1, and -queue can't be negative")
+	}
+	packets = make(chan packet, *queueSize)
+	handoff.working.Add(*workers)
+	for i := 0; i < *workers; i++ {
+		go work()
+	}
+	return nil
+}
+
+func work() {
+	defer handoff.working.Done()
+	for p := range packets {
+		resp := answer(p.query, onListener(p.addr, p.listener))
+		if len(resp) == 0 {
+			continue
+		}
+		resp = truncate(resp, p.query)
+		_, _, err := p.ln.WriteMsgUDP(resp, nil, p.addr)
+		if err != nil {
+			log.Print("write error:", err.Error())
+		}
+	}
+}
+
+// serve reads queries arriving on ln (named name, maybe), and queues
+// them, until stopping.
+func serve(ln *net.UDPConn, name string) {
+	defer handoff.serving.Done()
+	// Room for signed UPDATEs, too.
+	buf := make([]byte, ednsUDPSize)
 	for {
-		query := make([]byte, 128)
-		n, _, _, addr, err := ln.ReadMsgUDP(query, nil)
+		n, _, _, addr, err := ln.ReadMsgUDP(buf, nil)
+		if err != nil && stopping() {
+			return
+		}
 		if err != nil {
 			log.Print("read error:", err.Error())
 			continue
 		}
-		query = query[:n]
+		query := append([]byte(nil), buf[:n]...)
+		select {
+		case packets <- packet{ln, name, query, addr}:
+		default:
+			atomic.AddInt64(&stats.Dropped, 1)
+		}
+	}
+}
 
-		go func(query []byte, addr *net.UDPAddr) {
-			var err error
-			resp, err := dohClient.RawQuery(query)
-			if err != nil {
-				log.Print("query error:", err.Error())
-				// TODO: how to tell client we've got an error?
-				resp = []byte{0}
-			}
-			_, _, err = ln.WriteMsgUDP(resp, nil, addr)
-			if err != nil {
-				log.Print("write error:", err.Error())
-			}
-		}(query, addr)
+// serveCommand is "gdoh serve", and plain "gdoh": the server.
+func serveCommand(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Unexpected arguments: %s", strings.Join(args, " "))
+	}
+	if err := startWorkers(); err != nil {
+		return err
+	}
+	runSelfTest()
+	handleSignals()
+	go watchHealth()
+	go bootstrap.refresh()
+	go refreshResolverList()
+	go watchCaptive()
+	go ipsets.run()
+	go passive.run()
+	go blocked.watch(blockFiles.values)
+	go queryLog.run()
+	go logShip.run()
+	go statsd.run()
+	go vpns.run()
+	go watchNetwork()
+	go sendDecoys()
+	go keepStandby()
+	go keepReputation()
+	go watchCAs()
+	go refreshTLSRecords()
+	streams := []net.Listener{}
+	if *admin != "" {
+		ln, err := listenStream(*admin)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, ln)
+		go serveAdmin(ln)
+	}
+	lns, names := []*net.UDPConn{}, []string{}
+	for _, v := range listen.values {
+		name, address := splitListen(v)
+		ln, err := listenUDP(address)
+		if err != nil {
+			return err
+		}
+		log.Printf("Listening on %s%s", ln.LocalAddr().String(), listenerLabel(name))
+		defer ln.Close()
+		lns, names = append(lns, ln), append(names, name)
+	}
+	for _, v := range listenTCP.values {
+		name, address := splitListen(v)
+		ln, err := listenStream(address)
+		if err != nil {
+			return err
+		}
+		log.Printf("Listening on %s/tcp%s", ln.Addr().String(), listenerLabel(name))
+		streams = append(streams, ln)
+		go serveTCP(ln, v)
+	}
+	atomic.StoreInt32(&listening, 1)
+	handoff.serving.Add(len(lns))
+	for i, ln := range lns {
+		go serve(ln, names[i])
+	}
+	handedOver()
+	drain(lns, streams)
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	name, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		usage()
+		log.Fatalf("Unknown command: %s", name)
+	}
+	if name == "serve" {
+		// "gdoh serve -listen ..." reads nicer than the other way round.
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.setup {
+		if err := setup(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cmd.run(args); err != nil {
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// /metrics: the counters, in the Prometheus text format, for those
+// who'd rather graph them than poll /api/stats. Scrape it with the
+// admin token:
+//
+//	- job_name: gdoh
+//	  authorization: {credentials: s3cret}
+//	  static_configs: [{targets: ["127.0.0.1:8053"]}]
+
+type metric struct {
+	name, kind, help string
+	labels           string // {name="value",...}, or empty
+	value            float64
+}
+
+func metrics() []metric {
+	c := stats.snapshot()
+	cs := responseCache.stats()
+	ms := []metric{
+		{"gdoh_queries_total", "counter", "Queries received.", "", float64(c.Queries)},
+		{"gdoh_blocked_total", "counter", "Queries blocked.", "", float64(c.Blocked)},
+		{"gdoh_errors_total", "counter", "Queries answered with an error.", "", float64(c.Errors)},
+		{"gdoh_dropped_total", "counter", "UDP queries dropped, with the queue full.", "", float64(c.Dropped)},
+		{"gdoh_retries_total", "counter", "Upstream retries.", "", float64(c.Retries)},
+		{"gdoh_retries_denied_total", "counter", "Upstream retries not made, over the retry budget.", "", float64(c.RetriesDenied)},
+		{"gdoh_shed_total", "counter", "Upstream queries not sent, over the rate limits.", "", float64(c.Shed)},
+		{"gdoh_answers_filtered_total", "counter", "Answer records caught by -answer-filter.", "", float64(c.Filtered)},
+		{"gdoh_decoys_total", "counter", "Decoy queries sent.", "", float64(atomic.LoadInt64(&decoys.sent))},
+		{"gdoh_standby_queries_total", "counter", "Queries sent to keep standby endpoints connected.", "", float64(atomic.LoadInt64(&standbyPings))},
+		{"gdoh_cache_hits_total", "counter", "Queries answered from the cache.", "", float64(cs.Hits)},
+		{"gdoh_cache_misses_total", "counter", "Queries not in the cache.", "", float64(cs.Misses)},
+		{"gdoh_cache_evictions_total", "counter", "Cache entries dropped to make room.", "", float64(cs.Evictions)},
+		{"gdoh_cache_expired_total", "counter", "Expired cache entries dropped.", "", float64(cs.Expired)},
+		{"gdoh_cache_stale_served_total", "counter", "Expired answers served (never: no serve-stale).", "", float64(cs.StaleServed)},
+		{"gdoh_cache_prefetched_total", "counter", "Answers refreshed before they expired (never: no prefetch).", "", float64(cs.Prefetched)},
+		{"gdoh_cache_entries", "gauge", "Cached responses.", "", float64(cs.Entries)},
+		{"gdoh_cache_capacity", "gauge", "Maximum number of cached responses.", "", float64(cs.Capacity)},
+		{"gdoh_cache_bytes", "gauge", "Estimated memory used by the cache.", "", float64(cs.Bytes)},
+	}
+	for _, b := range typeBlocks {
+		ms = append(ms, metric{"gdoh_type_blocked_total", "counter",
+			"Queries blocked by a -block-type rule.", fmt.Sprintf("{rule=%q}", b.rule),
+			float64(atomic.LoadInt64(&b.hits))})
+	}
+	ms = append(ms, vpnMetrics()...)
+	return append(ms, endpointMetrics()...)
+}
+
+// endpointMetrics are the per-endpoint counters, grouped by metric
+// name, as the format wants.
+func endpointMetrics() []metric {
+	hs := dohClient.health.snapshot(dohClient.endpoints())
+	ms := []metric{}
+	add := func(name, kind, help string, value func(h endpointHealth) int64) {
+		for _, h := range hs {
+			labels := fmt.Sprintf("{endpoint=%q}", h.Endpoint)
+			ms = append(ms, metric{name, kind, help, labels, float64(value(h))})
+		}
+	}
+	add("gdoh_endpoint_queries_total", "counter", "Queries sent to the endpoint.",
+		func(h endpointHealth) int64 { return h.Queries })
+	add("gdoh_endpoint_errors_total", "counter", "Failed queries to the endpoint.",
+		func(h endpointHealth) int64 { return h.Errors })
+	add("gdoh_endpoint_timeouts_total", "counter", "Queries to the endpoint that timed out.",
+		func(h endpointHealth) int64 { return h.Timeouts })
+	for _, h := range hs {
+		for _, c := range []struct {
+			class string
+			n     int64
+		}{
+			{"2xx", h.Status2xx}, {"3xx", h.Status3xx},
+			{"4xx", h.Status4xx}, {"5xx", h.Status5xx},
+		} {
+			ms = append(ms, metric{"gdoh_endpoint_responses_total", "counter",
+				"HTTP responses from the endpoint, by status class.",
+				fmt.Sprintf("{endpoint=%q,class=%q}", h.Endpoint, c.class),
+				float64(c.n)})
+		}
+	}
+	for _, h := range hs {
+		for _, v := range []struct {
+			proto string
+			n     int64
+		}{
+			{"1.1", h.HTTP1}, {"2", h.HTTP2}, {"3", h.HTTP3},
+		} {
+			ms = append(ms, metric{"gdoh_endpoint_http_exchanges_total", "counter",
+				"Exchanges with the endpoint, by HTTP version.",
+				fmt.Sprintf("{endpoint=%q,proto=%q}", h.Endpoint, v.proto),
+				float64(v.n)})
+		}
+	}
+	add("gdoh_endpoint_paused_total", "counter", "Times the endpoint asked us to back off (429 or 503, with a Retry-After).",
+		func(h endpointHealth) int64 { return h.Paused })
+	add("gdoh_endpoint_paused", "gauge", "1 while the endpoint is taking the break it asked for.",
+		func(h endpointHealth) int64 {
+			if time.Now().Before(h.PausedUntil) {
+				return 1
+			}
+			return 0
+		})
+	add("gdoh_endpoint_sent_bytes_total", "counter", "Bytes sent to the endpoint, in request bodies.",
+		func(h endpointHealth) int64 { return h.BytesSent })
+	add("gdoh_endpoint_received_bytes_total", "counter", "Bytes received from the endpoint, in response bodies.",
+		func(h endpointHealth) int64 { return h.BytesRecv })
+	return ms
+}
+
+func writeMetrics(w io.Writer, ms []metric) {
+	last := ""
+	for _, m := range ms {
+		if m.name != last {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+				m.name, m.help, m.name, m.kind)
+			last = m.name
+		}
+		fmt.Fprintf(w, "%s%s %g\n", m.name, m.labels, m.value)
+	}
+}
+
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, metrics())
+}
@@ -0,0 +1,85 @@
+package main
+
+import "flag"
+
+// Response minimization: relay the answer to the question, and little
+// else. The additional section goes (but for the OPT record), and so
+// does the authority section, unless it's what makes a negative answer
+// cacheable; answer records that aren't on the CNAME chain from the
+// queried name go, too. What's left is smaller (less truncation over
+// UDP), and there's less for a client to cache that it never asked for.
+
+var minimize = flag.Bool("minimize", false,
+	"Strip responses down to the answer: no additional records, no authority for positive answers")
+
+// DNSSEC records kept alongside what they cover.
+const (
+	typeRRSIG = 46
+	typeNSEC  = 47
+	typeNSEC3 = 50
+)
+
+func minimizeResponse(r *dnsMsg) {
+	if !*minimize || len(r.Question) != 1 {
+		return
+	}
+	q := r.Question[0]
+	r.Answer = answerChain(q, r.Answer)
+	additional := []dnsRR{}
+	for _, rr := range r.Additional {
+		if rr.Type == typeOPT {
+			additional = append(additional, rr)
+		}
+	}
+	r.Additional = additional
+	if len(r.Answer) > 0 {
+		r.Authority = nil
+		return
+	}
+	authority := []dnsRR{}
+	for _, rr := range r.Authority {
+		switch rr.Type {
+		case typeSOA, typeNSEC, typeNSEC3, typeRRSIG:
+			authority = append(authority, rr)
+		}
+	}
+	r.Authority = authority
+}
+
+// answerChain returns the records answering q: those under the queried
+// name, or a name a CNAME led to, of the asked type (or CNAMEs, or
+// their signatures).
+func answerChain(q dnsQuestion, rrs []dnsRR) []dnsRR {
+	names := map[string]bool{normalizeName(q.Name): true}
+	keep := make([]bool, len(rrs))
+	// The chain can come in any order; go over it until it stops
+	// growing.
+	for changed := true; changed; {
+		changed = false
+		for i, rr := range rrs {
+			if keep[i] || !names[normalizeName(rr.Name)] {
+				continue
+			}
+			switch {
+			case rr.Type == typeCNAME:
+				target, _, err := readName(rr.Data, 0)
+				if err != nil {
+					continue
+				}
+				names[normalizeName(target)] = true
+				changed = true
+			case rr.Type == q.Type, q.Type == typeANY, rr.Type == typeRRSIG:
+			default:
+				continue
+			}
+			keep[i] = true
+		}
+	}
+	chain := []dnsRR{}
+	for i, rr := range rrs {
+		if keep[i] {
+			chain = append(chain, rr)
+		}
+	}
+	return chain
+}
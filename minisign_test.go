@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// RFC 7693, appendix A ("abc"), and the empty input; the rest from
+// Python's hashlib.blake2b, across the block boundaries.
+func TestBlake2b512(t *testing.T) {
+	long := make([]byte, 1000)
+	for i := range long {
+		long[i] = byte(i % 251)
+	}
+	seq := make([]byte, 129)
+	for i := range seq {
+		seq[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		data []byte
+		want string
+	}{
+		{[]byte(""), "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{[]byte("abc"), "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{seq[:128], "2319e3789c47e2daa5fe807f61bec2a1a6537fa03f19ff32e87eecbfd64b7e0e8ccff439ac333b040f19b0c4ddd11a61e24ac1fe0f10a039806c5dcc0da3d115"},
+		{seq, "f59711d44a031d5f97a9413c065d1e614c417ede998590325f49bad2fd444d3e4418be19aec4e11449ac1a57207898bc57d76a1bcf3566292c20c683a5c4648f"},
+		{long, "c11e1c0340bd7e5a1b275f1230c962fad215ecb1391486e74e31b960a2f2996381a5fad092da06841d5f26e38f6ecfeaf441acbcd1c2de61aef121e7927175f5"},
+	} {
+		sum := blake2b512(tc.data)
+		if got := hex.EncodeToString(sum[:]); got != tc.want {
+			t.Errorf("BLAKE2b-512 of %d bytes: got %s, want %s", len(tc.data), got, tc.want)
+		}
+	}
+}
+
+// Signed with the RFC 8032 reference code (section 6), not gdoh's, in
+// minisign's formats.
+const (
+	testMinisignKey  = "RWQBI0VniavN72ADYC6hrkbsS67YzD9I3A9DrIrDYONpGeykqUwWtK5/"
+	testMinisignData = "## resolver list\n\nhello\n"
+	// Over the BLAKE2b-512 hash, as minisign does by default.
+	testMinisigHashed = "untrusted comment: signature from minisign secret key\n" +
+		"RUQBI0VniavN73FAlK7vmmuJAW47BSVmmaKYS3s8zonw4e/TCPygeJOQzuU0Q+WrAvd8oZLT+TBgHQu5rTNA/baKMg0mJB3WqA8=\n" +
+		"trusted comment: timestamp:1792000000\tfile:list.md\thashed\n" +
+		"EHViPLUtedPTD9zHjPihnsgcSYEr12kVRBRUb/qB9+OXCA7hLEYaGDBS7+fO4lBlHE3fnn+abmlccipB0WaLBw==\n"
+	// Over the data itself (legacy).
+	testMinisigLegacy = "untrusted comment: signature from minisign secret key\n" +
+		"RWQBI0VniavN7xqOEiS/hahPrE902aRuQVCexOCcEiyc8T0bkdB6tXQb6eAO7xGnicE/6J2VV5K8genFZBVZfxiYSAIKYkM1pAc=\n" +
+		"trusted comment: timestamp:1792000000\tfile:list.md\n" +
+		"5Wc2lfd76G81zq6t6/aW5H+IV1QInDtJVyZ1SaKgRaBdF4nUFaSmiPHuAZ5PB1GjUqq7KJ8z2CCY2UibOFDpCA==\n"
+)
+
+func TestMinisignVerify(t *testing.T) {
+	k, err := parseMinisignKey(testMinisignKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(testMinisigHashed, "\n")
+	withLine := func(i int, line string) string {
+		l := append([]string{}, lines...)
+		l[i] = line
+		return strings.Join(l, "\n")
+	}
+	for _, tc := range []struct {
+		name    string
+		data    string
+		minisig string
+		ok      bool
+	}{
+		{"hashed", testMinisignData, testMinisigHashed, true},
+		{"legacy", testMinisignData, testMinisigLegacy, true},
+		{"CRLF", testMinisignData, strings.Replace(testMinisigHashed, "\n", "\r\n", -1), true},
+		{"tampered data", testMinisignData + " ", testMinisigHashed, false},
+		{"tampered data, legacy", "#" + testMinisignData, testMinisigLegacy, false},
+		{"tampered trusted comment", testMinisignData,
+			withLine(2, "trusted comment: timestamp:1792000001\tfile:list.md\thashed"), false},
+		// The hashed signature, passed off as a legacy one.
+		{"algorithm", testMinisignData,
+			withLine(1, "RWQBI0VniavN73FAlK7vmmuJAW47BSVmmaKYS3s8zonw4e/TCPygeJOQzuU0Q+WrAvd8oZLT+TBgHQu5rTNA/baKMg0mJB3WqA8="), false},
+		{"another key", testMinisignData,
+			withLine(1, "RUQAAAAAAAAAAHFAlK7vmmuJAW47BSVmmaKYS3s8zonw4e/TCPygeJOQzuU0Q+WrAvd8oZLT+TBgHQu5rTNA/baKMg0mJB3WqA8="), false},
+		{"global signature", testMinisignData,
+			withLine(3, "5Wc2lfd76G81zq6t6/aW5H+IV1QInDtJVyZ1SaKgRaBdF4nUFaSmiPHuAZ5PB1GjUqq7KJ8z2CCY2UibOFDpCA=="), false},
+		{"truncated", testMinisignData, strings.Join(lines[:2], "\n"), false},
+	} {
+		err := k.verify([]byte(tc.data), []byte(tc.minisig))
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: verified", tc.name)
+		}
+	}
+}
+
+func TestParseMinisignKey(t *testing.T) {
+	for _, v := range []string{
+		"",
+		"RWQBI0VniavN72ADYC6hrkbsS67YzD9I3A9DrIrDYONpGeykqUwWtK5",  // short
+		"UkQBI0VniavN72ADYC6hrkbsS67YzD9I3A9DrIrDYONpGeykqUwWtK5/", // "RD"
+	} {
+		if _, err := parseMinisignKey(v); err == nil {
+			t.Errorf("%q: parsed", v)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "gdoh mockserver FILE": a DoH server with canned answers, for
+// testing against, without bothering (or depending on) anyone's real
+// resolver. It speaks RFC 8484 (POST and GET) and DNS-JSON, over TLS;
+// unless given a certificate, it makes one up, and writes it out for
+// -ca-file:
+//
+//	gdoh mockserver -ca-out /tmp/mock.pem fixtures.txt &
+//	gdoh -endpoint https://127.0.0.1:8443/dns-query -ca-file /tmp/mock.pem \
+//	    query example.com
+//
+// The fixtures are records, zone file style, and rcodes for names
+// that should fail:
+//
+//	example.com.      300 IN A     192.0.2.1
+//	www.example.com.  300    CNAME example.com.
+//	example.com.          MX    10 mail.example.com.
+//	example.com.          TXT   "v=spf1 -all"
+//	broken.example.       SERVFAIL
+//
+// Anything else is NXDOMAIN; a name that's there, but without the
+// asked type, gets an empty answer.
+
+type fixture struct {
+	rcode  int
+	answer []dnsRR
+}
+
+// Fixtures, by name; types sorted out when answering.
+type fixtures map[string]*fixture
+
+// The TTL for records that don't say.
+const fixtureTTL = 300
+
+func loadFixtures(path string) (fixtures, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fx := fixtures{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if err := fx.add(strings.Fields(line)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return fx, s.Err()
+}
+
+func (fx fixtures) add(fields []string) error {
+	if len(fields) < 2 {
+		return errors.New("want NAME [TTL] [IN] TYPE DATA, or NAME RCODE")
+	}
+	name := normalizeName(fields[0])
+	e, ok := fx[name]
+	if !ok {
+		e = &fixture{}
+		fx[name] = e
+	}
+	if len(fields) == 2 {
+		for rcode, rn := range rcodeNames {
+			if strings.EqualFold(fields[1], rn) {
+				e.rcode = rcode
+				return nil
+			}
+		}
+	}
+	rr, err := parseRecord(name, fields[1:])
+	if err != nil {
+		return err
+	}
+	e.answer = append(e.answer, rr)
+	return nil
+}
+
+// parseRecord parses "[TTL] [IN] TYPE DATA...", for the few types a
+// test is likely to want.
+func parseRecord(name string, fields []string) (dnsRR, error) {
+	rr := dnsRR{Name: name, Class: classINET, TTL: fixtureTTL}
+	if ttl, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+		rr.TTL = uint32(ttl)
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return rr, errors.New("want TYPE DATA")
+	}
+	type_, err := typeNumber(fields[0])
+	if err != nil {
+		return rr, err
+	}
+	rr.Type = type_
+	data := fields[1:]
+	switch type_ {
+	case typeA, typeAAAA:
+		ip := net.ParseIP(data[0])
+		if ip == nil || (ip.To4() != nil) != (type_ == typeA) {
+			return rr, fmt.Errorf("%s: bad address", data[0])
+		}
+		rr.Data = addrData(ip, type_)
+	case typeCNAME, typeNS, typePTR:
+		rr.Data = appendName(nil, normalizeName(data[0]))
+	case typeMX:
+		pref, err := strconv.ParseUint(data[0], 10, 16)
+		if err != nil || len(data) < 2 {
+			return rr, errors.New("want MX PREFERENCE HOST")
+		}
+		rr.Data = binary.BigEndian.AppendUint16(nil, uint16(pref))
+		rr.Data = appendName(rr.Data, normalizeName(data[1]))
+	case typeTXT:
+		text := strings.Trim(strings.Join(data, " "), `"`)
+		for len(text) > 255 {
+			rr.Data = append(append(rr.Data, 255), text[:255]...)
+			text = text[255:]
+		}
+		rr.Data = append(append(rr.Data, byte(len(text))), text...)
+	default:
+		return rr, fmt.Errorf("%s records aren't supported", typeName(type_))
+	}
+	return rr, nil
+}
+
+// answer makes the response to q.
+func (fx fixtures) answer(q *dnsMsg) *dnsMsg {
+	if len(q.Question) != 1 {
+		return reply(q, rcodeFormErr)
+	}
+	question := q.Question[0]
+	name := normalizeName(question.Name)
+	r := reply(q, rcodeNXDomain)
+	r.Flags |= flagAA
+	// Follow CNAMEs, a few hops.
+	for hops := 0; hops < 8; hops++ {
+		e, ok := fx[name]
+		if !ok {
+			break
+		}
+		r.setRcode(e.rcode)
+		if e.rcode != rcodeSuccess {
+			break
+		}
+		next := ""
+		for _, rr := range e.answer {
+			switch {
+			case rr.Type == question.Type, question.Type == typeANY:
+				r.Answer = append(r.Answer, rr)
+			case rr.Type == typeCNAME:
+				r.Answer = append(r.Answer, rr)
+				next, _, _ = readName(rr.Data, 0)
+			}
+		}
+		if next == "" || question.Type == typeCNAME {
+			break
+		}
+		name = normalizeName(next)
+	}
+	return r
+}
+
+func (fx fixtures) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	switch {
+	case r.Method == "POST":
+		query, err = ioutil.ReadAll(r.Body)
+	case r.FormValue("dns") != "":
+		query, err = base64.RawURLEncoding.DecodeString(
+			strings.TrimRight(r.FormValue("dns"), "="))
+	case r.FormValue("name") != "":
+		fx.serveJSON(w, r)
+		return
+	default:
+		http.Error(w, "No query", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := parseMsg(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(fx.answer(q).pack())
+}
+
+// serveJSON answers a DNS-JSON query, the way Google and Cloudflare
+// do, give or take.
+func (fx fixtures) serveJSON(w http.ResponseWriter, r *http.Request) {
+	type_ := uint16(typeA)
+	if t := r.FormValue("type"); t != "" {
+		var err error
+		if type_, err = typeNumber(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	name := normalizeName(r.FormValue("name"))
+	resp := fx.answer(&dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{name, type_, classINET}},
+	})
+	type jsonAnswer struct {
+		Name string `json:"name"`
+		Type int    `json:"type"`
+		TTL  uint32 `json:"TTL"`
+		Data string `json:"data"`
+	}
+	answers := []jsonAnswer{}
+	for _, rr := range resp.Answer {
+		answers = append(answers, jsonAnswer{rr.Name, int(rr.Type), rr.TTL, rdataString(rr)})
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	writeJSON(w, map[string]interface{}{
+		"Status": resp.rcode(),
+		"Question": []map[string]interface{}{
+			{"name": name, "type": type_}},
+		"Answer": answers,
+	})
+}
+
+// mockCertificate makes up a self-signed certificate for localhost.
+func mockCertificate() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "gdoh mockserver"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func mockServerCommand(args []string) error {
+	fs := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	address := fs.String("listen", "127.0.0.1:8443", "HTTPS address to listen on")
+	certFile := fs.String("cert", "", "TLS certificate (default: a self-signed one)")
+	keyFile := fs.String("key", "", "TLS key, for -cert")
+	caOut := fs.String("ca-out", "", "Write the self-signed certificate here, for -ca-file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"Usage: gdoh mockserver [-listen ADDR] [-cert FILE -key FILE | -ca-out FILE] FIXTURES")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		fs.Usage()
+		return errors.New("Bad arguments")
+	}
+	fx, err := loadFixtures(args[0])
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	if *certFile != "" {
+		// Reloaded when the files change, as -client-cert is.
+		kp := &keyPair{certFile: *certFile, keyFile: *keyFile}
+		if err := kp.load(); err != nil {
+			return err
+		}
+		config.GetCertificate = kp.getServer
+	} else {
+		cert, certPEM, err := mockCertificate()
+		if err != nil {
+			return err
+		}
+		if *caOut != "" {
+			if err := ioutil.WriteFile(*caOut, certPEM, 0644); err != nil {
+				return err
+			}
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	ln, err := tls.Listen("tcp", *address, config)
+	if err != nil {
+		return err
+	}
+	log.Printf("Mock DoH server with %d names on https://%s/dns-query",
+		len(fx), ln.Addr().String())
+	return http.Serve(ln, fx)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Moving networks: a laptop that wakes up on another Wi-Fi still has
+// connections open over the old one, bootstrap addresses that were the
+// best from there, and endpoints it gave up on (or didn't) there. So
+// every -network-watch, gdoh looks at the interfaces that are up,
+// their addresses, and (where there's a /proc/net/route) the default
+// routes; when any of it changes, it drops the idle connections,
+// resolves the endpoint hostnames again, and probes the endpoints, as
+// for the self-test. -network-flush forgets the cache, too, for when
+// the answers depend on where you ask from.
+
+var networkWatch = flag.Duration("network-watch", 5*time.Second,
+	"How often to look for network changes (interfaces, addresses, default routes); 0: don't")
+var networkFlush = flag.Bool("network-flush", false,
+	"Flush the cache when the network changes")
+
+func watchNetwork() {
+	if *networkWatch <= 0 {
+		return
+	}
+	last := networkState()
+	for range backgroundTick(*networkWatch) {
+		now := networkState()
+		if changes := networkChanges(last, now); len(changes) > 0 {
+			networkChanged(changes)
+		}
+		last = now
+	}
+}
+
+// networkChanged starts over, upstream, on the network we're on now.
+func networkChanged(changes []string) {
+	log.Printf("Network changed: %s", strings.Join(changes, ", "))
+	// Over the old network; the new one may not route them at all.
+	rootDohClient.Client.CloseIdleConnections()
+	dohClient.Client.CloseIdleConnections()
+	bootstrap.refreshAll()
+	if *networkFlush {
+		log.Printf("Network changed: %d cached answers forgotten", responseCache.flush(""))
+	}
+	if ok := probeEndpoints("re-probe"); ok == 0 {
+		log.Printf("re-probe: no endpoint works (yet)")
+	}
+}
+
+// networkState describes the network: a line per interface address,
+// and per default route.
+func networkState() map[string]bool {
+	state := map[string]bool{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("network error: %s", err.Error())
+		return state
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			state[iface.Name+" "+a.String()] = true
+		}
+	}
+	for _, route := range defaultRoutes() {
+		state[route] = true
+	}
+	return state
+}
+
+// networkChanges lists what's new in now, and what's gone since last.
+func networkChanges(last, now map[string]bool) []string {
+	changes := []string{}
+	for s := range now {
+		if !last[s] {
+			changes = append(changes, "+"+s)
+		}
+	}
+	for s := range last {
+		if !now[s] {
+			changes = append(changes, "-"+s)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// defaultRoutes reads the default routes from /proc, where there is
+// one: "default via GATEWAY dev INTERFACE".
+func defaultRoutes() []string {
+	routes := []string{}
+	// Destination and gateway in hex, the IPv4 ones little-endian.
+	readProc := func(path string, parse func([]string) (string, string, bool)) {
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if gw, dev, ok := parse(strings.Fields(s.Text())); ok {
+				routes = append(routes, "default via "+gw+" dev "+dev)
+			}
+		}
+	}
+	readProc("/proc/net/route", func(f []string) (string, string, bool) {
+		// Iface Destination Gateway ...
+		if len(f) < 3 || f[1] != "00000000" {
+			return "", "", false
+		}
+		b, err := hex.DecodeString(f[2])
+		if err != nil || len(b) != 4 {
+			return "", "", false
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]).String(), f[0], true
+	})
+	readProc("/proc/net/ipv6_route", func(f []string) (string, string, bool) {
+		// Destination PrefixLength Source SourceLength NextHop ...
+		// Iface, last.
+		if len(f) < 10 || f[1] != "00" || strings.Trim(f[0], "0") != "" {
+			return "", "", false
+		}
+		b, err := hex.DecodeString(f[4])
+		if err != nil || len(b) != net.IPv6len || f[9] == "lo" {
+			return "", "", false
+		}
+		return net.IP(b).String(), f[9], true
+	})
+	return routes
+}
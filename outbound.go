@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Which way out the upstream HTTPS goes, on a router with more than
+// one: from a source address (one per family), or through an
+// interface - the WAN, or the VPN tunnel:
+//
+//	-outbound-address 203.0.113.7 -outbound-address 2001:db8::7
+//	-outbound-interface wg0
+//
+// On Linux, -outbound-interface binds the sockets to the interface
+// (SO_BINDTODEVICE; that takes root, or CAP_NET_RAW before 5.7),
+// which policy routing can't argue with; elsewhere, the connections
+// go from the interface's address. The bootstrap resolver goes the
+// same way as the endpoints; -forward's plain DNS servers, being
+// local more often than not, the usual one.
+//
+// With an address, or the interface, of one family only, connecting
+// to the other fails, rather than leaking out the default route.
+
+var outboundAddresses = &stringsFlag{}
+var outboundInterface = flag.String("outbound-interface", "",
+	"Interface to connect to the endpoints through (off by default)")
+
+func init() {
+	outboundAddresses.check = func(v string) error {
+		if net.ParseIP(v) == nil {
+			return fmt.Errorf("-outbound-address %s: want an IP address", v)
+		}
+		return nil
+	}
+	flag.Var(outboundAddresses, "outbound-address",
+		"Source address to connect to the endpoints from, one per family (repeatable)")
+}
+
+// The -outbound-address for each family, if there is one.
+var outbound struct {
+	ipv4, ipv6 net.IP
+}
+
+func loadOutbound() error {
+	for _, v := range outboundAddresses.values {
+		ip := net.ParseIP(v)
+		family := &outbound.ipv6
+		if ip.To4() != nil {
+			family = &outbound.ipv4
+		}
+		if *family != nil {
+			return fmt.Errorf("-outbound-address %s: there's already %s", v, *family)
+		}
+		*family = ip
+	}
+	if *outboundInterface != "" {
+		if _, err := net.InterfaceByName(*outboundInterface); err != nil {
+			// The tunnel may well come up after us.
+			log.Printf("-outbound-interface %s: %s (yet?)", *outboundInterface, err.Error())
+		}
+	}
+	if outbound.ipv4 != nil || outbound.ipv6 != nil || *outboundInterface != "" {
+		// The bootstrap resolver's http.DefaultTransport knows
+		// nothing about any of this.
+		rootDohClient.Client = &http.Client{
+			Transport: cleanHeaders{&http.Transport{
+				DialContext:         dialContext,
+				TLSHandshakeTimeout: *tlsTimeout,
+				IdleConnTimeout:     *idleTimeout,
+				ForceAttemptHTTP2:   true,
+			}},
+		}
+	}
+	return nil
+}
+
+// bindOutbound makes d connect to host (an IP address) the configured
+// way out, if there is one.
+func bindOutbound(d *net.Dialer, host string) *net.Dialer {
+	ip := net.ParseIP(host)
+	if ip == nil || (outbound.ipv4 == nil && outbound.ipv6 == nil && *outboundInterface == "") {
+		return d
+	}
+	ipv4 := ip.To4() != nil
+	local, family := outbound.ipv6, "IPv6"
+	if ipv4 {
+		local, family = outbound.ipv4, "IPv4"
+	}
+	if local == nil && len(outboundAddresses.values) > 0 {
+		return failDial(d, fmt.Errorf("no -outbound-address for %s", family))
+	}
+	if local != nil {
+		d.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	if *outboundInterface != "" {
+		if err := bindInterface(d, *outboundInterface, ipv4); err != nil {
+			return failDial(d, fmt.Errorf("-outbound-interface %s: %v", *outboundInterface, err))
+		}
+	}
+	return d
+}
+
+// failDial makes d's dials fail with err, before they connect.
+func failDial(d *net.Dialer, err error) *net.Dialer {
+	d.Control = func(string, string, syscall.RawConn) error { return err }
+	return d
+}
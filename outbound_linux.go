@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindInterface binds d's sockets to the interface, so that whatever
+// the routes say, that's the way out.
+func bindInterface(d *net.Dialer, name string, ipv4 bool) error {
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), name)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	return nil
+}
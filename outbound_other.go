@@ -0,0 +1,54 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// bindInterface makes d connect from the interface's address; without
+// SO_BINDTODEVICE, that's what there is.
+func bindInterface(d *net.Dialer, name string, ipv4 bool) error {
+	ip, err := interfaceAddress(name, ipv4)
+	if err != nil {
+		return err
+	}
+	if d.LocalAddr == nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return nil
+}
+
+// interfaceAddress finds an address of name's, of the family wanted.
+func interfaceAddress(name string, ipv4 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	family := "IPv6"
+	if ipv4 {
+		family = "IPv4"
+	}
+	var linkLocal net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			// Only if there's nothing better.
+			linkLocal = ipnet.IP
+			continue
+		}
+		return ipnet.IP, nil
+	}
+	if linkLocal != nil && ipv4 {
+		return linkLocal, nil
+	}
+	return nil, fmt.Errorf("no %s address", family)
+}
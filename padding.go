@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Padding (RFC 7830, with the block size of RFC 8467): TLS hides what
+// we ask, but not how long the question is, and the length of
+// "example.com" is its own tell. So the queries to the endpoints are
+// padded out to a multiple of -padding-block bytes - the POST body, or
+// what goes in the GET URL - with an OPT record added for the purpose,
+// if the client's query had none. The DNS-JSON queries (the bootstrap)
+// get a random_padding parameter instead, to the same end.
+//
+// Padding is between us and the endpoint: the clients get the
+// responses without the endpoint's padding (or the OPT record, if
+// their query had none).
+
+var paddingBlock = flag.Int("padding-block", 128,
+	"Pad the queries to the endpoints to a multiple of this many bytes; 0: don't")
+
+const optPadding = 12
+
+func checkPadding() error {
+	if *paddingBlock < 0 || *paddingBlock > 1024 {
+		return fmt.Errorf("-padding-block %d: want 0 to 1024", *paddingBlock)
+	}
+	return nil
+}
+
+// pad returns query, padded to the block size.
+func pad(query []byte) []byte {
+	if *paddingBlock == 0 {
+		return query
+	}
+	q, err := parseMsg(query)
+	if err != nil {
+		return query
+	}
+	m := q.copy()
+	opt := m.opt()
+	if opt == nil {
+		m.Additional = append(m.Additional, dnsRR{
+			Name: ".", Type: typeOPT, Class: ednsPayload()})
+		opt = m.opt()
+	}
+	opts, err := parseOptions(opt.Data)
+	if err != nil {
+		return query
+	}
+	opt.Data = packOptions(withoutPadding(opts))
+	// The option itself takes 4 bytes, before the padding.
+	n := len(m.pack()) + 4
+	opts = append(withoutPadding(opts), ednsOption{optPadding,
+		make([]byte, (*paddingBlock-n%*paddingBlock)%*paddingBlock)})
+	opt.Data = packOptions(opts)
+	return m.pack()
+}
+
+// unpad returns resp without the padding, for the client who sent
+// query: and without EDNS, if query didn't have it.
+func unpad(resp, query []byte) []byte {
+	if *paddingBlock == 0 {
+		return resp
+	}
+	r, err := parseMsg(resp)
+	if err != nil || r.opt() == nil {
+		return resp
+	}
+	q, err := parseMsg(query)
+	if err != nil {
+		return resp
+	}
+	if q.opt() == nil {
+		additional := []dnsRR{}
+		for _, rr := range r.Additional {
+			if rr.Type != typeOPT {
+				additional = append(additional, rr)
+			}
+		}
+		r.Additional = additional
+	} else if opts, err := parseOptions(r.opt().Data); err == nil {
+		r.opt().Data = packOptions(withoutPadding(opts))
+	}
+	return r.pack()
+}
+
+func withoutPadding(opts []ednsOption) []ednsOption {
+	kept := []ednsOption{}
+	for _, o := range opts {
+		if o.Code != optPadding {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// padURL pads a DNS-JSON query URL to the block size, with a
+// random_padding parameter (which Google's endpoint documents, and
+// the others ignore).
+func padURL(u *url.URL) {
+	if *paddingBlock == 0 {
+		return
+	}
+	const param = "&random_padding="
+	n := len(u.String()) + len(param)
+	u.RawQuery += param + strings.Repeat("x", (*paddingBlock-n%*paddingBlock)%*paddingBlock)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Passive DNS: every name -> data mapping we've seen in an answer,
+// with when we first and last saw it, to tell what has ever resolved
+// to some address, long after the fact. Kept in -passive-dns (one
+// JSON object per line), and served at /api/passive. With
+// -passive-dns-max-age, mappings not seen for that long are forgotten.
+
+var passiveFile = flag.String("passive-dns", "",
+	"File to keep the passive DNS record in (off by default)")
+var passiveMaxAge = flag.Duration("passive-dns-max-age", 0,
+	"Forget passive DNS mappings not seen for this long (0: never)")
+
+const (
+	// How often to write the file.
+	passiveSave = time.Minute
+	// Cap on the number of mappings; the least recently seen tenth
+	// goes when we get there.
+	passiveMax = 200000
+)
+
+type passiveEntry struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Data      string    `json:"data"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+}
+
+type passiveDNS struct {
+	sync.Mutex
+	entries map[[3]string]*passiveEntry
+	dirty   bool
+}
+
+var passive = &passiveDNS{entries: map[[3]string]*passiveEntry{}}
+
+func (p *passiveDNS) enabled() bool {
+	return *passiveFile != ""
+}
+
+// add records the answers in a response.
+func (p *passiveDNS) add(r *dnsMsg) {
+	if !p.enabled() {
+		return
+	}
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	for _, rr := range r.Answer {
+		key := [3]string{normalizeName(rr.Name), typeName(rr.Type), rdataString(rr)}
+		e, ok := p.entries[key]
+		if !ok {
+			e = &passiveEntry{Name: key[0], Type: key[1], Data: key[2], FirstSeen: now}
+			p.entries[key] = e
+		}
+		e.LastSeen = now
+		e.Count++
+		p.dirty = true
+	}
+	if len(p.entries) > passiveMax {
+		p.prune()
+	}
+}
+
+// prune drops the least recently seen entries.
+func (p *passiveDNS) prune() {
+	entries := p.list(func(*passiveEntry) bool { return true })
+	for _, e := range entries[passiveMax*9/10:] {
+		delete(p.entries, [3]string{e.Name, e.Type, e.Data})
+	}
+}
+
+// expire drops the entries not seen for -passive-dns-max-age.
+func (p *passiveDNS) expire(now time.Time) {
+	if *passiveMaxAge <= 0 {
+		return
+	}
+	for key, e := range p.entries {
+		if now.Sub(e.LastSeen) >= *passiveMaxAge {
+			delete(p.entries, key)
+			p.dirty = true
+		}
+	}
+}
+
+// list returns the matching entries, most recently seen first.
+func (p *passiveDNS) list(match func(*passiveEntry) bool) []passiveEntry {
+	entries := []passiveEntry{}
+	for _, e := range p.entries {
+		if match(e) {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	return entries
+}
+
+// search looks entries up by name (and its subdomains), or by data;
+// either may be empty.
+func (p *passiveDNS) search(name, data string) []passiveEntry {
+	if ip := net.ParseIP(data); ip != nil {
+		data = ip.String()
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.list(func(e *passiveEntry) bool {
+		if data != "" && e.Data != data && e.Data != normalizeName(data) {
+			return false
+		}
+		if name == "" {
+			return true
+		}
+		for _, parent := range parentNames(e.Name) {
+			if parent == normalizeName(name) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (p *passiveDNS) load() error {
+	if !p.enabled() {
+		return nil
+	}
+	f, err := os.Open(*passiveFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &passiveEntry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			continue
+		}
+		p.entries[[3]string{e.Name, e.Type, e.Data}] = e
+	}
+	p.expire(time.Now())
+	return s.Err()
+}
+
+// save writes the file, if anything changed.
+func (p *passiveDNS) save() error {
+	p.Lock()
+	p.expire(time.Now())
+	if !p.dirty {
+		p.Unlock()
+		return nil
+	}
+	entries := p.list(func(*passiveEntry) bool { return true })
+	p.dirty = false
+	p.Unlock()
+	tmp := *passiveFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	writeJSONL(w, entries)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *passiveFile)
+}
+
+func (p *passiveDNS) run() {
+	if !p.enabled() {
+		return
+	}
+	for range backgroundTick(passiveSave) {
+		if err := p.save(); err != nil {
+			log.Printf("passive dns error: %s", err.Error())
+		}
+	}
+}
+
+func writeJSONL(w io.Writer, entries []passiveEntry) {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+}
+
+func writeCSV(w io.Writer, entries []passiveEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "type", "data", "first_seen", "last_seen", "count"})
+	for _, e := range entries {
+		cw.Write([]string{e.Name, e.Type, e.Data,
+			e.FirstSeen.UTC().Format(time.RFC3339),
+			e.LastSeen.UTC().Format(time.RFC3339),
+			strconv.Itoa(e.Count)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// adminPassive: GET /api/passive?name=NAME&data=DATA&format=json|jsonl|csv
+func adminPassive(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	entries := passive.search(r.FormValue("name"), r.FormValue("data"))
+	switch r.FormValue("format") {
+	case "", "json":
+		writeJSON(w, entries)
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		writeJSONL(w, entries)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeCSV(w, entries); err != nil {
+			log.Print("admin error:", err.Error())
+		}
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Low-power mode, for laptops on battery: every packet sent wakes the
+// radio up, and keeps it up for a while after, so -low-power sends as
+// few as it can while nobody's asking anything.
+//
+//   - idle upstream connections are closed after 10 seconds (unless
+//     -idle-timeout or -transport say otherwise), without TCP
+//     keep-alives (unless -keepalive does), nor HTTP/2 pings at all;
+//   - the background work (bootstrap refreshes, the resolver list,
+//     captive portal checks, StatsD, flushing the logs, and the rest)
+//     runs in batches, on the minute, rather than each on its own
+//     clock;
+//   - and with no queries since the last batch, the next one waits
+//     for a query.
+
+var lowPower = flag.Bool("low-power", false,
+	"Battery mode: close idle connections sooner, no keep-alives, and background work in batches, only while there are queries")
+
+const (
+	lowPowerIdleTimeout = 10 * time.Second
+	// The background work all wakes up together.
+	lowPowerBatch = time.Minute
+)
+
+// flagGiven tells whether the flag was set, on the command line or in
+// the -config file.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// loadPower applies -low-power to the timeouts that weren't given
+// outright. Before loadTransportOptions.
+func loadPower() {
+	if !*lowPower {
+		return
+	}
+	if !flagGiven("idle-timeout") {
+		*idleTimeout = lowPowerIdleTimeout
+	}
+}
+
+// tcpKeepAlive is the keep-alive interval for upstream connections
+// (negative: none).
+func tcpKeepAlive() time.Duration {
+	if *lowPower && !flagGiven("keepalive") {
+		return -1
+	}
+	return *keepAlive
+}
+
+// Whoever's waiting for the next query; see waitForQuery.
+var nextQuery = struct {
+	sync.Mutex
+	c chan struct{}
+}{}
+
+// queried wakes up whoever's waiting for a query (the background
+// work, or the decoys), if anyone. After counting the query in
+// stats.Queries.
+func queried() {
+	nextQuery.Lock()
+	defer nextQuery.Unlock()
+	if nextQuery.c != nil {
+		close(nextQuery.c)
+		nextQuery.c = nil
+	}
+}
+
+// waitForQuery returns once there's been a query since stats.Queries
+// was seen.
+func waitForQuery(seen int64) {
+	nextQuery.Lock()
+	if nextQuery.c == nil {
+		nextQuery.c = make(chan struct{})
+	}
+	c := nextQuery.c
+	nextQuery.Unlock()
+	// It may have come in before we got in line.
+	if atomic.LoadInt64(&stats.Queries) != seen {
+		return
+	}
+	<-c
+}
+
+// backgroundTick is time.Tick, for the background work: with
+// -low-power, the ticks fall on the batch boundaries, and wait for a
+// query when there's been none since the last.
+func backgroundTick(d time.Duration) <-chan time.Time {
+	if !*lowPower {
+		return time.Tick(d)
+	}
+	c := make(chan time.Time)
+	go func() {
+		seen := atomic.LoadInt64(&stats.Queries)
+		for {
+			next := time.Now().Add(d)
+			if r := next.Sub(next.Truncate(lowPowerBatch)); r > 0 {
+				next = next.Add(lowPowerBatch - r)
+			}
+			time.Sleep(time.Until(next))
+			if atomic.LoadInt64(&stats.Queries) == seen {
+				waitForQuery(seen)
+			}
+			seen = atomic.LoadInt64(&stats.Queries)
+			c <- time.Now()
+		}
+	}()
+	return c
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Filtering services with per-account endpoints, where the account
+// (and the device) is in the URL path. -endpoint takes them by name:
+//
+//	nextdns:PROFILE           https://dns.nextdns.io/PROFILE
+//	nextdns:PROFILE/DEVICE    https://dns.nextdns.io/PROFILE/DEVICE
+//	adguard:CLIENT-ID         https://d.adguard-dns.com/dns-query/CLIENT-ID
+//
+// -device-name fills in the device, for the ones that don't name it,
+// so that the service's logs and per-device settings know who's who;
+// for AdGuard, "adguard:" with -device-name uses it as the client ID.
+// Services that want to hear about the device from the headers
+// instead get -endpoint-header.
+
+var deviceName = flag.String("device-name", "",
+	"Device name, for nextdns: and adguard: endpoints that don't name one")
+
+var endpointHeaderFlags = &stringsFlag{}
+
+func init() {
+	endpointHeaderFlags.check = func(v string) error {
+		_, _, _, err := parseEndpointHeader(v)
+		return err
+	}
+	flag.Var(endpointHeaderFlags, "endpoint-header",
+		"Send an HTTP header to an endpoint: HOST=Name: value (repeatable)")
+}
+
+// AdGuard DNS client IDs: letters, digits and dashes.
+var (
+	adguardClientID = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+	notClientID     = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+)
+
+// expandProfile turns a service:account endpoint into its URL; ok is
+// false for anything else.
+func expandProfile(endpoint string) (expanded string, ok bool, err error) {
+	parts := strings.SplitN(endpoint, ":", 2)
+	if len(parts) != 2 || strings.HasPrefix(parts[1], "//") {
+		return "", false, nil
+	}
+	service, account := parts[0], parts[1]
+	switch service {
+	case "nextdns":
+		ids := strings.SplitN(account, "/", 2)
+		if ids[0] == "" {
+			return "", true, fmt.Errorf("%s: want nextdns:PROFILE[/DEVICE]", endpoint)
+		}
+		device := *deviceName
+		if len(ids) == 2 {
+			device = ids[1]
+		}
+		u := "https://dns.nextdns.io/" + url.PathEscape(ids[0])
+		if device != "" {
+			u += "/" + url.PathEscape(device)
+		}
+		return u, true, nil
+	case "adguard":
+		id := account
+		if id == "" {
+			// Whatever the device calls itself, within reason.
+			id = strings.Trim(notClientID.ReplaceAllString(*deviceName, "-"), "-")
+		}
+		if !adguardClientID.MatchString(id) {
+			return "", true, fmt.Errorf("%s: want adguard:CLIENT-ID (letters, digits and dashes), or -device-name", endpoint)
+		}
+		return "https://d.adguard-dns.com/dns-query/" + id, true, nil
+	}
+	return "", false, nil
+}
+
+// Extra headers, by endpoint host.
+var endpointHeaders = map[string]http.Header{}
+
+func parseEndpointHeader(v string) (host, name, value string, err error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) == 2 {
+		host = strings.ToLower(parts[0])
+		if header := strings.SplitN(parts[1], ":", 2); len(header) == 2 {
+			name, value = strings.TrimSpace(header[0]), strings.TrimSpace(header[1])
+		}
+	}
+	if host == "" || name == "" {
+		return "", "", "", fmt.Errorf("-endpoint-header %s: want HOST=Name: value", v)
+	}
+	return host, name, value, nil
+}
+
+func loadEndpointHeaders() error {
+	for _, v := range endpointHeaderFlags.values {
+		host, name, value, err := parseEndpointHeader(v)
+		if err != nil {
+			return err
+		}
+		if value, err = secret(value); err != nil {
+			return fmt.Errorf("-endpoint-header %s=%s: %v", host, name, err)
+		}
+		h, ok := endpointHeaders[host]
+		if !ok {
+			h = http.Header{}
+			endpointHeaders[host] = h
+		}
+		h.Add(name, value)
+	}
+	return nil
+}
+
+// addEndpointHeaders adds the -endpoint-header headers for req's
+// host, if any.
+func addEndpointHeaders(req *http.Request) {
+	for name, values := range endpointHeaders[strings.ToLower(req.URL.Hostname())] {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+}
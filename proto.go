@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The HTTP version, of every exchange with an endpoint: counted per
+// endpoint, in /api/endpoints and /metrics, and shown by "gdoh check".
+// An endpoint behind a new load balancer may quietly go from HTTP/2
+// down to HTTP/1.1 - one query per connection at a time, and a
+// handshake for every one that has to wait - so -transport
+// HOST=require-h2:on makes that an error instead: the query goes to
+// another endpoint, and this one is unhealthy, right away.
+// (require-h2 turns http2 on, too.)
+//
+// Go's HTTP client doesn't do HTTP/3, so neither does gdoh; asking
+// for require-h3 is an error at startup, rather than one for every
+// query.
+
+// ProtoError is returned when an endpoint answers over an older HTTP
+// version than required.
+type ProtoError struct {
+	Endpoint string
+	Proto    string // what it spoke
+	Want     int    // the major version required
+}
+
+func (e *ProtoError) Error() string {
+	return fmt.Sprintf("%s: answered over %s, HTTP/%d required", e.Endpoint, e.Proto, e.Want)
+}
+
+func downgraded(err error) bool {
+	var proto *ProtoError
+	return errors.As(err, &proto)
+}
+
+// requiredProto is the HTTP major version required of host; 0 for
+// any.
+func requiredProto(host string) int {
+	opts, ok := hostTransport[strings.ToLower(host)]
+	if !ok {
+		opts = defaultTransport
+	}
+	if opts.requireH2 {
+		return 2
+	}
+	return 0
+}
+
+// checkProto tells whether the response, over proto (major), from
+// endpoint on host will do.
+func checkProto(endpoint, host, proto string, major int) error {
+	if want := requiredProto(host); major < want {
+		return &ProtoError{endpoint, proto, want}
+	}
+	return nil
+}
+
+// spoke counts an exchange with endpoint, over proto (major).
+func (t *endpointTracker) spoke(endpoint, proto string, major int) {
+	t.Lock()
+	defer t.Unlock()
+	h := t.get(endpoint)
+	switch major {
+	case 1:
+		h.HTTP1++
+	case 2:
+		h.HTTP2++
+	case 3:
+		h.HTTP3++
+	}
+	h.Proto = proto
+}
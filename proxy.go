@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The HAProxy PROXY protocol, versions 1 (text) and 2 (binary), as
+// spoken by load balancers and sslh to tell us who the real client is.
+//
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+//
+// Per -listen-tcp listener, and only from the proxies: anyone who can
+// connect could otherwise claim to be anyone, and get their policy.
+//
+//	-listen-tcp :53 -listen-tcp lb=10.0.0.2:53
+//	-proxy-protocol lb=10.0.1.0/24,10.0.2.7
+//
+// A connection to lb from 10.0.1.0/24 or 10.0.2.7 has to start with
+// a header; one from elsewhere is taken to be the client itself, as
+// on :53. An unnamed listener goes by its address.
+
+var proxyProtocol = &stringsFlag{}
+
+func init() {
+	proxyProtocol.check = func(v string) error {
+		_, _, err := parseProxyProtocol(v)
+		return err
+	}
+	flag.Var(proxyProtocol, "proxy-protocol",
+		"Require a PROXY protocol (v1 or v2) header on a TCP listener, from the proxies' addresses: LISTENER=CIDR,... (repeatable)")
+}
+
+// The proxies, per -listen-tcp name (or address).
+var proxySources = map[string][]*net.IPNet{}
+
+func parseProxyProtocol(v string) (listener string, sources []*net.IPNet, err error) {
+	i := strings.LastIndex(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return "", nil, fmt.Errorf("want LISTENER=CIDR,...: %s", v)
+	}
+	for _, cidr := range strings.Split(v[i+1:], ",") {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", nil, err
+		}
+		sources = append(sources, ipnet)
+	}
+	return v[:i], sources, nil
+}
+
+func loadProxyProtocol() error {
+	listeners := map[string]bool{}
+	for _, v := range listenTCP.values {
+		if name, address := splitListen(v); name != "" {
+			listeners[name] = true
+		} else {
+			listeners[address] = true
+		}
+	}
+	for _, v := range proxyProtocol.values {
+		listener, sources, err := parseProxyProtocol(v)
+		if err != nil {
+			return err
+		}
+		if !listeners[listener] {
+			return fmt.Errorf("-proxy-protocol %s: no -listen-tcp %s", v, listener)
+		}
+		proxySources[listener] = append(proxySources[listener], sources...)
+	}
+	return nil
+}
+
+// fromProxy tells whether a connection from peer, to the -listen-tcp
+// value v, has a PROXY header to read.
+func fromProxy(v string, peer net.Addr) bool {
+	name, address := splitListen(v)
+	if name == "" {
+		name = address
+	}
+	sources := proxySources[name]
+	if len(sources) == 0 {
+		return false
+	}
+	tcp, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range sources {
+		if ipnet.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrProxyHeader signifies a missing or malformed PROXY header.
+var ErrProxyHeader = errors.New("Bad PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes a PROXY header from r, and returns the
+// source address it carries. The address is nil for "UNKNOWN" (v1)
+// or "LOCAL" (v2) connections, e.g. health checks from the proxy
+// itself; the caller should use the peer address then.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, ErrProxyHeader
+}
+
+// readProxyV1 parses e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 53\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The spec caps the line at 107 bytes; don't read forever if
+	// we're fed garbage.
+	line := []byte{}
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 {
+		// LOCAL
+		return nil, nil
+	}
+	// Address family in the high nibble, transport in the low; we
+	// can't do much with anything other than TCP over IPv4/IPv6.
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// "gdoh query NAME [TYPE]": a one-off lookup, through the same client
+// (and bootstrap) the server uses.
+
+// parseInterleaved parses flags mixed with positional arguments
+// ("query example.com -json AAAA"), which flag.FlagSet alone won't,
+// and returns the positional ones.
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+type queryRecord struct {
+	Name  string `json:"name"`
+	TTL   uint32 `json:"ttl"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	Data  string `json:"data"`
+}
+
+type queryEDNS struct {
+	Version int      `json:"version"`
+	UDPSize int      `json:"udp_size"`
+	Flags   []string `json:"flags"`
+}
+
+// queryResult is what "query -json" prints. Fields only ever get
+// added to it; scripts can count on the ones there.
+type queryResult struct {
+	Endpoint   string        `json:"endpoint"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	Rcode      string        `json:"rcode"`
+	TimeMS     float64       `json:"time_ms"`
+	Answer     []queryRecord `json:"answer"`
+	ID         uint16        `json:"id"`
+	Flags      []string      `json:"flags"`
+	Authority  []queryRecord `json:"authority"`
+	Additional []queryRecord `json:"additional"` // without the OPT
+	EDNS       *queryEDNS    `json:"edns"`       // null without EDNS
+	Size       int           `json:"size"`
+}
+
+// exitCode is an error that only sets the exit status: the command
+// has said all there is to say.
+type exitCode int
+
+func (e exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// queryCommand exits with 0 for NOERROR (answers or not), 1 for
+// NXDOMAIN, and 2 for anything else, including not getting an answer
+// at all - for scripts.
+func queryCommand(args []string) error {
+	rcode, err := runQuery(args)
+	switch {
+	case err != nil:
+		log.Print(err)
+		return exitCode(2)
+	case rcode == rcodeNXDomain:
+		return exitCode(1)
+	case rcode != rcodeSuccess:
+		return exitCode(2)
+	}
+	return nil
+}
+
+func runQuery(args []string) (int, error) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "",
+		"Query this endpoint (default: a random configured one)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	short := fs.Bool("short", false, "Print just the answer data, like dig +short")
+	dnssec := fs.Bool("dnssec", false, "Ask for DNSSEC records (set the DO bit)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"Usage: gdoh query [-endpoint URL] [-json|-short] [-dnssec] NAME [TYPE]")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return 0, err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fs.Usage()
+		return 0, errors.New("Bad arguments")
+	}
+	type_ := uint16(typeA)
+	if len(args) == 2 {
+		if type_, err = typeNumber(args[1]); err != nil {
+			return 0, err
+		}
+	}
+	name := normalizeName(args[0])
+	opt := dnsRR{Name: ".", Type: typeOPT, Class: ednsPayload()}
+	if *dnssec {
+		opt.TTL = ednsDO
+	}
+	q := &dnsMsg{
+		ID:         randomID(),
+		Flags:      flagRD,
+		Question:   []dnsQuestion{{name, type_, classINET}},
+		Additional: []dnsRR{opt},
+	}
+	when := time.Now()
+	resp, err := dohClient.RawQueryFull(context.Background(), *endpoint, q.pack())
+	if err != nil {
+		return 0, err
+	}
+	r, err := parseMsg(resp.Msg)
+	if err != nil {
+		return 0, err
+	}
+	rcode := extendedRcode(r)
+	result := newQueryResult(name, type_, resp, r)
+	switch {
+	case *asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return rcode, enc.Encode(result)
+	case *short:
+		for _, rr := range r.Answer {
+			fmt.Println(rdataString(rr))
+		}
+		return rcode, nil
+	}
+	printDig(result, r, when)
+	return rcode, nil
+}
+
+func newQueryResult(name string, type_ uint16, resp *RawResponse, r *dnsMsg) queryResult {
+	result := queryResult{
+		Endpoint:   resp.Endpoint,
+		Proto:      resp.Proto,
+		Status:     resp.Status,
+		Name:       name,
+		Type:       typeName(type_),
+		Rcode:      rcodeName(extendedRcode(r)),
+		TimeMS:     resp.Latency.Seconds() * 1000,
+		Answer:     queryRecords(r.Answer),
+		ID:         r.ID,
+		Flags:      headerFlags(r.Flags),
+		Authority:  queryRecords(r.Authority),
+		Additional: queryRecords(r.Additional),
+		Size:       len(resp.Msg),
+	}
+	if opt := r.opt(); opt != nil {
+		result.EDNS = &queryEDNS{
+			Version: int(opt.TTL >> 16 & 0xff),
+			UDPSize: int(opt.Class),
+			Flags:   []string{},
+		}
+		if opt.TTL&ednsDO != 0 {
+			result.EDNS.Flags = append(result.EDNS.Flags, "do")
+		}
+	}
+	return result
+}
+
+// printDig prints the result the way dig does, more or less: people
+// (and their muscle memory) know where to look.
+func printDig(result queryResult, r *dnsMsg, when time.Time) {
+	fmt.Printf("; <<>> gdoh %s <<>> %s %s\n", version, result.Name, result.Type)
+	fmt.Printf(";; ->>HEADER<<- opcode: QUERY, status: %s, id: %d\n", result.Rcode, result.ID)
+	fmt.Printf(";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(result.Flags, " "), len(r.Question), len(r.Answer),
+		len(r.Authority), len(r.Additional))
+	if e := result.EDNS; e != nil {
+		fmt.Printf("\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d, flags: %s; udp: %d\n",
+			e.Version, strings.Join(e.Flags, " "), e.UDPSize)
+	}
+	fmt.Printf("\n;; QUESTION SECTION:\n")
+	for _, q := range r.Question {
+		fmt.Printf(";%s\t\t%s\t%s\n", q.Name, className(q.Class), typeName(q.Type))
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []dnsRR
+	}{
+		{"ANSWER", r.Answer},
+		{"AUTHORITY", r.Authority},
+		{"ADDITIONAL", r.Additional},
+	} {
+		printed := false
+		for _, rr := range section.rrs {
+			if rr.Type == typeOPT {
+				continue
+			}
+			if !printed {
+				fmt.Printf("\n;; %s SECTION:\n", section.name)
+				printed = true
+			}
+			fmt.Println(rrString(rr))
+		}
+	}
+	fmt.Printf("\n;; Query time: %d msec\n", int(result.TimeMS))
+	fmt.Printf(";; SERVER: %s (%s %d)\n", result.Endpoint, result.Proto, result.Status)
+	fmt.Printf(";; WHEN: %s\n", when.Format(time.RFC1123Z))
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n", result.Size)
+}
+
+// queryRecords formats records for queryResult, minus the OPT.
+func queryRecords(rrs []dnsRR) []queryRecord {
+	records := []queryRecord{}
+	for _, rr := range rrs {
+		if rr.Type == typeOPT {
+			continue
+		}
+		records = append(records, queryRecord{
+			rr.Name, rr.TTL, className(rr.Class), typeName(rr.Type), rdataString(rr),
+		})
+	}
+	return records
+}
+
+// headerFlags names the header flags that are set, dig style.
+func headerFlags(flags uint16) []string {
+	names := []string{}
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{
+		{flagQR, "qr"}, {flagAA, "aa"}, {flagTC, "tc"}, {flagRD, "rd"},
+		{flagRA, "ra"}, {flagAD, "ad"}, {flagCD, "cd"},
+	} {
+		if flags&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The query log: every query (or, at high rates, a sample of them),
+// one JSON object per line, as in /api/recent. Errors and blocked
+// queries are always logged; they're the interesting ones.
+//
+// With -query-log-max-size, the file is rotated when it gets that big
+// (to FILE.20060102-150405); with -query-log-max-age, it's rotated at
+// least once a day, and rotated files older than that are deleted.
+// Nobody needs to know what the kids were looking up last year. With
+// -query-log-max-files, only that many rotated files are kept (the
+// newest), however old: a busy week shouldn't fill the disk.
+
+var queryLogFile = flag.String("query-log", "",
+	"File to log queries to, as JSON lines; - for standard error (off by default)")
+var queryLogSample = flag.Int("query-log-sample", 1,
+	"Log one in this many queries; errors and blocked queries are always logged")
+var queryLogMaxSize = flag.Int("query-log-max-size", 0,
+	"Rotate the query log when it gets this many megabytes big (0: never)")
+var queryLogMaxAge = flag.Duration("query-log-max-age", 0,
+	"Delete rotated query logs older than this (0: keep forever)")
+var queryLogMaxFiles = flag.Int("query-log-max-files", 0,
+	"Keep at most this many rotated query logs, the newest (0: no limit)")
+
+// How often to flush the log; it's buffered, to keep the writes few
+// and large.
+const queryLogFlush = time.Second
+
+// Suffix for rotated logs (a time.Format layout).
+const queryLogRotated = ".20060102-150405"
+
+type queryLogger struct {
+	sync.Mutex
+	w       *bufio.Writer
+	f       io.Closer
+	count   uint64
+	written int64     // bytes in the current file
+	opened  time.Time // when the current file was started
+}
+
+var queryLog = &queryLogger{}
+
+// checkQueryLog checks the -query-log flags; open opens the file.
+func checkQueryLog() error {
+	if *queryLogSample < 1 {
+		return errors.New("-query-log-sample must be at least 1")
+	}
+	if *queryLogMaxSize < 0 || *queryLogMaxAge < 0 || *queryLogMaxFiles < 0 {
+		return errors.New("-query-log-max-size, -query-log-max-age and -query-log-max-files can't be negative")
+	}
+	return nil
+}
+
+func (ql *queryLogger) open() error {
+	switch *queryLogFile {
+	case "":
+		return nil
+	case "-":
+		ql.w = bufio.NewWriter(os.Stderr)
+		return nil
+	}
+	if err := ql.openFile(); err != nil {
+		return err
+	}
+	ql.purge()
+	return nil
+}
+
+func (ql *queryLogger) openFile() error {
+	f, err := os.OpenFile(*queryLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ql.w, ql.f = bufio.NewWriter(f), f
+	ql.written, ql.opened = fi.Size(), time.Now()
+	return nil
+}
+
+// sampled tells whether to log e.
+func (ql *queryLogger) sampled(e queryEntry) bool {
+	if e.Outcome == outcomeError || e.Outcome == outcomeBlocked ||
+		e.Rcode == rcodeServFail {
+		return true
+	}
+	n := atomic.AddUint64(&ql.count, 1)
+	return n%uint64(*queryLogSample) == 0
+}
+
+func (ql *queryLogger) add(e queryEntry) {
+	if (ql.w == nil && !logShip.enabled()) || !ql.sampled(e) {
+		return
+	}
+	logShip.add(e)
+	if ql.w == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	ql.Lock()
+	defer ql.Unlock()
+	n, _ := ql.w.Write(append(b, '\n'))
+	ql.written += int64(n)
+}
+
+func (ql *queryLogger) flush() {
+	ql.Lock()
+	defer ql.Unlock()
+	if err := ql.w.Flush(); err != nil {
+		log.Printf("query log error: %s", err.Error())
+	}
+	if ql.rotateDue() {
+		if err := ql.rotate(); err != nil {
+			log.Printf("query log error: %s", err.Error())
+		}
+		ql.purge()
+	}
+}
+
+func (ql *queryLogger) rotateDue() bool {
+	if ql.f == nil {
+		return false
+	}
+	if *queryLogMaxSize > 0 && ql.written >= int64(*queryLogMaxSize)<<20 {
+		return true
+	}
+	if *queryLogMaxAge > 0 {
+		every := 24 * time.Hour
+		if *queryLogMaxAge < every {
+			every = *queryLogMaxAge
+		}
+		return time.Since(ql.opened) >= every
+	}
+	return false
+}
+
+// rotate moves the current file out of the way, and starts a new one.
+func (ql *queryLogger) rotate() error {
+	if err := ql.f.Close(); err != nil {
+		return err
+	}
+	rotated := *queryLogFile + time.Now().Format(queryLogRotated)
+	renameErr := os.Rename(*queryLogFile, rotated)
+	// Keep logging, to the old file if need be.
+	if err := ql.openFile(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// purge deletes rotated files older than -query-log-max-age, and past
+// the -query-log-max-files newest.
+func (ql *queryLogger) purge() {
+	if *queryLogMaxAge == 0 && *queryLogMaxFiles == 0 {
+		return
+	}
+	dir, base := filepath.Split(*queryLogFile)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("query log error: %s", err.Error())
+		return
+	}
+	// ReadDir sorts by name, and so by when they were rotated: the
+	// newest go last.
+	rotated := []os.FileInfo{}
+	for _, fi := range files {
+		suffix := strings.TrimPrefix(fi.Name(), base)
+		if suffix == fi.Name() || fi.IsDir() {
+			continue
+		}
+		// Only touch what we've rotated ourselves.
+		if _, err := time.Parse(queryLogRotated, suffix); err != nil {
+			continue
+		}
+		rotated = append(rotated, fi)
+	}
+	for i, fi := range rotated {
+		tooMany := *queryLogMaxFiles > 0 && len(rotated)-i > *queryLogMaxFiles
+		tooOld := *queryLogMaxAge > 0 && time.Since(fi.ModTime()) >= *queryLogMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			log.Printf("query log error: %s", err.Error())
+		}
+	}
+}
+
+func (ql *queryLogger) run() {
+	if ql.w == nil {
+		return
+	}
+	for range backgroundTick(queryLogFlush) {
+		ql.flush()
+	}
+}
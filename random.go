@@ -0,0 +1,76 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"flag"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Randomness, for picking endpoints and addresses, and the IDs of our
+// plain DNS queries: seeded from crypto/rand, so that no two
+// instances (or runs) pick the same; or from -seed, to make a run
+// repeatable while chasing a bug.
+
+var seed = flag.Int64("seed", 0,
+	"Seed for the random choices, to make them repeatable (0: random)")
+
+// lockedSource makes a rand.Source safe to share.
+type lockedSource struct {
+	sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.src.Seed(seed)
+}
+
+// random is the source of all our random choices; replace it (with a
+// seeded one) for deterministic runs.
+var random = newRandom(randomSeed())
+
+func newRandom(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+func loadSeed() {
+	if *seed != 0 {
+		random = newRandom(*seed)
+	}
+}
+
+// randomID is a query ID; one an off-path attacker has to guess.
+func randomID() uint16 {
+	if *seed != 0 {
+		return uint16(random.Uint32())
+	}
+	var b [2]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return uint16(random.Uint32())
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
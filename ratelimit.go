@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream rate limits: public resolvers don't like being hammered,
+// and they're the ones who decide what counts as that. One device on
+// the LAN stuck in a loop of lookups shouldn't get the whole network
+// rate-limited, or banned.
+//
+// -upstream-qps caps the queries sent upstream, altogether, and
+// -endpoint-qps to each endpoint. A query over the limit waits for its
+// turn, up to -upstream-wait, and fails with SERVFAIL past that
+// (counted as "shed" in the stats). Answers from the cache don't
+// count, so it's the misbehaving device that suffers most.
+
+var (
+	upstreamQPS = flag.Float64("upstream-qps", 0,
+		"Send at most this many queries per second upstream, altogether (0: no limit)")
+	endpointQPS = flag.Float64("endpoint-qps", 0,
+		"Send at most this many queries per second to each endpoint (0: no limit)")
+	upstreamWait = flag.Duration("upstream-wait", 500*time.Millisecond,
+		"Over an -upstream-qps or -endpoint-qps limit, let a query wait this long for its turn")
+)
+
+var errRateLimited = errors.New("Over the upstream rate limit")
+
+// tokenBucket lets through rate queries per second, with up to a
+// second's worth at once.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: maxFloat(rate, 1), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if burst := maxFloat(b.rate, 1); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// delay is how long until the next token; tokens go negative for the
+// queries already waiting in line.
+func (b *tokenBucket) delay() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	global    *tokenBucket
+	endpoints map[string]*tokenBucket
+}
+
+var upstreamLimit = &rateLimiter{endpoints: map[string]*tokenBucket{}}
+
+// wait blocks until a query can be sent to endpoint, or fails if that
+// would take too long.
+func (l *rateLimiter) wait(ctx context.Context, endpoint string) error {
+	if *upstreamQPS <= 0 && *endpointQPS <= 0 {
+		return nil
+	}
+	l.Lock()
+	now := time.Now()
+	buckets := []*tokenBucket{}
+	if *upstreamQPS > 0 {
+		if l.global == nil {
+			l.global = newTokenBucket(*upstreamQPS, now)
+		}
+		buckets = append(buckets, l.global)
+	}
+	if *endpointQPS > 0 {
+		b, ok := l.endpoints[endpoint]
+		if !ok {
+			b = newTokenBucket(*endpointQPS, now)
+			l.endpoints[endpoint] = b
+		}
+		buckets = append(buckets, b)
+	}
+	var delay time.Duration
+	for _, b := range buckets {
+		b.refill(now)
+		if d := b.delay(); d > delay {
+			delay = d
+		}
+	}
+	if delay > *upstreamWait {
+		l.Unlock()
+		atomic.AddInt64(&stats.Shed, 1)
+		tracef(ctx, "over the rate limit, would wait %s", delay.Round(time.Millisecond))
+		return errRateLimited
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	l.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	tracef(ctx, "rate limited, waiting %s", delay.Round(time.Millisecond))
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The last few queries, for the dashboard.
+
+const recentSize = 1000
+
+type queryEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Device   string    `json:"device,omitempty"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Outcome  string    `json:"outcome"`
+	Rcode    int       `json:"rcode"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// Outcomes.
+const (
+	outcomeBlocked   = "blocked"
+	outcomeCached    = "cached"
+	outcomeForwarded = "forwarded"
+	outcomeError     = "error"
+	outcomeLocal     = "local"
+	outcomeBypassed  = "bypassed"
+)
+
+// recentQueries is a ring buffer of queryEntry.
+type recentQueries struct {
+	sync.Mutex
+	entries []queryEntry
+	next    int
+}
+
+var recent = &recentQueries{}
+
+func (r *recentQueries) add(e queryEntry) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.entries) < recentSize {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % recentSize
+}
+
+// list returns up to n entries, newest first.
+func (r *recentQueries) list(n int) []queryEntry {
+	r.Lock()
+	defer r.Unlock()
+	entries := []queryEntry{}
+	for i := len(r.entries) - 1; i >= 0 && len(entries) < n; i-- {
+		entries = append(entries,
+			r.entries[(r.next+i)%len(r.entries)])
+	}
+	return entries
+}
+
+// clientHost strips the port from a queryEntry's client address.
+func clientHost(client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
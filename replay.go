@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// "gdoh replay FILE": run a sample of real queries through the whole
+// pipeline (blocklists, rewrites, routes, the cache, upstream), and
+// see what comes out - before the new config goes live.
+//
+// The file is either a pcap capture (queries to port 53, over UDP; as
+// written by "tcpdump -w"), or text, a question per line:
+//
+//	example.com
+//	example.com AAAA
+//	;example.com.		IN	MX
+//
+// The last one is how dig prints the question; lines with more to them
+// (dig's answers, for one) are skipped, and so are ";;" comments.
+// Queries from a capture keep their client address, and the rest of
+// the query, EDNS and all; text ones come from -client.
+
+type replayQuery struct {
+	query  []byte
+	client net.Addr
+}
+
+type replayResult struct {
+	n        int
+	name     string
+	type_    string
+	client   net.Addr
+	outcome  string
+	rcode    string
+	answers  int
+	duration time.Duration
+}
+
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	rate := fs.Float64("rate", 10,
+		"Queries per second (0: one at a time, as fast as they're answered)")
+	client := fs.String("client", "127.0.0.1",
+		"Client address for the queries from a text file")
+	quiet := fs.Bool("q", false, "Just print the summary")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"Usage: gdoh replay [-rate N] [-client ADDR] [-q] FILE")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 || *rate < 0 {
+		fs.Usage()
+		return errors.New("Bad arguments")
+	}
+	ip := net.ParseIP(*client)
+	if ip == nil {
+		return fmt.Errorf("-client %s: bad address", *client)
+	}
+	queries, err := readReplay(args[0], &net.UDPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("%s: no queries in there", args[0])
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := []replayResult{}
+	done := func(r replayResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, r)
+		if !*quiet {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%d answers\t%s\n",
+				r.n, clientHost(r.client.String()), r.name, r.type_,
+				r.outcome, r.rcode, r.answers, ms(r.duration))
+		}
+	}
+	start := time.Now()
+	for n, rq := range queries {
+		if *rate == 0 {
+			done(replayOne(n+1, rq))
+			continue
+		}
+		// Keep to the schedule, even if the answers are slow.
+		time.Sleep(time.Until(start.Add(time.Duration(float64(n) / *rate * float64(time.Second)))))
+		wg.Add(1)
+		go func(n int, rq replayQuery) {
+			defer wg.Done()
+			done(replayOne(n, rq))
+		}(n+1, rq)
+	}
+	wg.Wait()
+	printReplaySummary(results, time.Since(start))
+	return nil
+}
+
+// replayOne answers a query, the same way the server would, minus the
+// query log and the alerts: this isn't real traffic (anymore).
+func replayOne(n int, rq replayQuery) replayResult {
+	r := replayResult{n: n, client: rq.client, outcome: outcomeError, rcode: "-"}
+	q, err := parseMsg(rq.query)
+	if err != nil || len(q.Question) != 1 {
+		r.name = "(unparseable)"
+		return r
+	}
+	r.name = q.Question[0].Name
+	r.type_ = typeName(q.Question[0].Type)
+	ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
+	defer cancel()
+	start := time.Now()
+	resp, outcome := resolve(ctx, q, rq.query, rq.client)
+	r.duration = time.Since(start)
+	r.outcome = outcome
+	if m, err := parseMsg(resp); err == nil {
+		r.rcode = rcodeName(m.rcode())
+		r.answers = len(m.Answer)
+	}
+	return r
+}
+
+func printReplaySummary(results []replayResult, elapsed time.Duration) {
+	outcomes := map[string]int{}
+	rcodes := map[string]int{}
+	times := []time.Duration{}
+	for _, r := range results {
+		outcomes[r.outcome]++
+		rcodes[r.rcode]++
+		times = append(times, r.duration)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	r := benchResult{Times: times}
+	fmt.Printf(";; %d queries in %s; p50 %s, p95 %s\n", len(results),
+		elapsed.Round(time.Millisecond), ms(r.quantile(0.5)), ms(r.quantile(0.95)))
+	fmt.Printf(";; %s\n", countsString(outcomes))
+	fmt.Printf(";; %s\n", countsString(rcodes))
+}
+
+// countsString prints counts, the most common first.
+func countsString(counts map[string]int) string {
+	keys := []string{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readReplay reads the queries from a file, whichever kind it is.
+func readReplay(path string, client net.Addr) ([]replayQuery, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 4 {
+		switch binary.BigEndian.Uint32(b) {
+		case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+			queries, err := readPcap(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			return queries, nil
+		case 0x0a0d0d0a:
+			return nil, fmt.Errorf("%s: pcapng isn't supported; "+
+				"convert it with \"editcap -F pcap\"", path)
+		}
+	}
+	queries := []replayQuery{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, ";;") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, ";"))
+		if len(fields) == 3 && strings.EqualFold(fields[1], "IN") {
+			fields = []string{fields[0], fields[2]}
+		}
+		if len(fields) > 2 {
+			continue
+		}
+		type_ := uint16(typeA)
+		if len(fields) == 2 {
+			if type_, err = typeNumber(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		q := &dnsMsg{
+			ID:         uint16(n),
+			Flags:      flagRD,
+			Question:   []dnsQuestion{{normalizeName(fields[0]), type_, classINET}},
+			Additional: []dnsRR{{Name: ".", Type: typeOPT, Class: ednsPayload()}},
+		}
+		queries = append(queries, replayQuery{q.pack(), client})
+	}
+	return queries, s.Err()
+}
+
+// Link types we can find IP packets in.
+const (
+	linkNull  = 0
+	linkEther = 1
+	linkRaw   = 101
+	linkSLL   = 113
+	linkSLL2  = 276
+)
+
+// readPcap picks the DNS queries out of a pcap capture: UDP, to port
+// 53, unfragmented, over IPv4 or IPv6 (without extension headers).
+// That's all it takes for the usual "tcpdump -w" capture.
+func readPcap(b []byte) ([]replayQuery, error) {
+	if len(b) < 24 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if b[0] == 0xd4 || b[0] == 0x4d {
+		order = binary.LittleEndian
+	}
+	link := order.Uint32(b[20:]) & 0xffff
+	switch link {
+	case linkNull, linkEther, linkRaw, linkSLL, linkSLL2:
+	default:
+		return nil, fmt.Errorf("link type %d isn't supported", link)
+	}
+	queries := []replayQuery{}
+	for off := 24; off < len(b); {
+		if len(b)-off < 16 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(order.Uint32(b[off+8:]))
+		off += 16
+		if len(b)-off < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		packet := b[off : off+n]
+		off += n
+		if rq, ok := pcapQuery(packet, link); ok {
+			queries = append(queries, rq)
+		}
+	}
+	return queries, nil
+}
+
+// pcapQuery picks the query out of a captured packet, if there's one.
+func pcapQuery(p []byte, link uint32) (replayQuery, bool) {
+	// Find the IP packet.
+	switch link {
+	case linkNull:
+		if len(p) < 4 {
+			return replayQuery{}, false
+		}
+		p = p[4:]
+	case linkEther:
+		if len(p) < 14 {
+			return replayQuery{}, false
+		}
+		etherType, p2 := binary.BigEndian.Uint16(p[12:]), p[14:]
+		for etherType == 0x8100 && len(p2) >= 4 { // 802.1Q
+			etherType, p2 = binary.BigEndian.Uint16(p2[2:]), p2[4:]
+		}
+		p = p2
+	case linkSLL:
+		if len(p) < 16 {
+			return replayQuery{}, false
+		}
+		p = p[16:]
+	case linkSLL2:
+		if len(p) < 20 {
+			return replayQuery{}, false
+		}
+		p = p[20:]
+	}
+	// Then the UDP datagram.
+	var src net.IP
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		ihl := int(p[0]&0xf) * 4
+		fragment := binary.BigEndian.Uint16(p[6:]) & 0x3fff
+		if p[9] != 17 || fragment != 0 || len(p) < ihl {
+			return replayQuery{}, false
+		}
+		src, p = net.IP(append([]byte(nil), p[12:16]...)), p[ihl:]
+	case len(p) >= 40 && p[0]>>4 == 6:
+		if p[6] != 17 {
+			return replayQuery{}, false
+		}
+		src, p = net.IP(append([]byte(nil), p[8:24]...)), p[40:]
+	default:
+		return replayQuery{}, false
+	}
+	if len(p) < 8 || binary.BigEndian.Uint16(p[2:]) != 53 {
+		return replayQuery{}, false
+	}
+	client := &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(p))}
+	query := append([]byte(nil), p[8:]...)
+	// Queries only, not the answers going the other way.
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return replayQuery{}, false
+	}
+	return replayQuery{query, client}, true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Endpoint reputation, across restarts: what gdoh has learned about
+// the endpoints - which one's been failing, and since when, which one
+// asked for a break, their latency histograms - goes in -reputation
+// every minute, and on the way out, and back into the health records
+// on startup. An endpoint that was broken a few minutes ago comes
+// back unhealthy: the self-test is its next try, and one more failure
+// keeps it out, rather than the three it takes from scratch, with
+// queries failing on it in the meantime. Nor does a break it asked
+// for start over. A file older than an hour is ignored: by then, most
+// of what it says is history.
+
+var reputationFile = flag.String("reputation", "",
+	"File to keep the endpoints' health and latency in, across restarts (off by default)")
+
+const (
+	reputationSave   = time.Minute
+	reputationMaxAge = time.Hour
+)
+
+type savedReputation struct {
+	Saved     time.Time       `json:"saved"`
+	Endpoints []savedEndpoint `json:"endpoints"`
+}
+
+type savedEndpoint struct {
+	Endpoint    string    `json:"endpoint"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	LastOKAt    time.Time `json:"last_ok_at"`
+	PausedUntil time.Time `json:"paused_until"`
+	RecentOK    float64   `json:"recent_ok"`
+	RecentErr   float64   `json:"recent_errors"`
+	Latency     []float64 `json:"latency"` // the histogram's counts
+}
+
+func loadReputation() error {
+	if *reputationFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(*reputationFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := savedReputation{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		// Not worth refusing to start over.
+		log.Printf("reputation error: %s: %s", *reputationFile, err.Error())
+		return nil
+	}
+	if time.Since(saved.Saved) > reputationMaxAge {
+		return nil
+	}
+	dohClient.health.restore(saved.Endpoints)
+	return nil
+}
+
+// restore puts the saved records back.
+func (t *endpointTracker) restore(saved []savedEndpoint) {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range saved {
+		h := t.get(s.Endpoint)
+		h.Failures = s.Failures
+		h.Healthy = h.Failures < maxFailures
+		h.LastError, h.LastErrorAt = s.LastError, s.LastErrorAt
+		h.LastOKAt, h.PausedUntil = s.LastOKAt, s.PausedUntil
+		h.recentOK, h.recentErr = s.RecentOK, s.RecentErr
+		if len(s.Latency) == len(h.latency.counts) {
+			h.latency.total = 0
+			for i, n := range s.Latency {
+				h.latency.counts[i] = n
+				h.latency.total += n
+			}
+		}
+	}
+}
+
+// saved is what goes in the file.
+func (t *endpointTracker) saved() []savedEndpoint {
+	t.Lock()
+	defer t.Unlock()
+	saved := []savedEndpoint{}
+	for _, h := range t.m {
+		saved = append(saved, savedEndpoint{
+			Endpoint:    h.Endpoint,
+			Failures:    h.Failures,
+			LastError:   h.LastError,
+			LastErrorAt: h.LastErrorAt,
+			LastOKAt:    h.LastOKAt,
+			PausedUntil: h.PausedUntil,
+			RecentOK:    h.recentOK,
+			RecentErr:   h.recentErr,
+			Latency:     append([]float64{}, h.latency.counts...),
+		})
+	}
+	return saved
+}
+
+func saveReputation() error {
+	if *reputationFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(savedReputation{time.Now(), dohClient.health.saved()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := *reputationFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *reputationFile)
+}
+
+func keepReputation() {
+	if *reputationFile == "" {
+		return
+	}
+	for range backgroundTick(reputationSave) {
+		if err := saveReputation(); err != nil {
+			log.Printf("reputation error: %s", err.Error())
+		}
+	}
+}
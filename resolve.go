@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// "gdoh resolve [-f FILE]": look up a list of names (a name per line,
+// from FILE or stdin), a bunch at a time, over the configured
+// endpoints, and print what they resolve to, as CSV or JSON lines. A
+// poor man's massdns, with gdoh's client.
+//
+// Results come out as they arrive, not in the order of the list. CSV
+// is a row per record (or a row with no data, for names without any):
+//
+//	name,type,rcode,ttl,rrtype,data,endpoint,time_ms,error
+//
+// JSON lines are "gdoh query -json" results, an object per name and
+// type, with an "error" when there's no result.
+
+type resolveResult struct {
+	queryResult
+	Error string `json:"error,omitempty"`
+}
+
+func resolveCommand(args []string) error {
+	fs := flag.NewFlagSet("resolve", flag.ExitOnError)
+	file := fs.String("f", "-", "Read the names from this file")
+	concurrency := fs.Int("c", 16, "Queries in flight at once")
+	qtypes := fs.String("type", "A", "Query types, comma separated")
+	format := &choiceFlag{value: "csv", choices: []string{"csv", "jsonl"}}
+	fs.Var(format, "format", "Output format: csv or jsonl")
+	endpoint := fs.String("endpoint", "",
+		"Query this endpoint (default: any of the configured ones)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"Usage: gdoh resolve [-f FILE] [-c N] [-type TYPE,...] [-format csv|jsonl] [-endpoint URL]")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 || *concurrency < 1 {
+		fs.Usage()
+		return errors.New("Bad arguments")
+	}
+	types := []uint16{}
+	for _, t := range strings.Split(*qtypes, ",") {
+		type_, err := typeNumber(strings.TrimSpace(t))
+		if err != nil {
+			return err
+		}
+		types = append(types, type_)
+	}
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	out := newResolveWriter(os.Stdout, format.value)
+	type job struct {
+		name  string
+		type_ uint16
+	}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				out.write(resolveName(*endpoint, j.name, j.type_))
+			}
+		}()
+	}
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		name := strings.TrimSpace(s.Text())
+		if name == "" || name[0] == '#' {
+			continue
+		}
+		for _, type_ := range types {
+			jobs <- job{normalizeName(name), type_}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := out.flush(); err != nil {
+		return err
+	}
+	return s.Err()
+}
+
+func resolveName(endpoint, name string, type_ uint16) resolveResult {
+	q := &dnsMsg{
+		ID:         randomID(),
+		Flags:      flagRD,
+		Question:   []dnsQuestion{{name, type_, classINET}},
+		Additional: []dnsRR{{Name: ".", Type: typeOPT, Class: ednsPayload()}},
+	}
+	resp, err := dohClient.RawQueryFull(context.Background(), endpoint, q.pack())
+	var r *dnsMsg
+	if err == nil {
+		r, err = parseMsg(resp.Msg)
+	}
+	if err != nil {
+		result := resolveResult{Error: err.Error()}
+		result.Endpoint, result.Proto, result.Status = resp.Endpoint, resp.Proto, resp.Status
+		result.Name, result.Type = name, typeName(type_)
+		result.TimeMS = resp.Latency.Seconds() * 1000
+		result.Answer, result.Authority, result.Additional =
+			[]queryRecord{}, []queryRecord{}, []queryRecord{}
+		result.Flags = []string{}
+		return result
+	}
+	return resolveResult{queryResult: newQueryResult(name, type_, resp, r)}
+}
+
+// resolveWriter writes results out as they come, from all the
+// workers.
+type resolveWriter struct {
+	sync.Mutex
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newResolveWriter(w io.Writer, format string) *resolveWriter {
+	if format == "jsonl" {
+		return &resolveWriter{json: json.NewEncoder(w)}
+	}
+	rw := &resolveWriter{csv: csv.NewWriter(w)}
+	rw.csv.Write([]string{"name", "type", "rcode", "ttl", "rrtype", "data",
+		"endpoint", "time_ms", "error"})
+	return rw
+}
+
+func (rw *resolveWriter) write(r resolveResult) {
+	rw.Lock()
+	defer rw.Unlock()
+	if rw.json != nil {
+		rw.json.Encode(r)
+		return
+	}
+	row := func(ttl, rrtype, data string) {
+		rw.csv.Write([]string{r.Name, r.Type, r.Rcode, ttl, rrtype, data,
+			r.Endpoint, strconv.FormatFloat(r.TimeMS, 'f', 1, 64), r.Error})
+	}
+	if len(r.Answer) == 0 {
+		row("", "", "")
+	}
+	for _, rr := range r.Answer {
+		row(strconv.Itoa(int(rr.TTL)), rr.Type, rr.Data)
+	}
+	// Don't sit on the results: someone may be piping them along.
+	rw.csv.Flush()
+}
+
+func (rw *resolveWriter) flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	return nil
+}
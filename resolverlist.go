@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resolver lists, in the format dnscrypt-proxy uses
+// (https://github.com/DNSCrypt/dnscrypt-resolvers): a markdown file
+// with a "## name" section per resolver, each with one or more
+// sdns:// stamps, signed with minisign. We take the DoH resolvers
+// which meet -resolver-list-require, as the endpoints, and keep them
+// up to date.
+//
+// The stamps' certificate hashes aren't checked; use -pin for that.
+
+var resolverList = flag.String("resolver-list", "",
+	"URL of a signed resolver list to take the endpoints from")
+var resolverListKey = flag.String("resolver-list-key", "",
+	"Minisign public key the resolver list is signed with")
+var resolverListRequire = flag.String("resolver-list-require", "nolog",
+	"Only take resolvers with these properties: dnssec,nolog,nofilter")
+
+// How often to fetch the list again.
+const resolverListRefresh = 6 * time.Hour
+
+// Stamp properties (https://dnscrypt.info/stamps-specifications).
+const (
+	stampDNSSEC   = 1 << 0
+	stampNoLog    = 1 << 1
+	stampNoFilter = 1 << 2
+	stampDoH      = 0x02
+)
+
+var stampProps = map[string]uint64{
+	"dnssec":   stampDNSSEC,
+	"nolog":    stampNoLog,
+	"nofilter": stampNoFilter,
+}
+
+type stamp struct {
+	Props    uint64
+	Addr     string
+	Endpoint string
+}
+
+// parseStamp decodes a DoH stamp; other protocols are an error.
+func parseStamp(s string) (stamp, error) {
+	st := stamp{}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return st, err
+	}
+	if len(b) < 9 || b[0] != stampDoH {
+		return st, errors.New("Not a DoH stamp")
+	}
+	st.Props = binary.LittleEndian.Uint64(b[1:])
+	b = b[9:]
+	// Length-prefixed strings; the hashes are a set of them, with
+	// the high bit of the length meaning "more to come".
+	next := func() (string, bool) {
+		if len(b) < 1 || len(b) < 1+int(b[0]&0x7f) {
+			return "", false
+		}
+		n := int(b[0] & 0x7f)
+		more := b[0]&0x80 != 0
+		s := string(b[1 : 1+n])
+		b = b[1+n:]
+		return s, more
+	}
+	st.Addr, _ = next()
+	for _, more := next(); more; _, more = next() {
+	}
+	host, _ := next()
+	path, _ := next()
+	if host == "" || !strings.HasPrefix(path, "/") {
+		return st, errors.New("Bad DoH stamp")
+	}
+	st.Endpoint = "https://" + host + path
+	return st, nil
+}
+
+// parseResolverList returns the stamps, by resolver name.
+func parseResolverList(data []byte) map[string][]stamp {
+	resolvers := map[string][]stamp{}
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "## "):
+			name = strings.TrimSpace(line[3:])
+		case strings.HasPrefix(line, "sdns://") && name != "":
+			st, err := parseStamp(line)
+			if err != nil {
+				continue
+			}
+			resolvers[name] = append(resolvers[name], st)
+		}
+	}
+	return resolvers
+}
+
+func requiredProps() (uint64, error) {
+	var props uint64
+	for _, p := range strings.Split(*resolverListRequire, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		prop, ok := stampProps[p]
+		if !ok {
+			return 0, fmt.Errorf("-resolver-list-require: unknown property %s", p)
+		}
+		props |= prop
+	}
+	return props, nil
+}
+
+// fetchResolverList fetches the list and its signature, and returns
+// the stamps that meet the requirements.
+func fetchResolverList() ([]stamp, error) {
+	key, err := parseMinisignKey(*resolverListKey)
+	if err != nil {
+		return nil, err
+	}
+	required, err := requiredProps()
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetch(*resolverList)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetch(*resolverList + ".minisig")
+	if err != nil {
+		return nil, err
+	}
+	if err := key.verify(data, sig); err != nil {
+		return nil, fmt.Errorf("%s: %v", *resolverList, err)
+	}
+	stamps := []stamp{}
+	for _, resolver := range parseResolverList(data) {
+		for _, st := range resolver {
+			if st.Props&required == required {
+				stamps = append(stamps, st)
+			}
+		}
+	}
+	if len(stamps) == 0 {
+		return nil, errors.New("No resolvers on the list meet -resolver-list-require")
+	}
+	return stamps, nil
+}
+
+// fetch GETs a URL, through the upstreams.
+func fetch(u string) ([]byte, error) {
+	r, err := dohClient.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return nil, &StatusError{Endpoint: u, StatusCode: r.StatusCode}
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// useResolverList makes the stamps the endpoints.
+func useResolverList(stamps []stamp) {
+	endpoints := []string{}
+	for _, st := range stamps {
+		u, err := url.Parse(st.Endpoint)
+		if err != nil {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(st.Addr); err == nil {
+			st.Addr = host
+		}
+		if ip := net.ParseIP(strings.Trim(st.Addr, "[]")); ip != nil &&
+			net.ParseIP(u.Hostname()) == nil {
+			bootstrap.pin(u.Hostname(), []string{ip.String()})
+		}
+		endpoints = append(endpoints, st.Endpoint)
+	}
+	// Before they're used: -ech and -dane require want them.
+	echFor(endpoints)
+	daneFor(endpoints)
+	dohClient.setEndpoints(endpoints)
+}
+
+// checkResolverList checks what can be checked before the list is
+// fetched.
+func checkResolverList() error {
+	if *resolverList == "" {
+		return nil
+	}
+	if _, err := parseMinisignKey(*resolverListKey); err != nil {
+		return fmt.Errorf("-resolver-list-key: %v", err)
+	}
+	_, err := requiredProps()
+	return err
+}
+
+// loadResolverList replaces the endpoints with the list, if there is
+// one, and we can get it; otherwise we keep -endpoint.
+func loadResolverList() error {
+	if *resolverList == "" {
+		return nil
+	}
+	stamps, err := fetchResolverList()
+	if err != nil {
+		log.Printf("resolver list error: %s", err.Error())
+		return nil
+	}
+	useResolverList(stamps)
+	log.Printf("Using %d resolvers from %s", len(stamps), *resolverList)
+	return nil
+}
+
+// refreshResolverList fetches the list again, every now and then.
+func refreshResolverList() {
+	if *resolverList == "" {
+		return
+	}
+	for range backgroundTick(resolverListRefresh) {
+		stamps, err := fetchResolverList()
+		if err != nil {
+			log.Printf("resolver list error: %s", err.Error())
+			continue
+		}
+		useResolverList(stamps)
+	}
+}
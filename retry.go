@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var retryRatio = flag.Float64("retry-budget", 0.2,
+	"Retries allowed, as a fraction of queries (0 disables retries)")
+
+// How many retries can be saved up.
+const retryBurst = 10
+
+type retryBudget struct {
+	sync.Mutex
+	tokens float64
+}
+
+var retries = &retryBudget{tokens: retryBurst}
+
+// earn is called for every query.
+func (b *retryBudget) earn() {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += *retryRatio
+	if b.tokens > retryBurst {
+		b.tokens = retryBurst
+	}
+}
+
+// spend tells whether there's a retry left, and takes it.
+func (b *retryBudget) spend() bool {
+	b.Lock()
+	defer b.Unlock()
+	if *retryRatio <= 0 || b.tokens < 1 {
+		atomic.AddInt64(&stats.RetriesDenied, 1)
+		return false
+	}
+	b.tokens--
+	atomic.AddInt64(&stats.Retries, 1)
+	return true
+}
+
+// A kept-alive connection can go away while it sits idle: the
+// endpoint restarts, or a middlebox forgets about it. We find out
+// when we write the next query to it; DoH queries are safe to repeat,
+// so we do, once, over a new connection.
+//
+// Unless it's all the connections going away (say, the network's
+// down), and every query would be sent twice: retries are on a budget,
+// of -retry-budget (a fifth) of the queries. Each query earns that
+// much of a retry, up to a few saved up, and each retry spends one;
+// when there's none left, the query fails instead. Sporadic retries
+// always fit; a storm of them doesn't.
+
+// send sends a wire format query (see -method), and tells whether it
+// went over a reused connection.
+func (c *DoHClient) send(ctx context.Context, endpoint string, query []byte) (r *http.Response, reused bool, err error) {
+	var req *http.Request
+	if wireMethod.value == "GET" {
+		req, err = getRequest(ctx, endpoint, query)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(query))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	addEndpointHeaders(req)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, httpTrace(ctx, &reused)))
+	r, err = c.Client.Do(req)
+	return r, reused, err
+}
+
+// staleConnection tells if err looks like the connection was dead
+// before we got to use it.
+func staleConnection(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed) ||
+		strings.Contains(err.Error(), "GOAWAY")
+}
+
+// closeIdle drops the idle connections to endpoint's host.
+func (c *DoHClient) closeIdle(endpoint string) {
+	if et, ok := c.Client.Transport.(*endpointTransports); ok {
+		if u, err := url.Parse(endpoint); err == nil {
+			et.forHost(u.Hostname()).CloseIdleConnections()
+			return
+		}
+	}
+	c.Client.CloseIdleConnections()
+}
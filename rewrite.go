@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// Rewrite rules, applied to upstream responses before they're cached
+// and relayed:
+//
+//	nxdomain:example.com=192.0.2.10   NXDOMAIN under example.com ->
+//	                                  this address (a landing page)
+//	ip:203.0.113.5=10.0.0.5           replace one address with another
+//	                                  (a split-horizon hack)
+//	cname:cdn.example.net=example.org CNAME targets under
+//	                                  cdn.example.net get moved under
+//	                                  example.org, and re-resolved
+
+var rewriteFlags = &stringsFlag{}
+
+func init() {
+	rewriteFlags.check = func(v string) error {
+		return newRewriteRules().load([]string{v})
+	}
+	flag.Var(rewriteFlags, "rewrite",
+		"Rewrite rule: nxdomain:DOMAIN=IP, ip:IP=IP, or cname:DOMAIN=DOMAIN (repeatable)")
+}
+
+// TTL for the records we make up.
+const rewriteTTL = 60
+
+type rewriteRules struct {
+	nxdomain map[string]net.IP // domain -> landing address
+	ips      map[string]net.IP // address (as string) -> address
+	cnames   map[string]string // domain -> domain
+}
+
+var rewrites = newRewriteRules()
+
+func newRewriteRules() *rewriteRules {
+	return &rewriteRules{
+		nxdomain: map[string]net.IP{},
+		ips:      map[string]net.IP{},
+		cnames:   map[string]string{},
+	}
+}
+
+func (rw *rewriteRules) load(rules []string) error {
+	for _, rule := range rules {
+		kind, from, to, err := parseRewrite(rule)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case "nxdomain":
+			ip := net.ParseIP(to)
+			if ip == nil {
+				return fmt.Errorf("-rewrite %s: bad address", rule)
+			}
+			rw.nxdomain[normalizeName(from)] = ip
+		case "ip":
+			old, new := net.ParseIP(from), net.ParseIP(to)
+			if old == nil || new == nil ||
+				(old.To4() == nil) != (new.To4() == nil) {
+				return fmt.Errorf("-rewrite %s: want two addresses of the same family", rule)
+			}
+			rw.ips[old.String()] = new
+		case "cname":
+			rw.cnames[normalizeName(from)] = normalizeName(to)
+		default:
+			return fmt.Errorf("-rewrite %s: unknown kind %s", rule, kind)
+		}
+	}
+	return nil
+}
+
+func parseRewrite(rule string) (kind, from, to string, err error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) == 2 {
+		kind = parts[0]
+		parts = strings.SplitN(parts[1], "=", 2)
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("-rewrite %s: want kind:from=to", rule)
+	}
+	return kind, parts[0], parts[1], nil
+}
+
+// apply rewrites r in place.
+func (rw *rewriteRules) apply(ctx context.Context, r *dnsMsg) {
+	if len(r.Question) != 1 {
+		return
+	}
+	if r.rcode() == rcodeNXDomain && len(rw.nxdomain) > 0 {
+		rw.landing(r)
+	}
+	if len(rw.ips) > 0 {
+		for i := range r.Answer {
+			rr := &r.Answer[i]
+			if rr.Type != typeA && rr.Type != typeAAAA {
+				continue
+			}
+			if ip, ok := rw.ips[net.IP(rr.Data).String()]; ok {
+				rr.Data = addrData(ip, rr.Type)
+			}
+		}
+	}
+	if len(rw.cnames) > 0 {
+		rw.cname(ctx, r)
+	}
+}
+
+// landing turns NXDOMAIN under a listed domain into an answer with
+// the landing address, if the question asks for its family; for any
+// other type, the name exists now, with nothing of that type: NODATA,
+// with the SOA, for the negative caches.
+func (rw *rewriteRules) landing(r *dnsMsg) {
+	q := r.Question[0]
+	for _, parent := range parentNames(q.Name) {
+		ip, ok := rw.nxdomain[parent]
+		if !ok {
+			continue
+		}
+		type_ := uint16(typeAAAA)
+		if ip.To4() != nil {
+			type_ = typeA
+		}
+		r.setRcode(rcodeSuccess)
+		if q.Type != type_ {
+			// The NSECs and such proved the name's not there.
+			soa := []dnsRR{}
+			for _, rr := range r.Authority {
+				if rr.Type == typeSOA {
+					soa = append(soa, rr)
+				}
+			}
+			r.Answer, r.Authority = nil, soa
+			return
+		}
+		r.Answer = []dnsRR{{Name: q.Name, Type: type_,
+			Class: classINET, TTL: rewriteTTL, Data: addrData(ip, type_)}}
+		r.Authority = nil
+		return
+	}
+}
+
+// cname moves CNAME targets, and resolves the new target, replacing
+// whatever followed the old one.
+func (rw *rewriteRules) cname(ctx context.Context, r *dnsMsg) {
+	for i, rr := range r.Answer {
+		if rr.Type != typeCNAME {
+			continue
+		}
+		target, _, err := readName(rr.Data, 0)
+		if err != nil {
+			continue
+		}
+		moved, ok := rw.moveName(target)
+		if !ok {
+			continue
+		}
+		r.Answer[i].Data = appendName(nil, moved)
+		// Anything after this CNAME belongs to the old target.
+		r.Answer = r.Answer[:i+1]
+		q := r.Question[0]
+		if q.Type == typeCNAME {
+			return
+		}
+		chased, err := lookup(ctx, moved, q.Type, q.Class)
+		if err != nil {
+			log.Printf("rewrite error: %s: %s", moved, err.Error())
+			return
+		}
+		r.Answer = append(r.Answer, chased...)
+		return
+	}
+}
+
+// moveName applies the most specific cname rule to name.
+func (rw *rewriteRules) moveName(name string) (string, bool) {
+	name = normalizeName(name)
+	for _, parent := range parentNames(name) {
+		if to, ok := rw.cnames[parent]; ok {
+			prefix := strings.TrimSuffix(name, parent)
+			if to == "." {
+				return prefix, true
+			}
+			return prefix + to, true
+		}
+	}
+	return "", false
+}
+
+// lookup resolves a name via upstream, returning the answer section.
+func lookup(ctx context.Context, name string, type_, class uint16) ([]dnsRR, error) {
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{name, type_, class}},
+	}
+	resp, _, err := dohClient.rawQuery(ctx, dohClient.pickForName(name), q.pack())
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return nil, err
+	}
+	return r.Answer, nil
+}
+
+// addrData encodes ip as A or AAAA record data.
+func addrData(ip net.IP, type_ uint16) []byte {
+	if type_ == typeA {
+		return []byte(ip.To4())
+	}
+	return []byte(ip.To16())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Routing by query type:
+//
+//	-route PTR=dns:192.168.1.1                          plain DNS, to the router
+//	-route ANY=refuse                                   REFUSED, right away
+//	-route HTTPS=https://unfiltered.example/dns-query   another DoH endpoint
+//
+// and by domain (and its subdomains), which goes first:
+//
+//	-forward corp.example,10.in-addr.arpa=dns:10.0.0.1
+//
+// Types and domains without a route go to the endpoints, as usual.
+
+var routeFlags = &stringsFlag{}
+var forwardFlags = &stringsFlag{}
+
+func init() {
+	routeFlags.check = func(v string) error {
+		_, _, err := parseRoute(v)
+		return err
+	}
+	forwardFlags.check = func(v string) error {
+		return forwardRules{}.load([]string{v})
+	}
+	flag.Var(routeFlags, "route",
+		"Route queries by type: TYPE=ENDPOINT, TYPE=dns:ADDRESS, or TYPE=refuse (repeatable)")
+	flag.Var(forwardFlags, "forward",
+		"Route queries by domain: DOMAIN,...=ENDPOINT or DOMAIN,...=dns:ADDRESS (repeatable)")
+}
+
+type route struct {
+	refuse   bool
+	endpoint string // DoH
+	server   string // plain DNS
+}
+
+var routes = map[uint16]*route{}
+
+func parseRoute(v string) (uint16, *route, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("-route %s: want TYPE=DESTINATION", v)
+	}
+	type_, err := typeNumber(parts[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("-route %s: %v", v, err)
+	}
+	if parts[1] == "refuse" {
+		return type_, &route{refuse: true}, nil
+	}
+	rt, err := parseDestination(parts[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("-route %s: %v", v, err)
+	}
+	return type_, rt, nil
+}
+
+// parseDestination parses a DoH endpoint, or "dns:ADDRESS".
+func parseDestination(to string) (*route, error) {
+	if strings.HasPrefix(to, "dns:") {
+		server := to[4:]
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%s: want an address", to)
+		}
+		return &route{server: server}, nil
+	}
+	endpoint, addrs, err := normalizeEndpoint(to)
+	if err != nil {
+		return nil, err
+	}
+	if addrs != nil {
+		u, _ := url.Parse(endpoint)
+		bootstrap.pin(u.Hostname(), addrs)
+	}
+	return &route{endpoint: endpoint}, nil
+}
+
+func loadRoutes() error {
+	for _, v := range routeFlags.values {
+		type_, rt, err := parseRoute(v)
+		if err != nil {
+			return err
+		}
+		routes[type_] = rt
+	}
+	return forwards.load(forwardFlags.values)
+}
+
+type forwardRules map[string]*route // domain -> route
+
+var forwards = forwardRules{}
+
+func (fr forwardRules) load(values []string) error {
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("-forward %s: want DOMAIN,...=DESTINATION", v)
+		}
+		rt, err := parseDestination(parts[1])
+		if err != nil {
+			return fmt.Errorf("-forward %s: %v", v, err)
+		}
+		for _, domain := range strings.Split(parts[0], ",") {
+			if domain = strings.TrimSpace(domain); domain == "" {
+				return fmt.Errorf("-forward %s: empty domain", v)
+			}
+			fr[normalizeName(domain)] = rt
+		}
+	}
+	return nil
+}
+
+// match finds the route for the most specific domain name is in, if
+// any.
+func (fr forwardRules) match(name string) (string, *route) {
+	if len(fr) == 0 {
+		return "", nil
+	}
+	for _, parent := range parentNames(name) {
+		if rt, ok := fr[parent]; ok {
+			return parent, rt
+		}
+	}
+	return "", nil
+}
+
+// exchange sends the query along the route.
+func (rt *route) exchange(ctx context.Context, query []byte) ([]byte, int, error) {
+	if rt.server != "" {
+		resp, err := udpExchange(ctx, rt.server, query)
+		return resp, -1, err
+	}
+	return dohClient.rawQuery(ctx, rt.endpoint, query)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"strings"
+)
+
+// Search domains: "ssh nas" asks for "nas.", which only the router
+// knew about, as "nas.lan.", when it was the DHCP resolver. With
+// -search lan, single-label questions are tried with the suffix, as a
+// stub would with resolv.conf's search; the first name that exists
+// is the answer, via a CNAME from the name asked.
+//
+// The completions are resolved like any other query (blocklists,
+// cache, and all), or sent to -search-via.
+
+var searchFlags = &stringsFlag{}
+var searchVia = flag.String("search-via", "",
+	"Where to resolve search domain completions: ENDPOINT or dns:ADDRESS (default: like any other query)")
+
+func init() {
+	flag.Var(searchFlags, "search",
+		"Search domain, tried for single-label names, e.g. lan (repeatable)")
+}
+
+var (
+	searchDomains []string
+	searchRoute   *route
+)
+
+func loadSearch() error {
+	searchDomains = nil
+	for _, v := range searchFlags.values {
+		searchDomains = append(searchDomains, normalizeName(strings.TrimPrefix(v, ".")))
+	}
+	if *searchVia == "" {
+		return nil
+	}
+	rt, err := parseDestination(*searchVia)
+	if err != nil {
+		return err
+	}
+	searchRoute = rt
+	return nil
+}
+
+// singleLabel tells if name is just one label, like "nas.".
+func singleLabel(name string) bool {
+	name = normalizeName(name)
+	return name != "." && strings.Count(name, ".") == 1
+}
+
+// search tries the search domains on a single-label question.
+func search(ctx context.Context, q *dnsMsg, client net.Addr) (*dnsMsg, bool) {
+	question := q.Question[0]
+	if len(searchDomains) == 0 || !singleLabel(question.Name) {
+		return nil, false
+	}
+	for _, domain := range searchDomains {
+		name := normalizeName(question.Name) + domain
+		sq := &dnsMsg{
+			ID:       q.ID,
+			Flags:    flagRD,
+			Question: []dnsQuestion{{name, question.Type, question.Class}},
+		}
+		var resp []byte
+		if searchRoute != nil {
+			resp, _, _ = searchRoute.exchange(ctx, sq.pack())
+		} else {
+			resp, _ = resolve(ctx, sq, sq.pack(), client)
+		}
+		r, err := parseMsg(resp)
+		if err != nil || r.rcode() != rcodeSuccess || len(r.Answer) == 0 {
+			continue
+		}
+		ttl, _ := r.minTTL()
+		found := reply(q, rcodeSuccess)
+		found.Answer = append([]dnsRR{{Name: question.Name, Type: typeCNAME,
+			Class: question.Class, TTL: ttl, Data: appendName(nil, name)}},
+			r.Answer...)
+		return found, true
+	}
+	return nil, false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secrets, kept out of the config file: the values that are secrets
+// (-admin-token, -alert-webhook and -log-ship, which tend to have a
+// token in the URL, the value of an -endpoint-header, and the secret
+// of an -update-key) can be references, resolved at startup:
+//
+//	admin-token file:///run/secrets/gdoh-admin
+//	endpoint-header dns.example.net=Authorization: env://DOH_AUTH
+//	update-key dhcp:file:///run/secrets/tsig
+//
+// A file's trailing newline isn't part of the secret. The TLS keys
+// (-client-cert) are files already.
+
+const (
+	fileRef = "file://"
+	envRef  = "env://"
+)
+
+// secret resolves v, if it's a reference; anything else is the secret
+// itself.
+func secret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, fileRef):
+		b, err := ioutil.ReadFile(v[len(fileRef):])
+		if err != nil {
+			return "", err
+		}
+		s := strings.TrimRight(string(b), "\r\n")
+		if s == "" {
+			return "", fmt.Errorf("%s: empty", v[len(fileRef):])
+		}
+		return s, nil
+	case strings.HasPrefix(v, envRef):
+		s, ok := os.LookupEnv(v[len(envRef):])
+		if !ok || s == "" {
+			return "", fmt.Errorf("%s: not set", v[len(envRef):])
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+// secretRef is where the reference in v starts, or -1.
+func secretRef(v string) int {
+	for _, ref := range []string{fileRef, envRef} {
+		if i := strings.Index(v, ref); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadSecrets resolves the secret flags that are plain strings; the
+// others resolve their own, as they're parsed. First thing in setup,
+// for the commands that need one: "gdoh version" shouldn't fail over
+// an unset variable. The admin commands resolve the token in
+// adminCall.
+func loadSecrets() error {
+	for name, v := range map[string]*string{
+		"admin-token":   adminToken,
+		"alert-webhook": alertWebhook,
+		"log-ship":      logShipURL,
+	} {
+		s, err := secret(*v)
+		if err != nil {
+			return fmt.Errorf("-%s: %v", name, err)
+		}
+		*v = s
+	}
+	return nil
+}
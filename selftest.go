@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// On startup, resolve a well-known name through every endpoint, so
+// that a resolver which can't resolve anything doesn't go unnoticed.
+
+var selfTest = &choiceFlag{value: "warn", choices: []string{"off", "warn", "fail"}}
+var canary = flag.String("canary", "example.com",
+	"Name to resolve in the startup self-test")
+
+func init() {
+	flag.Var(selfTest, "self-test",
+		"Startup self-test: off, warn (log if no endpoint works), or fail (exit)")
+}
+
+// testEndpoint resolves the canary's A record via endpoint.
+func testEndpoint(endpoint string) error {
+	q := &dnsMsg{
+		Flags:    flagRD,
+		Question: []dnsQuestion{{normalizeName(*canary), typeA, classINET}},
+	}
+	resp, err := dohClient.RawQueryTo(endpoint, q.pack())
+	if err != nil {
+		return err
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return err
+	}
+	if r.rcode() != rcodeSuccess {
+		return fmt.Errorf("%s: %s", *canary, rcodeName(r.rcode()))
+	}
+	if len(r.Answer) == 0 {
+		return fmt.Errorf("%s: no answers", *canary)
+	}
+	return nil
+}
+
+// runSelfTest tests all endpoints at once, logging the results.
+func runSelfTest() {
+	if selfTest.value == "off" {
+		return
+	}
+	if probeEndpoints("self-test") > 0 {
+		return
+	}
+	err := errors.New("self-test: no endpoint works")
+	if selfTest.value == "fail" {
+		log.Fatal(err)
+	}
+	log.Print(err.Error())
+}
+
+// probeEndpoints tests all endpoints at once (which also tells the
+// health tracker how they're doing), logging the results under what,
+// and returns how many work.
+func probeEndpoints(what string) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := 0
+	for _, endpoint := range dohClient.endpoints() {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			start := time.Now()
+			if err := testEndpoint(endpoint); err != nil {
+				log.Printf("%s: %s: %s", what, endpoint, err.Error())
+				return
+			}
+			log.Printf("%s: %s: ok (%s)", what, endpoint,
+				time.Since(start).Round(time.Millisecond))
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+	return ok
+}
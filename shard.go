@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"os"
+	"strings"
+)
+
+// Sharding the endpoints by site: with -select shard, every registered
+// domain (example.co.uk, for www.example.co.uk) sticks to one of the
+// endpoints, so that none of them sees all of the browsing, and each
+// gets the same sites over and over, for a warm cache. The
+// assignment is rendezvous hashing: with an endpoint down, only its
+// domains move elsewhere, and they come back when it does.
+//
+// What's a registered domain is up to the Public Suffix List; without
+// -public-suffixes (public_suffix_list.dat, from publicsuffix.org),
+// it's a guess, from the suffixes everyone's heard of.
+
+var selectMode = &choiceFlag{value: "random", choices: []string{"random", "shard", "failover"}}
+var publicSuffixes = flag.String("public-suffixes", "",
+	"Public Suffix List file, for -select shard (default: a built-in sample)")
+
+func init() {
+	flag.Var(selectMode, "select",
+		"How to pick an endpoint for a query: random, shard (by registered domain), or failover (the first healthy one)")
+}
+
+// The usual suspects, for want of the list.
+var builtinSuffixes = []string{
+	"ac.uk", "co.uk", "gov.uk", "ltd.uk", "me.uk", "net.uk", "org.uk", "plc.uk",
+	"com.au", "edu.au", "gov.au", "net.au", "org.au",
+	"co.nz", "net.nz", "org.nz",
+	"ac.jp", "co.jp", "go.jp", "ne.jp", "or.jp",
+	"co.kr", "or.kr",
+	"com.br", "net.br", "org.br",
+	"com.cn", "gov.cn", "net.cn", "org.cn",
+	"com.hk", "com.sg", "com.tw", "com.my",
+	"co.in", "net.in", "org.in",
+	"co.id", "co.il", "co.za", "com.ar", "com.mx", "com.pl", "com.tr", "com.ua",
+	"appspot.com", "blogspot.com", "cloudfront.net", "github.io",
+	"herokuapp.com", "netlify.app", "pages.dev", "vercel.app", "workers.dev",
+}
+
+type suffixList struct {
+	rules, wildcards, exceptions map[string]bool
+}
+
+var suffixes = newSuffixList(builtinSuffixes)
+
+func newSuffixList(rules []string) *suffixList {
+	sl := &suffixList{rules: map[string]bool{}, wildcards: map[string]bool{},
+		exceptions: map[string]bool{}}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSuffix(rule, "."))
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			sl.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			sl.wildcards[rule[2:]] = true
+		default:
+			sl.rules[rule] = true
+		}
+	}
+	return sl
+}
+
+func loadSuffixes() error {
+	if *publicSuffixes == "" {
+		return nil
+	}
+	f, err := os.Open(*publicSuffixes)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// A rule is the line up to the first whitespace.
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rules = append(rules, fields[0])
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	suffixes = newSuffixList(rules)
+	return nil
+}
+
+// registered finds the registered domain name is in: the public
+// suffix, and one more label.
+func (sl *suffixList) registered(name string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	if len(labels) < 2 {
+		return strings.Join(labels, ".")
+	}
+	// From the longest candidate down; the first rule that matches is
+	// the longest one.
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		switch {
+		case sl.exceptions[suffix]:
+			// The rule is one label shorter than it is.
+			return suffix
+		case sl.rules[suffix],
+			i+1 < len(labels) && sl.wildcards[strings.Join(labels[i+1:], ".")]:
+			if i == 0 {
+				return suffix
+			}
+			return strings.Join(labels[i-1:], ".")
+		}
+	}
+	// The default rule: the last label's a suffix.
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// shard picks the endpoint for the registered domain of name, out of
+// endpoints: the one scoring highest, for that domain.
+func shard(endpoints []string, name string) string {
+	domain := suffixes.registered(name)
+	best, bestScore := "", uint64(0)
+	for _, endpoint := range endpoints {
+		sum := sha256.Sum256([]byte(domain + "\x00" + endpoint))
+		if score := binary.BigEndian.Uint64(sum[:]); best == "" || score > bestScore {
+			best, bestScore = endpoint, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals dumps stats to the log on SIGUSR1, hands over to a
+// new copy on SIGUSR2, and drains on SIGTERM and SIGINT (see
+// handoff.go).
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range c {
+			switch sig {
+			case syscall.SIGUSR1:
+				dumpStats()
+			case syscall.SIGUSR2:
+				upgrade()
+			default:
+				stopServing()
+			}
+		}
+	}()
+}
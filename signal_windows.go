@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// No SIGUSR1 on Windows, nor handing over sockets; use the admin API,
+// and ^C still drains (see handoff.go).
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		for range c {
+			stopServing()
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Warm standby: when an endpoint fails, the queries go elsewhere - to
+// an endpoint that may not have been asked anything in a while, and
+// has its hostname to look up, and a TLS handshake to go through, at
+// the worst possible moment, with every client retrying at once. So,
+// while there are queries, gdoh keeps -standby endpoints warm on top
+// of the one(s) answering them, asking them about the -canary (as the
+// self-test does) before their idle connections time out. They go in
+// -endpoint order, among the healthy ones.
+//
+// Mostly for -select failover, where the first healthy endpoint gets
+// all the queries, and the second none; with random selection, the
+// standbys only need the odd query when the traffic's thin. Not with
+// -low-power, unless asked for: keeping connections up is what it's
+// there to avoid.
+
+var standbyCount = flag.Int("standby", 1,
+	"Endpoints to keep connected, besides the ones in use, to fail over to; 0: none")
+
+var standbyPings int64
+
+// standbyInterval is how often to look for cold endpoints: one that
+// hasn't answered since the last look gets a query, at most two
+// intervals after the last, well within the idle timeout.
+func standbyInterval() time.Duration {
+	d := defaultTransport.idleTimeout / 3
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func keepStandby() {
+	if *standbyCount <= 0 || *lowPower && !flagGiven("standby") {
+		return
+	}
+	interval := standbyInterval()
+	seen := atomic.LoadInt64(&stats.Queries)
+	for range backgroundTick(interval) {
+		if atomic.LoadInt64(&stats.Queries) == seen {
+			// Nobody's asking; the one(s) in use go cold, too.
+			continue
+		}
+		seen = atomic.LoadInt64(&stats.Queries)
+		warmUp(*standbyCount, interval)
+	}
+}
+
+// warmUp makes sure that the one endpoint in use, and standby more,
+// have been asked something within the interval, asking the ones
+// that haven't.
+func warmUp(standby int, interval time.Duration) {
+	endpoints := dohClient.health.healthy(dohClient.endpoints())
+	want := 1 + standby
+	if want > len(endpoints) {
+		want = len(endpoints)
+	}
+	var ask []string
+	if selectMode.value == "failover" {
+		// The next ones in line, specifically.
+		ask = coldEndpoints(endpoints[:want], interval)
+	} else {
+		ask = coldEndpoints(endpoints, interval)
+		n := want - (len(endpoints) - len(ask))
+		if n < 0 {
+			n = 0
+		}
+		ask = ask[:n]
+	}
+	for _, endpoint := range ask {
+		atomic.AddInt64(&standbyPings, 1)
+		if err := testEndpoint(endpoint); err != nil {
+			log.Printf("standby error: %s: %s", endpoint, err.Error())
+		}
+	}
+}
+
+// coldEndpoints are the ones of endpoints which haven't answered
+// anything within the interval.
+func coldEndpoints(endpoints []string, interval time.Duration) []string {
+	cold := []string{}
+	for _, h := range dohClient.health.snapshot(endpoints) {
+		if time.Since(h.LastOKAt) >= interval {
+			cold = append(cold, h.Endpoint)
+		}
+	}
+	return cold
+}
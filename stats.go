@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters, for the admin API. Update with atomic.AddInt64.
+type counters struct {
+	Queries     int64 `json:"queries"`
+	Blocked     int64 `json:"blocked"`
+	CacheHits   int64 `json:"cache_hits"`
+	CacheMisses int64 `json:"cache_misses"`
+	Errors      int64 `json:"errors"`
+	// UDP queries that found the queue full.
+	Dropped int64 `json:"dropped"`
+	// Upstream retries made, and not made for lack of budget.
+	Retries       int64 `json:"retries"`
+	RetriesDenied int64 `json:"retries_denied"`
+	// Upstream queries not sent, over the rate limits.
+	Shed int64 `json:"shed"`
+	// Answer records caught by -answer-filter.
+	Filtered int64 `json:"answers_filtered"`
+}
+
+var stats counters
+
+func (c *counters) snapshot() counters {
+	return counters{
+		Queries:       atomic.LoadInt64(&c.Queries),
+		Blocked:       atomic.LoadInt64(&c.Blocked),
+		CacheHits:     atomic.LoadInt64(&c.CacheHits),
+		CacheMisses:   atomic.LoadInt64(&c.CacheMisses),
+		Errors:        atomic.LoadInt64(&c.Errors),
+		Dropped:       atomic.LoadInt64(&c.Dropped),
+		Retries:       atomic.LoadInt64(&c.Retries),
+		RetriesDenied: atomic.LoadInt64(&c.RetriesDenied),
+		Shed:          atomic.LoadInt64(&c.Shed),
+		Filtered:      atomic.LoadInt64(&c.Filtered),
+	}
+}
+
+// An endpoint is considered unhealthy after this many consecutive
+// failures, until it succeeds again.
+const maxFailures = 3
+
+// Give an unhealthy endpoint another try after this long.
+const retryUnhealthy = 30 * time.Second
+
+type endpointHealth struct {
+	Endpoint    string    `json:"endpoint"`
+	Healthy     bool      `json:"healthy"`
+	Queries     int64     `json:"queries"`
+	Errors      int64     `json:"errors"`
+	Failures    int       `json:"failures"` // consecutive
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	LastOKAt    time.Time `json:"last_ok_at"`
+	// 429 Too Many Requests, and 403 Forbidden: the endpoint doesn't
+	// want to hear from us.
+	RateLimited int64 `json:"rate_limited"`
+	Forbidden   int64 `json:"forbidden"`
+	// Breaks asked for, with a Retry-After, and when the last one's
+	// over.
+	Paused      int64     `json:"paused"`
+	PausedUntil time.Time `json:"paused_until"`
+	// Responses by status class (an error before any response is
+	// neither), timeouts, and traffic in HTTP bodies, both ways.
+	Status2xx int64 `json:"status_2xx"`
+	Status3xx int64 `json:"status_3xx"`
+	Status4xx int64 `json:"status_4xx"`
+	Status5xx int64 `json:"status_5xx"`
+	Timeouts  int64 `json:"timeouts"`
+	BytesSent int64 `json:"bytes_sent"`
+	BytesRecv int64 `json:"bytes_received"`
+	// Exchanges by HTTP version, and the last one's.
+	HTTP1 int64  `json:"http1"`
+	HTTP2 int64  `json:"http2"`
+	HTTP3 int64  `json:"http3"`
+	Proto string `json:"proto,omitempty"`
+
+	// Filled in by snapshot, from the recent history below.
+	P50MS     float64           `json:"p50_ms"`
+	P95MS     float64           `json:"p95_ms"`
+	P99MS     float64           `json:"p99_ms"`
+	ErrorRate float64           `json:"error_rate"`
+	Histogram []histogramBucket `json:"histogram"`
+	// And from the TLS stats, per host.
+	Handshakes int64 `json:"tls_handshakes"`
+	Resumed    int64 `json:"tls_resumed"`
+
+	// Successful query latencies, and recent outcomes (decaying
+	// the same way as the histogram).
+	latency             *latencyHistogram
+	recentOK, recentErr float64
+}
+
+// endpointTracker keeps an endpointHealth per endpoint.
+type endpointTracker struct {
+	sync.Mutex
+	m map[string]*endpointHealth
+}
+
+func newEndpointTracker() *endpointTracker {
+	return &endpointTracker{m: map[string]*endpointHealth{}}
+}
+
+func (t *endpointTracker) get(endpoint string) *endpointHealth {
+	h, ok := t.m[endpoint]
+	if !ok {
+		h = &endpointHealth{
+			Endpoint: endpoint,
+			Healthy:  true,
+			latency:  newLatencyHistogram(),
+		}
+		t.m[endpoint] = h
+	}
+	return h
+}
+
+// record notes the outcome of a query sent to endpoint, and how
+// long it took.
+func (t *endpointTracker) record(endpoint string, d time.Duration, err error) {
+	t.Lock()
+	defer t.Unlock()
+	h := t.get(endpoint)
+	h.Queries++
+	if err != nil {
+		h.Errors++
+		h.Failures++
+		var status *StatusError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &status):
+			h.countStatus(status.StatusCode)
+		case errors.Is(err, context.DeadlineExceeded),
+			errors.As(err, &netErr) && netErr.Timeout():
+			h.Timeouts++
+		}
+		if status != nil && status.RetryAfter > 0 {
+			h.Paused++
+			h.PausedUntil = time.Now().Add(status.RetryAfter)
+		}
+		if status != nil {
+			switch status.StatusCode {
+			case http.StatusTooManyRequests:
+				h.RateLimited++
+				h.Failures = maxFailures
+			case http.StatusForbidden:
+				h.Forbidden++
+				h.Failures = maxFailures
+			}
+		}
+		if downgraded(err) {
+			h.Failures = maxFailures
+		}
+		h.LastError = err.Error()
+		h.LastErrorAt = time.Now()
+		h.recentErr++
+	} else {
+		h.Status2xx++
+		h.Failures = 0
+		h.LastOKAt = time.Now()
+		h.latency.observe(d.Seconds() * 1000)
+		h.recentOK++
+	}
+	if h.recentOK+h.recentErr >= histogramDecay {
+		h.recentOK /= 2
+		h.recentErr /= 2
+	}
+	h.Healthy = h.Failures < maxFailures
+}
+
+func (h *endpointHealth) countStatus(code int) {
+	switch code / 100 {
+	case 2:
+		h.Status2xx++
+	case 3:
+		h.Status3xx++
+	case 4:
+		h.Status4xx++
+	case 5:
+		h.Status5xx++
+	}
+}
+
+// transferred counts the bytes sent to, and received from, endpoint.
+func (t *endpointTracker) transferred(endpoint string, sent, received int) {
+	t.Lock()
+	defer t.Unlock()
+	h := t.get(endpoint)
+	h.BytesSent += int64(sent)
+	h.BytesRecv += int64(received)
+}
+
+// healthy returns the healthy ones of the given endpoints, plus the
+// ones which have been quiet long enough to deserve another chance.
+func (t *endpointTracker) healthy(endpoints []string) []string {
+	t.Lock()
+	defer t.Unlock()
+	healthy := []string{}
+	for _, endpoint := range endpoints {
+		h, ok := t.m[endpoint]
+		if ok && time.Now().Before(h.PausedUntil) {
+			continue
+		}
+		if !ok || h.Healthy || time.Since(h.LastErrorAt) > retryUnhealthy {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return healthy
+}
+
+// snapshot returns the health of the given endpoints, in order.
+func (t *endpointTracker) snapshot(endpoints []string) []endpointHealth {
+	t.Lock()
+	defer t.Unlock()
+	hs := []endpointHealth{}
+	for _, endpoint := range endpoints {
+		h := *t.get(endpoint)
+		h.P50MS = h.latency.quantile(0.50)
+		h.P95MS = h.latency.quantile(0.95)
+		h.P99MS = h.latency.quantile(0.99)
+		if n := h.recentOK + h.recentErr; n > 0 {
+			h.ErrorRate = h.recentErr / n
+		}
+		h.Histogram = h.latency.buckets()
+		if u, err := url.Parse(endpoint); err == nil {
+			h.Handshakes, h.Resumed = handshakeCount(u.Hostname())
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+type nameCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// top returns the n biggest counts, biggest first.
+func top(counts map[string]int, n int) []nameCount {
+	ncs := []nameCount{}
+	for name, count := range counts {
+		ncs = append(ncs, nameCount{name, count})
+	}
+	sort.Slice(ncs, func(i, j int) bool {
+		if ncs[i].Count != ncs[j].Count {
+			return ncs[i].Count > ncs[j].Count
+		}
+		return ncs[i].Name < ncs[j].Name
+	})
+	if len(ncs) > n {
+		ncs = ncs[:n]
+	}
+	return ncs
+}
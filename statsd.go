@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD: the /metrics counters, pushed rather than scraped, for
+// where there's an agent but no Prometheus. Every -statsd-interval,
+// over UDP: the counters as deltas ("|c"), the gauges as they are
+// ("|g"), and each query's time ("|ms", sampled past a point):
+//
+//	gdoh -statsd 127.0.0.1:8125 -statsd-prefix gdoh.
+//	gdoh -statsd 127.0.0.1:8125 -statsd-format datadog
+//
+// Plain StatsD has no labels, so they go in the name
+// (gdoh.endpoint_queries.dns_example_com_dns_query); DogStatsD gets
+// tags (gdoh.endpoint_queries:1|c|#endpoint:https://dns.example.com/...).
+
+var statsdAddr = flag.String("statsd", "",
+	"StatsD address to push metrics to, HOST:PORT (off by default)")
+var statsdPrefix = flag.String("statsd-prefix", "gdoh.",
+	"Prefix for the StatsD metric names")
+var statsdInterval = flag.Duration("statsd-interval", 10*time.Second,
+	"How often to push metrics to StatsD")
+var statsdFormat = &choiceFlag{value: "statsd", choices: []string{"statsd", "datadog"}}
+
+func init() {
+	flag.Var(statsdFormat, "statsd-format",
+		"StatsD dialect: statsd, or datadog (with tags)")
+}
+
+const (
+	// Query times kept per interval; past that, a random sample.
+	statsdTimings = 1000
+	// Keep the packets under a typical MTU.
+	statsdPacket = 1400
+)
+
+type statsdEmitter struct {
+	sync.Mutex
+	timings []statsdTiming
+	seen    int // timings offered this interval
+	last    map[string]float64
+}
+
+type statsdTiming struct {
+	outcome string
+	ms      float64
+}
+
+var statsd = &statsdEmitter{last: map[string]float64{}}
+
+func checkStatsd() error {
+	if *statsdAddr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(*statsdAddr); err != nil {
+		return fmt.Errorf("-statsd %s: %v", *statsdAddr, err)
+	}
+	if *statsdInterval < time.Second {
+		return fmt.Errorf("-statsd-interval %s: want at least 1s", *statsdInterval)
+	}
+	return nil
+}
+
+// add records a query's time, for the next push.
+func (s *statsdEmitter) add(e queryEntry) {
+	if *statsdAddr == "" {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.seen++
+	t := statsdTiming{e.Outcome, e.Duration}
+	if len(s.timings) < statsdTimings {
+		s.timings = append(s.timings, t)
+	} else if i := random.Intn(s.seen); i < statsdTimings {
+		// Reservoir sampling: every query has the same chance.
+		s.timings[i] = t
+	}
+}
+
+func (s *statsdEmitter) run() {
+	if *statsdAddr == "" {
+		return
+	}
+	failing := false
+	for range backgroundTick(*statsdInterval) {
+		err := s.push()
+		if err != nil && !failing {
+			log.Printf("statsd error: %s", err.Error())
+		}
+		failing = err != nil
+	}
+}
+
+// push sends what's new since the last one.
+func (s *statsdEmitter) push() error {
+	conn, err := net.Dial("udp", *statsdAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	send := func(line string) error {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		return nil
+	}
+	for _, line := range s.lines() {
+		if err := send(line); err != nil {
+			return err
+		}
+	}
+	if packet.Len() == 0 {
+		return nil
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+// lines are the metric lines for this push.
+func (s *statsdEmitter) lines() []string {
+	ms := metrics()
+	s.Lock()
+	defer s.Unlock()
+	lines := []string{}
+	for _, m := range ms {
+		name, tags := statsdName(m)
+		switch m.kind {
+		case "counter":
+			key := m.name + m.labels
+			delta := m.value - s.last[key]
+			s.last[key] = m.value
+			if delta > 0 {
+				lines = append(lines, fmt.Sprintf("%s:%g|c%s", name, delta, tags))
+			}
+		default:
+			lines = append(lines, fmt.Sprintf("%s:%g|g%s", name, m.value, tags))
+		}
+	}
+	rate := ""
+	if s.seen > len(s.timings) {
+		rate = fmt.Sprintf("|@%.4g", float64(len(s.timings))/float64(s.seen))
+	}
+	for _, t := range s.timings {
+		name, tags := statsdName(metric{name: "gdoh_query_time",
+			labels: fmt.Sprintf("{outcome=%q}", t.outcome)})
+		lines = append(lines, fmt.Sprintf("%s:%.3f|ms%s%s", name, t.ms, rate, tags))
+	}
+	s.timings, s.seen = s.timings[:0], 0
+	return lines
+}
+
+var (
+	statsdLabel   = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+	statsdNotName = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// statsdName turns a metric's name and labels into the StatsD name,
+// and the DogStatsD tags, if that's the format.
+func statsdName(m metric) (name, tags string) {
+	name = *statsdPrefix + strings.TrimSuffix(strings.TrimPrefix(m.name, "gdoh_"), "_total")
+	labels := statsdLabel.FindAllStringSubmatch(m.labels, -1)
+	if statsdFormat.value == "datadog" {
+		for i, l := range labels {
+			if i == 0 {
+				tags = "|#"
+			} else {
+				tags += ","
+			}
+			tags += l[1] + ":" + strings.NewReplacer(",", "_", "|", "_").Replace(l[2])
+		}
+		return name, tags
+	}
+	for _, l := range labels {
+		value := strings.TrimPrefix(strings.TrimPrefix(l[2], "https://"), "http://")
+		name += "." + strings.Trim(statsdNotName.ReplaceAllString(value, "_"), "_")
+	}
+	return name, ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// DNS over TCP (RFC 7766): every message is prefixed with its length
+// as a 16-bit big-endian integer. Clients may send several queries
+// over one connection.
+
+var listenTCP = &stringsFlag{}
+
+func init() {
+	listenTCP.check = checkListen
+	flag.Var(listenTCP, "listen-tcp", "TCP address to listen on, optionally NAME=ADDRESS (repeatable)")
+}
+
+// tcpIdleTimeout is how long we keep an idle client connection open.
+const tcpIdleTimeout = 10 * time.Second
+
+// listenStream binds a TCP listener, see network; or takes the one
+// handed over (see handoff.go).
+func listenStream(address string) (net.Listener, error) {
+	var ln net.Listener
+	if f := inherited("tcp", address); f != nil {
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		network, err := network("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+	keepSocket("tcp", address, ln.(*net.TCPListener).File)
+	return ln, nil
+}
+
+// serveTCP accepts connections on ln, for the -listen-tcp value v,
+// until stopping.
+func serveTCP(ln net.Listener, v string) {
+	name, _ := splitListen(v)
+	for {
+		conn, err := ln.Accept()
+		if err != nil && stopping() {
+			return
+		}
+		if err != nil {
+			log.Print("accept error:", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		handoff.connections.Add(1)
+		go handleTCP(conn, name, fromProxy(v, conn.RemoteAddr()))
+	}
+}
+
+func handleTCP(conn net.Conn, listener string, proxied bool) {
+	defer handoff.connections.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	client := conn.RemoteAddr()
+	if proxied {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		src, err := readProxyHeader(r)
+		if err != nil {
+			log.Printf("proxy error: %s: %s", client, err.Error())
+			return
+		}
+		if src != nil {
+			client = src
+		}
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			if err != io.EOF {
+				log.Print("read error:", err.Error())
+			}
+			return
+		}
+		query := make([]byte, n)
+		if _, err := io.ReadFull(r, query); err != nil {
+			log.Print("read error:", err.Error())
+			return
+		}
+		resp := answer(query, onListener(client, listener))
+		if len(resp) == 0 {
+			continue
+		}
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+		if _, err := conn.Write(msg); err != nil {
+			log.Print("write error:", err.Error())
+			return
+		}
+	}
+}
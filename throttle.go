@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// When an endpoint answers 429 Too Many Requests, or 503 Service
+// Unavailable, with a Retry-After, we do as we're told: the endpoint
+// gets a break for that long (an hour at most), and the queries go
+// elsewhere - including the one that got the 429, which is retried
+// (on the retry budget) with another endpoint. If there's no other
+// endpoint left, queries fail right away, without going out at all.
+// A 429 without a Retry-After makes the endpoint unhealthy, as before.
+
+// The longest break an endpoint gets to ask for.
+const maxPause = time.Hour
+
+// PausedError is returned for queries to an endpoint that has asked
+// us to back off, until it's over.
+type PausedError struct {
+	Endpoint string
+	Until    time.Time
+}
+
+func (e *PausedError) Error() string {
+	return fmt.Sprintf("%s: paused for %s more, as asked (Retry-After)",
+		e.Endpoint, time.Until(e.Until).Round(time.Second))
+}
+
+// retryAfter parses the Retry-After header (RFC 9110, section
+// 10.2.3): seconds, or an HTTP date. Zero if there's none, or it's
+// garbage.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if n, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(n) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > maxPause {
+		return maxPause
+	}
+	return d
+}
+
+// throttled tells whether err means the endpoint wants a break.
+func throttled(err error) bool {
+	var status *StatusError
+	var paused *PausedError
+	return errors.As(err, &paused) ||
+		errors.As(err, &status) && status.RetryAfter > 0
+}
+
+// pausedUntil tells whether endpoint is taking a break, and till when.
+func (t *endpointTracker) pausedUntil(endpoint string) (time.Time, bool) {
+	t.Lock()
+	defer t.Unlock()
+	h, ok := t.m[endpoint]
+	if !ok || !time.Now().Before(h.PausedUntil) {
+		return time.Time{}, false
+	}
+	return h.PausedUntil, true
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream TLS settings. Every endpoint host gets its own
+// http.Transport, configured here.
+//
+// Private resolvers can have their own CA: -ca-file adds to the
+// system's roots for all endpoints, -ca HOST=FILE replaces them for
+// one.
+//
+// -tls sets the minimum version, the TLS 1.2 cipher suites (Go won't
+// let us pick the 1.3 ones), and whether to resume sessions; resumed
+// handshakes save a round trip, and are counted in the endpoint stats.
+//
+// Client certificates (-client-cert) are read again whenever the
+// files change, so that they can be renewed without a restart; so are
+// the CA files (-ca-file, -ca), after which new connections trust the
+// new ones, and the idle ones go. (The one server certificate there
+// is, the mockserver's -cert, gets reloaded the same way as the
+// client certificates.)
+//
+// SPKI pins: the base64 SHA-256 of a certificate's public key (as
+// with kdig's +tls-pin, or HPKP). If an endpoint has any pins, some
+// certificate in a verified chain (not just any the server sent) has
+// to match one of them, on top of the usual verification; otherwise
+// we hang up. Get yours with:
+//
+//	openssl s_client -connect dns.example.net:443 </dev/null |
+//	openssl x509 -pubkey -noout |
+//	openssl pkey -pubin -outform der |
+//	openssl dgst -sha256 -binary | base64
+
+var pinFlags = &stringsFlag{}
+var caFile = flag.String("ca-file", "",
+	"PEM file with CA certificates to trust, on top of the system's")
+var caFlags = &stringsFlag{}
+var clientCertFlags = &stringsFlag{}
+var tlsFlags = &stringsFlag{}
+
+func init() {
+	caFlags.check = func(v string) error {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("-ca %s: want host=file", v)
+		}
+		return checkFile(parts[1])
+	}
+	flag.Var(caFlags, "ca",
+		"Trust only the CA certificates in FILE for an endpoint: HOST=FILE (repeatable)")
+	clientCertFlags.check = func(v string) error {
+		_, _, _, err := parseClientCert(v)
+		return err
+	}
+	flag.Var(clientCertFlags, "client-cert",
+		"TLS client certificate for an endpoint: HOST=CERT.pem,KEY.pem (repeatable)")
+	tlsFlags.check = func(v string) error {
+		_, err := parseTLSOptions(v, defaultTLS)
+		return err
+	}
+	flag.Var(tlsFlags, "tls",
+		"TLS options, for all endpoints or one: [HOST=]min:1.3,ciphers:A+B,resume:off (repeatable)")
+	pinFlags.check = func(v string) error {
+		_, _, err := parsePin(v)
+		return err
+	}
+	flag.Var(pinFlags, "pin",
+		"Pin an endpoint's key: HOST=BASE64 SHA-256 of the SPKI (repeatable)")
+}
+
+// ErrPinMismatch is returned when no certificate matches the pins.
+var ErrPinMismatch = errors.New("Certificate doesn't match the pinned keys")
+
+// spkiPins maps hostnames to their pinned key hashes.
+var spkiPins = map[string][][]byte{}
+
+func parsePin(v string) (string, []byte, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, fmt.Errorf("-pin %s: want host=hash", v)
+	}
+	hash := strings.TrimPrefix(parts[1], "sha256/")
+	pin, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || len(pin) != sha256.Size {
+		return "", nil, fmt.Errorf("-pin %s: want a base64 SHA-256", v)
+	}
+	return strings.ToLower(parts[0]), pin, nil
+}
+
+func loadPins() error {
+	for _, v := range pinFlags.values {
+		host, pin, err := parsePin(v)
+		if err != nil {
+			return err
+		}
+		spkiPins[host] = append(spkiPins[host], pin)
+	}
+	return nil
+}
+
+// Root CAs: nil for the system's, unless -ca-file is given; for some
+// hosts, from -ca. With the modification times of their files, as of
+// when they were read.
+var (
+	rootsMu    sync.RWMutex
+	roots      *x509.CertPool
+	hostRoots  = map[string]*x509.CertPool{}
+	caModTimes = map[string]time.Time{}
+)
+
+func loadCAs() error {
+	modTimes, err := caFilesModified()
+	if err != nil {
+		return err
+	}
+	var newRoots *x509.CertPool
+	newHostRoots := map[string]*x509.CertPool{}
+	if *caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := addCerts(pool, *caFile); err != nil {
+			return err
+		}
+		newRoots = pool
+	}
+	for _, v := range caFlags.values {
+		parts := strings.SplitN(v, "=", 2)
+		host := strings.ToLower(parts[0])
+		pool, ok := newHostRoots[host]
+		if !ok {
+			pool = x509.NewCertPool()
+			newHostRoots[host] = pool
+		}
+		if err := addCerts(pool, parts[1]); err != nil {
+			return err
+		}
+	}
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	roots, hostRoots, caModTimes = newRoots, newHostRoots, modTimes
+	return nil
+}
+
+// caFilesModified tells when the CA files were last modified.
+func caFilesModified() (map[string]time.Time, error) {
+	paths := []string{}
+	if *caFile != "" {
+		paths = append(paths, *caFile)
+	}
+	for _, v := range caFlags.values {
+		paths = append(paths, strings.SplitN(v, "=", 2)[1])
+	}
+	modTimes := map[string]time.Time{}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// watchCAs reloads the CA files when they change. If they can't be
+// loaded (say, halfway through an update), we stick with the old
+// ones.
+func watchCAs() {
+	if *caFile == "" && len(caFlags.values) == 0 {
+		return
+	}
+	for range backgroundTick(keyPairCheck) {
+		modTimes, err := caFilesModified()
+		if err == nil && !caFilesSame(modTimes) {
+			err = loadCAs()
+			if err == nil {
+				log.Printf("Reloaded CA certificates")
+				dohClient.Client.Transport.(*endpointTransports).reset()
+			}
+		}
+		if err != nil {
+			log.Printf("ca error: %s", err.Error())
+		}
+	}
+}
+
+func caFilesSame(modTimes map[string]time.Time) bool {
+	rootsMu.RLock()
+	defer rootsMu.RUnlock()
+	for path, t := range modTimes {
+		if !t.Equal(caModTimes[path]) {
+			return false
+		}
+	}
+	return true
+}
+
+func addCerts(pool *x509.CertPool, path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no certificates found", path)
+	}
+	return nil
+}
+
+// keyPair is a client certificate, reloaded when its files change.
+type keyPair struct {
+	sync.Mutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modTime           time.Time
+	checked           time.Time
+}
+
+// Don't look at the files on every handshake.
+const keyPairCheck = 10 * time.Second
+
+var clientCerts = map[string]*keyPair{}
+
+func parseClientCert(v string) (host, certFile, keyFile string, err error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) == 2 {
+		files := strings.SplitN(parts[1], ",", 2)
+		if len(files) == 2 && parts[0] != "" {
+			return strings.ToLower(parts[0]), files[0], files[1], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("-client-cert %s: want host=cert,key", v)
+}
+
+func loadClientCerts() error {
+	for _, v := range clientCertFlags.values {
+		host, certFile, keyFile, _ := parseClientCert(v)
+		kp := &keyPair{certFile: certFile, keyFile: keyFile}
+		if err := kp.load(); err != nil {
+			return err
+		}
+		clientCerts[host] = kp
+	}
+	return nil
+}
+
+func (kp *keyPair) load() error {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return err
+	}
+	kp.cert, kp.modTime = &cert, modTime
+	return nil
+}
+
+func (kp *keyPair) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{kp.certFile, kp.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// get is a tls.Config.GetClientCertificate. If the files changed but
+// can't be loaded (say, halfway through an update), we stick with
+// the old certificate.
+func (kp *keyPair) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return kp.current(), nil
+}
+
+// getServer is get, as a tls.Config.GetCertificate.
+func (kp *keyPair) getServer(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.current(), nil
+}
+
+func (kp *keyPair) current() *tls.Certificate {
+	kp.Lock()
+	defer kp.Unlock()
+	if time.Since(kp.checked) > keyPairCheck {
+		kp.checked = time.Now()
+		modTime, err := kp.lastModified()
+		if err == nil && !modTime.Equal(kp.modTime) {
+			err = kp.load()
+			if err == nil {
+				log.Printf("Reloaded certificate %s", kp.certFile)
+			}
+		}
+		if err != nil {
+			log.Printf("certificate error: %s", err.Error())
+		}
+	}
+	return kp.cert
+}
+
+func spkiHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+type tlsOptions struct {
+	minVersion uint16
+	ciphers    []uint16
+	resume     bool
+}
+
+var (
+	defaultTLS = tlsOptions{resume: true}
+	hostTLS    = map[string]tlsOptions{}
+)
+
+var tlsVersionNumbers = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSOptions parses a -tls value, on top of the given options.
+func parseTLSOptions(v string, opts tlsOptions) (tlsOptions, error) {
+	if i := strings.Index(v, "="); i >= 0 {
+		v = v[i+1:]
+	}
+	for _, opt := range strings.Split(v, ",") {
+		parts := strings.SplitN(opt, ":", 2)
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("-tls %s: want key:value", opt)
+		}
+		switch parts[0] {
+		case "min":
+			version, ok := tlsVersionNumbers[parts[1]]
+			if !ok {
+				return opts, fmt.Errorf("-tls %s: unknown version", opt)
+			}
+			opts.minVersion = version
+		case "ciphers":
+			opts.ciphers = nil
+		names:
+			for _, name := range strings.Split(parts[1], "+") {
+				for _, suite := range tls.CipherSuites() {
+					if suite.Name == name {
+						opts.ciphers = append(opts.ciphers, suite.ID)
+						continue names
+					}
+				}
+				return opts, fmt.Errorf("-tls %s: unknown cipher suite %s", opt, name)
+			}
+		case "resume":
+			if parts[1] != "on" && parts[1] != "off" {
+				return opts, fmt.Errorf("-tls %s: want on or off", opt)
+			}
+			opts.resume = parts[1] == "on"
+		default:
+			return opts, fmt.Errorf("-tls %s: unknown option", opt)
+		}
+	}
+	return opts, nil
+}
+
+// loadTLSOptions applies the global -tls options first, and the
+// per-host ones on top of those.
+func loadTLSOptions() error {
+	hosts := []string{}
+	for _, v := range tlsFlags.values {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			opts, err := parseTLSOptions(v, defaultTLS)
+			if err != nil {
+				return err
+			}
+			defaultTLS = opts
+			continue
+		}
+		hosts = append(hosts, v)
+	}
+	for _, v := range hosts {
+		host := strings.ToLower(v[:strings.Index(v, "=")])
+		opts, ok := hostTLS[host]
+		if !ok {
+			opts = defaultTLS
+		}
+		opts, err := parseTLSOptions(v, opts)
+		if err != nil {
+			return err
+		}
+		hostTLS[host] = opts
+	}
+	return nil
+}
+
+// Handshakes, and how many of them were resumed, by host.
+var (
+	handshakesMu sync.Mutex
+	handshakes   = map[string]*[2]int64{}
+)
+
+func countHandshake(host string, resumed bool) {
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+	n, ok := handshakes[host]
+	if !ok {
+		n = &[2]int64{}
+		handshakes[host] = n
+	}
+	n[0]++
+	if resumed {
+		n[1]++
+	}
+}
+
+func handshakeCount(host string) (total, resumed int64) {
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+	if n, ok := handshakes[strings.ToLower(host)]; ok {
+		return n[0], n[1]
+	}
+	return 0, 0
+}
+
+// configureTLS applies our settings for connections to host.
+func configureTLS(host string, config *tls.Config) {
+	rootsMu.RLock()
+	if pool, ok := hostRoots[host]; ok {
+		config.RootCAs = pool
+	} else if roots != nil {
+		config.RootCAs = roots
+	}
+	rootsMu.RUnlock()
+	if kp, ok := clientCerts[host]; ok {
+		config.GetClientCertificate = kp.get
+	}
+	opts, ok := hostTLS[host]
+	if !ok {
+		opts = defaultTLS
+	}
+	config.MinVersion = opts.minVersion
+	config.CipherSuites = opts.ciphers
+	if opts.resume {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	configureECH(host, config)
+	pins := spkiPins[host]
+	// Runs after the regular certificate verification, resumed
+	// sessions included.
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		countHandshake(host, cs.DidResume)
+		if err := verifyDANE(host, endpointPort(host), cs); err != nil {
+			return err
+		}
+		if len(pins) == 0 {
+			return nil
+		}
+		return verifyPins(host, pins, cs)
+	}
+}
+
+func verifyPins(host string, pins [][]byte, cs tls.ConnectionState) error {
+	// Only the chains that check out, up to a root we trust: anyone
+	// can send the pinned CA's certificate along with theirs.
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			hash := spkiHash(cert)
+			for _, pin := range pins {
+				if string(hash) == string(pin) {
+					return nil
+				}
+			}
+		}
+	}
+	got := ""
+	if len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 0 {
+		got = base64.StdEncoding.EncodeToString(spkiHash(cs.VerifiedChains[0][0]))
+	}
+	log.Printf("pin error: %s: got %s, refusing to talk", host, got)
+	return ErrPinMismatch
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query traces: what happened to a query, step by step - the
+// question, the policies that had a say, the cache, the endpoint, the
+// retries, the HTTP status, and how long each of it took - to tell why
+// a name fails without reading the code.
+//
+// "gdoh trace NAME [TYPE]" traces a single query, through the
+// configured pipeline; -trace DOMAIN has the server log a trace of
+// every query under DOMAIN, as they come.
+
+var traceDomains = &stringsFlag{}
+
+func init() {
+	flag.Var(traceDomains, "trace",
+		"Log a step by step trace of queries for names under this domain (repeatable)")
+}
+
+type traceStep struct {
+	at   time.Duration
+	text string
+}
+
+type queryTrace struct {
+	sync.Mutex
+	start time.Time
+	steps []traceStep
+}
+
+type traceKey struct{}
+
+// withTrace starts a trace, for the queries made with the returned
+// context.
+func withTrace(ctx context.Context) (context.Context, *queryTrace) {
+	t := &queryTrace{start: time.Now()}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+func traceFrom(ctx context.Context) *queryTrace {
+	t, _ := ctx.Value(traceKey{}).(*queryTrace)
+	return t
+}
+
+// tracef adds a step to ctx's trace, if there's one; it costs next
+// to nothing if there isn't.
+func tracef(ctx context.Context, format string, args ...interface{}) {
+	t := traceFrom(ctx)
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.steps = append(t.steps, traceStep{time.Since(t.start), fmt.Sprintf(format, args...)})
+}
+
+func (t *queryTrace) lines() []string {
+	t.Lock()
+	defer t.Unlock()
+	lines := []string{}
+	for _, s := range t.steps {
+		lines = append(lines, fmt.Sprintf("%8.1fms  %s", s.at.Seconds()*1000, s.text))
+	}
+	return lines
+}
+
+// traced tells whether the server should trace queries for name.
+func traced(name string) bool {
+	if len(traceDomains.values) == 0 {
+		return false
+	}
+	name = normalizeName(name)
+	for _, domain := range traceDomains.values {
+		domain = normalizeName(domain)
+		if domain == "." || name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// logTrace logs a finished trace, a line per step.
+func logTrace(t *queryTrace, q dnsQuestion, client net.Addr) {
+	for _, line := range t.lines() {
+		log.Printf("trace: %s %s %s: %s", clientLabel(client),
+			q.Name, typeName(q.Type), strings.TrimSpace(line))
+	}
+}
+
+// httpTrace is the HTTP side of a trace: connections, handshakes, and
+// the time to the first byte.
+func httpTrace(ctx context.Context, reused *bool) *httptrace.ClientTrace {
+	if traceFrom(ctx) == nil {
+		return &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { *reused = info.Reused },
+		}
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			*reused = info.Reused
+			if info.Reused {
+				tracef(ctx, "reusing a connection to %s (idle for %s)",
+					info.Conn.RemoteAddr(), info.IdleTime.Round(time.Millisecond))
+			} else {
+				tracef(ctx, "new connection to %s", info.Conn.RemoteAddr())
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			tracef(ctx, "connecting to %s", addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				tracef(ctx, "connect to %s failed: %s", addr, err.Error())
+			}
+		},
+		TLSHandshakeStart: func() { tracef(ctx, "TLS handshake") },
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err != nil {
+				tracef(ctx, "TLS handshake failed: %s", err.Error())
+				return
+			}
+			tracef(ctx, "TLS handshake done: %s, ALPN %q, resumed %t",
+				tlsVersions[cs.Version], cs.NegotiatedProtocol, cs.DidResume)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			tracef(ctx, "query sent")
+		},
+		GotFirstResponseByte: func() { tracef(ctx, "first response byte") },
+	}
+}
+
+func traceCommand(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	client := fs.String("client", "127.0.0.1",
+		"Trace the query as if it came from this address (for the per-client policies)")
+	listener := fs.String("listener", "",
+		"Trace the query as if it came in on this named listener")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gdoh trace [-client ADDR] [-listener NAME] NAME [TYPE]")
+		fs.PrintDefaults()
+	}
+	args, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fs.Usage()
+		return errors.New("Bad arguments")
+	}
+	type_ := uint16(typeA)
+	if len(args) == 2 {
+		if type_, err = typeNumber(args[1]); err != nil {
+			return err
+		}
+	}
+	ip := net.ParseIP(*client)
+	if ip == nil {
+		return fmt.Errorf("-client %s: bad address", *client)
+	}
+	q := &dnsMsg{
+		ID:         randomID(),
+		Flags:      flagRD,
+		Question:   []dnsQuestion{{normalizeName(args[0]), type_, classINET}},
+		Additional: []dnsRR{{Name: ".", Type: typeOPT, Class: ednsPayload()}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
+	defer cancel()
+	ctx, t := withTrace(ctx)
+	resp, outcome := resolve(ctx, q, q.pack(), onListener(&net.UDPAddr{IP: ip}, *listener))
+	tracef(ctx, "done: %s", outcome)
+	for _, line := range t.lines() {
+		fmt.Println(line)
+	}
+	r, err := parseMsg(resp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(";; %s\n", rcodeName(r.rcode()))
+	for _, rr := range r.Answer {
+		fmt.Println(rrString(rr))
+	}
+	return nil
+}
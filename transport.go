@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every endpoint host gets an http.Transport of its own, so that a
+// slow one can't hog the connections the others need. -transport
+// tunes them, for all endpoints or just one:
+//
+//	idle-conns:N          idle connections to keep (MaxIdleConnsPerHost)
+//	max-conns:N           connections at most (MaxConnsPerHost; 0: any)
+//	idle-timeout:D        close idle connections after this long
+//	response-timeout:D    wait this long for the response headers
+//	http2:on|off          try HTTP/2
+//	h2-ping:D             ping HTTP/2 connections quiet for this long
+//	h2-ping-timeout:D     and close them if there's no pong in time
+//	require-h2:on|off     fail responses over HTTP/1.1 (see proto.go)
+
+var transportFlags = &stringsFlag{}
+
+// Timeouts, for the upstream connections.
+var (
+	dialTimeout = flag.Duration("dial-timeout", 5*time.Second,
+		"Give up connecting to an endpoint after this long")
+	tlsTimeout = flag.Duration("tls-timeout", 10*time.Second,
+		"Give up on a TLS handshake after this long")
+	requestTimeout = flag.Duration("request-timeout", 10*time.Second,
+		"Give up on an upstream request after this long (see also -query-timeout)")
+	keepAlive = flag.Duration("keepalive", 30*time.Second,
+		"TCP keep-alive interval for upstream connections")
+	idleTimeout = flag.Duration("idle-timeout", 90*time.Second,
+		"Close upstream connections idle for this long")
+)
+
+func checkTimeouts() error {
+	for name, d := range map[string]time.Duration{
+		"dial-timeout":    *dialTimeout,
+		"tls-timeout":     *tlsTimeout,
+		"request-timeout": *requestTimeout,
+		"query-timeout":   *queryTimeout,
+		"keepalive":       *keepAlive,
+		"idle-timeout":    *idleTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("-%s has to be positive", name)
+		}
+	}
+	return nil
+}
+
+func init() {
+	transportFlags.check = func(v string) error {
+		_, err := parseTransportOptions(v, defaultTransport)
+		return err
+	}
+	flag.Var(transportFlags, "transport",
+		"HTTP options, for all endpoints or one: [HOST=]idle-conns:4,http2:on,... (repeatable)")
+}
+
+type transportOptions struct {
+	idleConns, maxConns          int
+	idleTimeout, responseTimeout time.Duration
+	http2, requireH2             bool
+	h2Ping, h2PingTimeout        time.Duration
+}
+
+var (
+	defaultTransport = transportOptions{
+		idleConns: 2, // http.DefaultMaxIdleConnsPerHost
+	}
+	hostTransport = map[string]transportOptions{}
+)
+
+// parseTransportOptions parses a -transport value, on top of the
+// given options.
+func parseTransportOptions(v string, opts transportOptions) (transportOptions, error) {
+	if i := strings.Index(v, "="); i >= 0 {
+		v = v[i+1:]
+	}
+	for _, opt := range strings.Split(v, ",") {
+		parts := strings.SplitN(opt, ":", 2)
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("-transport %s: want key:value", opt)
+		}
+		var n int
+		var d time.Duration
+		var err error
+		switch parts[0] {
+		case "idle-conns", "max-conns":
+			n, err = strconv.Atoi(parts[1])
+			if err == nil && n < 0 {
+				err = fmt.Errorf("negative")
+			}
+		case "idle-timeout", "response-timeout", "h2-ping", "h2-ping-timeout":
+			d, err = time.ParseDuration(parts[1])
+			if err == nil && d < 0 {
+				err = fmt.Errorf("negative")
+			}
+		case "http2", "require-h2":
+			if parts[1] != "on" && parts[1] != "off" {
+				err = fmt.Errorf("want on or off")
+			}
+		case "require-h3":
+			err = fmt.Errorf("gdoh doesn't speak HTTP/3")
+		default:
+			return opts, fmt.Errorf("-transport %s: unknown option", opt)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("-transport %s: %v", opt, err)
+		}
+		switch parts[0] {
+		case "idle-conns":
+			opts.idleConns = n
+		case "max-conns":
+			opts.maxConns = n
+		case "idle-timeout":
+			opts.idleTimeout = d
+		case "response-timeout":
+			opts.responseTimeout = d
+		case "http2":
+			opts.http2 = parts[1] == "on"
+		case "require-h2":
+			opts.requireH2 = parts[1] == "on"
+		case "h2-ping":
+			opts.h2Ping = d
+		case "h2-ping-timeout":
+			opts.h2PingTimeout = d
+		}
+	}
+	return opts, nil
+}
+
+// loadTransportOptions applies the global -transport options first,
+// and the per-host ones on top of those.
+func loadTransportOptions() error {
+	defaultTransport.idleTimeout = *idleTimeout
+	hosts := []string{}
+	for _, v := range transportFlags.values {
+		if !strings.Contains(v, "=") {
+			opts, err := parseTransportOptions(v, defaultTransport)
+			if err != nil {
+				return err
+			}
+			defaultTransport = opts
+			continue
+		}
+		hosts = append(hosts, v)
+	}
+	for _, v := range hosts {
+		host := strings.ToLower(v[:strings.Index(v, "=")])
+		opts, ok := hostTransport[host]
+		if !ok {
+			opts = defaultTransport
+		}
+		opts, err := parseTransportOptions(v, opts)
+		if err != nil {
+			return err
+		}
+		hostTransport[host] = opts
+	}
+	return nil
+}
+
+// configureTransport applies the options for host to t.
+func configureTransport(host string, t *http.Transport) {
+	opts, ok := hostTransport[host]
+	if !ok {
+		opts = defaultTransport
+	}
+	t.MaxIdleConnsPerHost = opts.idleConns
+	t.MaxConnsPerHost = opts.maxConns
+	t.IdleConnTimeout = opts.idleTimeout
+	t.TLSHandshakeTimeout = *tlsTimeout
+	t.ResponseHeaderTimeout = opts.responseTimeout
+	if opts.http2 || opts.requireH2 {
+		h2Ping := opts.h2Ping
+		if *lowPower {
+			// Pings are what keeps the radio up.
+			h2Ping = 0
+		}
+		// Needed with our own DialContext.
+		t.ForceAttemptHTTP2 = true
+		t.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: h2Ping,
+			PingTimeout:     opts.h2PingTimeout,
+		}
+	}
+}
+
+// endpointTransports is an http.RoundTripper with a separate
+// http.Transport for each host, cloned from base.
+type endpointTransports struct {
+	sync.Mutex
+	base  *http.Transport
+	hosts map[string]*http.Transport
+}
+
+func (et *endpointTransports) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := strings.ToLower(r.URL.Hostname())
+	if echMode.value == "require" && net.ParseIP(host) == nil &&
+		getECH(host) == nil {
+		return nil, ErrNoECH
+	}
+	r = cleanRequest(r)
+	resp, err := et.forHost(host).RoundTrip(r)
+	if err != nil {
+		resp, err = et.echRetry(r, err)
+	}
+	cleanResponse(resp)
+	return resp, err
+}
+
+func (et *endpointTransports) forHost(host string) *http.Transport {
+	host = strings.ToLower(host)
+	et.Lock()
+	defer et.Unlock()
+	t, ok := et.hosts[host]
+	if !ok {
+		t = et.base.Clone()
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		configureTLS(host, t.TLSClientConfig)
+		configureTransport(host, t)
+		et.hosts[host] = t
+	}
+	return t
+}
+
+// reset starts over, with new transports, set up afresh: for new TLS
+// settings. The requests in flight finish on the old ones.
+func (et *endpointTransports) reset() {
+	et.Lock()
+	defer et.Unlock()
+	for _, t := range et.hosts {
+		t.CloseIdleConnections()
+	}
+	et.hosts = map[string]*http.Transport{}
+}
+
+// resetHost is reset, for just the one host.
+func (et *endpointTransports) resetHost(host string) {
+	et.Lock()
+	defer et.Unlock()
+	if t, ok := et.hosts[host]; ok {
+		t.CloseIdleConnections()
+		delete(et.hosts, host)
+	}
+}
+
+// CloseIdleConnections closes the idle connections of all hosts.
+func (et *endpointTransports) CloseIdleConnections() {
+	et.Lock()
+	defer et.Unlock()
+	for _, t := range et.hosts {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TTL clamping: a minimum stops 1-second TTLs from thrashing the
+// cache, a maximum bounds how stale an answer can get. Per-domain
+// overrides trump both.
+
+var ttlMin = flag.Duration("min-ttl", 0,
+	"Raise TTLs below this, in cached and relayed answers")
+var ttlMax = flag.Duration("max-ttl", 0,
+	"Lower TTLs above this, in cached and relayed answers (0: no limit)")
+
+var ttlFlags = &stringsFlag{}
+
+func init() {
+	ttlFlags.check = func(v string) error {
+		_, _, err := parseTTLOverride(v)
+		return err
+	}
+	flag.Var(ttlFlags, "ttl",
+		"Override TTLs for a domain and its subdomains: example.com=24h (repeatable)")
+}
+
+// ttlOverrides maps domains to the TTL forced on answers for names
+// under them.
+var ttlOverrides = map[string]uint32{}
+
+func checkTTLs() error {
+	if *ttlMin < 0 || *ttlMax < 0 {
+		return fmt.Errorf("TTL limits can't be negative")
+	}
+	if *ttlMax > 0 && *ttlMin > *ttlMax {
+		return fmt.Errorf("-min-ttl %s is over -max-ttl %s", *ttlMin, *ttlMax)
+	}
+	for _, v := range ttlFlags.values {
+		domain, ttl, err := parseTTLOverride(v)
+		if err != nil {
+			return err
+		}
+		ttlOverrides[domain] = ttl
+	}
+	return nil
+}
+
+func parseTTLOverride(v string) (string, uint32, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("-ttl %s: want domain=duration", v)
+	}
+	d, err := time.ParseDuration(parts[1])
+	if err != nil || d < 0 {
+		return "", 0, fmt.Errorf("-ttl %s: bad duration", v)
+	}
+	return normalizeName(parts[0]), uint32(d / time.Second), nil
+}
+
+// ttlOverride finds the override for the most specific domain
+// covering name, if any.
+func ttlOverride(name string) (uint32, bool) {
+	for _, parent := range parentNames(name) {
+		if ttl, ok := ttlOverrides[parent]; ok {
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// cacheTTL tells how long to cache m for; maxAge is from the HTTP
+// headers, if not -1. The endpoint saying no-store (0) has the last
+// word; otherwise -min-ttl raises the DNS TTL, not the endpoint's
+// max-age.
+func cacheTTL(m *dnsMsg, maxAge int) (uint32, bool) {
+	if maxAge == 0 {
+		return 0, true
+	}
+	if len(m.Question) == 1 {
+		if ttl, ok := ttlOverride(m.Question[0].Name); ok {
+			return ttl, true
+		}
+	}
+	ttl, ok := m.minTTL()
+	ttl = clampTTL(ttl)
+	if maxAge > 0 && uint32(maxAge) < ttl {
+		ttl = uint32(maxAge)
+	}
+	return ttl, ok
+}
+
+func clampTTL(ttl uint32) uint32 {
+	if min := uint32(*ttlMin / time.Second); ttl < min {
+		ttl = min
+	}
+	if max := uint32(*ttlMax / time.Second); max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// clampTTLs applies the limits (or the override) to all records in
+// m.
+func clampTTLs(m *dnsMsg) {
+	override, ok := uint32(0), false
+	if len(m.Question) == 1 {
+		override, ok = ttlOverride(m.Question[0].Name)
+	}
+	for _, section := range m.sections() {
+		for i := range *section {
+			rr := &(*section)[i]
+			switch {
+			case rr.Type == typeOPT:
+			case ok:
+				rr.TTL = override
+			default:
+				rr.TTL = clampTTL(rr.TTL)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Blocking by query type, for everyone or some clients:
+//
+//	-block-type ANY,NULL                    REFUSED, for everyone
+//	-block-type HTTPS:nodata@192.168.1.50   an empty answer, for the
+//	                                        TV that chokes on HTTPS
+//	                                        records
+//
+// The action is refuse (the default) or nodata; the clients are an
+// address, a range, a MAC address, a client ID or a listener (see
+// clientid.go). For each query, the most specific matching
+// rule wins. -route TYPE=refuse predates this, and still works (for
+// everyone).
+
+var typeBlockFlags = &stringsFlag{}
+
+func init() {
+	typeBlockFlags.check = func(v string) error {
+		_, err := parseTypeBlock(v)
+		return err
+	}
+	flag.Var(typeBlockFlags, "block-type",
+		"Block queries by type: TYPE,...[:refuse|:nodata][@ADDRESS[/BITS]|@MAC|@id:NAME|@on:LISTENER] (repeatable)")
+}
+
+type typeBlock struct {
+	rule    string
+	types   map[uint16]bool
+	nodata  bool
+	clients *clientMatcher // nil for everyone
+	hits    int64
+}
+
+var typeBlocks []*typeBlock
+
+func parseTypeBlock(v string) (*typeBlock, error) {
+	b := &typeBlock{rule: v, types: map[uint16]bool{}}
+	spec := v
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		clients, err := parseClientMatcher(spec[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("-block-type %s: %v", v, err)
+		}
+		spec = spec[:i]
+		b.clients = &clients
+	}
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		switch spec[i+1:] {
+		case "refuse":
+		case "nodata":
+			b.nodata = true
+		default:
+			return nil, fmt.Errorf("-block-type %s: want refuse or nodata", v)
+		}
+		spec = spec[:i]
+	}
+	for _, t := range strings.Split(spec, ",") {
+		type_, err := typeNumber(strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("-block-type %s: %v", v, err)
+		}
+		b.types[type_] = true
+	}
+	return b, nil
+}
+
+func loadTypeBlocks() error {
+	typeBlocks = nil
+	for _, v := range typeBlockFlags.values {
+		b, err := parseTypeBlock(v)
+		if err != nil {
+			return err
+		}
+		typeBlocks = append(typeBlocks, b)
+	}
+	return nil
+}
+
+// matchTypeBlock finds the most specific rule blocking type_ for
+// client, if any, and counts the hit.
+func matchTypeBlock(type_ uint16, client net.Addr) *typeBlock {
+	if len(typeBlocks) == 0 {
+		return nil
+	}
+	var match *typeBlock
+	best := -1
+	for _, b := range typeBlocks {
+		if !b.types[type_] {
+			continue
+		}
+		bits := -2 // below on:NAME
+		if b.clients != nil {
+			if !b.clients.match(client) {
+				continue
+			}
+			bits = b.clients.specificity()
+		}
+		if match == nil || bits > best {
+			match, best = b, bits
+		}
+	}
+	if match != nil {
+		atomic.AddInt64(&match.hits, 1)
+	}
+	return match
+}
+
+// typeBlockStats is how often each rule fired.
+func typeBlockStats() map[string]int64 {
+	m := map[string]int64{}
+	for _, b := range typeBlocks {
+		m[b.rule] = atomic.LoadInt64(&b.hits)
+	}
+	return m
+}
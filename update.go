@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dynamic updates (RFC 2136) for a local zone, signed with TSIG (RFC
+// 8945), so that the DHCP server and devices can register their own
+// names:
+//
+//	gdoh -update-zone lan -update-key hmac-sha256:dhcp:BASE64SECRET
+//	nsupdate -y hmac-sha256:dhcp:BASE64SECRET <<EOF
+//	server 127.0.0.1
+//	zone lan
+//	update add laptop.lan 300 A 192.168.1.50
+//	send
+//	EOF
+//
+// The zone is answered from, authoritatively; names in it that
+// nobody registered are NXDOMAIN. Records are kept in -update-file.
+
+var updateZone = flag.String("update-zone", "",
+	"Local zone to accept signed dynamic updates for, e.g. lan")
+var updateFile = flag.String("update-file", "",
+	"File to keep the local zone's records in, across restarts")
+var updateKeys = &stringsFlag{}
+
+func init() {
+	updateKeys.check = func(v string) error {
+		// The secret may be a reference; that's for setup.
+		_, _, err := splitTSIGKey(v)
+		return err
+	}
+	flag.Var(updateKeys, "update-key",
+		"TSIG key for dynamic updates: [ALGORITHM:]NAME:BASE64SECRET, like nsupdate -y (repeatable)")
+}
+
+const (
+	opcodeUpdate = 5
+	typeTSIG     = 250
+	classNONE    = 254
+	classANY     = 255
+
+	rcodeYXDomain = 6
+	rcodeYXRRSet  = 7
+	rcodeNXRRSet  = 8
+	rcodeNotAuth  = 9
+	rcodeNotZone  = 10
+
+	// TSIG errors.
+	tsigBadSig  = 16
+	tsigBadKey  = 17
+	tsigBadTime = 18
+)
+
+// TTL of the zone's SOA, and NXDOMAIN answers.
+const updateSOATTL = 60
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+func parseTSIGKey(v string) (tsigKey, error) {
+	k, encoded, err := splitTSIGKey(v)
+	if err != nil {
+		return k, err
+	}
+	if encoded, err = secret(encoded); err != nil {
+		return k, fmt.Errorf("-update-key %s: %v", strings.TrimSuffix(k.name, "."), err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return k, fmt.Errorf("-update-key %s: %v", strings.TrimSuffix(k.name, "."), err)
+	}
+	k.secret = decoded
+	return k, nil
+}
+
+// splitTSIGKey is parseTSIGKey, but for the secret, returned as is.
+func splitTSIGKey(v string) (tsigKey, string, error) {
+	// The secret's the last part - unless it's a reference (see
+	// secret), which has colons of its own.
+	i := strings.LastIndex(v, ":")
+	if ref := secretRef(v); ref > 0 && v[ref-1] == ':' {
+		i = ref - 1
+	}
+	parts := []string{v}
+	if i >= 0 {
+		parts = append(strings.Split(v[:i], ":"), v[i+1:])
+	}
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 {
+		return tsigKey{}, "", fmt.Errorf("-update-key: want [ALGORITHM:]NAME:SECRET")
+	}
+	k := tsigKey{
+		name:      normalizeName(parts[1]),
+		algorithm: normalizeName(parts[0]),
+	}
+	if _, ok := tsigAlgorithms[k.algorithm]; !ok {
+		return k, "", fmt.Errorf("-update-key: unknown algorithm %s", parts[0])
+	}
+	return k, parts[2], nil
+}
+
+// zoneRecord is how records are kept in -update-file.
+type zoneRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data []byte `json:"data"`
+}
+
+type localZone struct {
+	sync.RWMutex
+	zone    string
+	keys    map[string]tsigKey
+	records map[string][]dnsRR // name -> records
+	serial  uint32
+}
+
+var dynamicZone = &localZone{
+	keys:    map[string]tsigKey{},
+	records: map[string][]dnsRR{},
+}
+
+func (z *localZone) load() error {
+	if *updateZone == "" {
+		return nil
+	}
+	z.zone = normalizeName(*updateZone)
+	z.serial = uint32(time.Now().Unix())
+	for _, v := range updateKeys.values {
+		k, err := parseTSIGKey(v)
+		if err != nil {
+			return err
+		}
+		z.keys[k.name] = k
+	}
+	if len(z.keys) == 0 {
+		return fmt.Errorf("-update-zone needs an -update-key")
+	}
+	if *updateFile == "" {
+		return nil
+	}
+	f, err := os.Open(*updateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var zr zoneRecord
+		if err := json.Unmarshal(s.Bytes(), &zr); err != nil {
+			return fmt.Errorf("%s: %v", *updateFile, err)
+		}
+		type_, err := typeNumber(zr.Type)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *updateFile, err)
+		}
+		z.add(dnsRR{Name: zr.Name, Type: type_, TTL: zr.TTL, Data: zr.Data})
+	}
+	return s.Err()
+}
+
+// save writes the records out; called with the lock held.
+func (z *localZone) save() error {
+	if *updateFile == "" {
+		return nil
+	}
+	tmp := *updateFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rrs := range z.records {
+		for _, rr := range rrs {
+			enc.Encode(zoneRecord{rr.Name, typeName(rr.Type), rr.TTL, rr.Data})
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *updateFile)
+}
+
+// inZone tells if name is the zone, or under it.
+func (z *localZone) inZone(name string) bool {
+	name = normalizeName(name)
+	return z.zone != "" && (name == z.zone || strings.HasSuffix(name, "."+z.zone))
+}
+
+func (z *localZone) soa() dnsRR {
+	host, _ := os.Hostname()
+	data := appendName(nil, normalizeName(host))
+	data = appendName(data, "hostmaster."+z.zone)
+	for _, n := range []uint32{z.serial, 3600, 600, 86400, updateSOATTL} {
+		data = binary.BigEndian.AppendUint32(data, n)
+	}
+	return dnsRR{Name: z.zone, Type: typeSOA, Class: classINET,
+		TTL: updateSOATTL, Data: data}
+}
+
+// answer answers questions about the zone.
+func (z *localZone) answer(q *dnsMsg) (*dnsMsg, bool) {
+	question := q.Question[0]
+	if question.Class != classINET || !z.inZone(question.Name) {
+		return nil, false
+	}
+	z.RLock()
+	defer z.RUnlock()
+	name := normalizeName(question.Name)
+	r := reply(q, rcodeSuccess)
+	r.Flags |= flagAA
+	if name == z.zone && (question.Type == typeSOA || question.Type == typeANY) {
+		soa := z.soa()
+		soa.Name = question.Name
+		r.Answer = append(r.Answer, soa)
+	}
+	rrs, ok := z.records[name]
+	for _, rr := range rrs {
+		if question.Type == rr.Type || question.Type == typeANY {
+			rr.Name = question.Name
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	if !ok && name != z.zone {
+		r.setRcode(rcodeNXDomain)
+	}
+	if len(r.Answer) == 0 {
+		r.Authority = []dnsRR{z.soa()}
+	}
+	return r, true
+}
+
+// add adds rr, replacing an identical record (down to the TTL);
+// called with the lock held.
+func (z *localZone) add(rr dnsRR) {
+	rr.Name = normalizeName(rr.Name)
+	rr.Class = classINET
+	rrs := z.records[rr.Name]
+	for i := range rrs {
+		if sameRR(rrs[i], rr) {
+			rrs[i] = rr
+			return
+		}
+	}
+	z.records[rr.Name] = append(rrs, rr)
+}
+
+// remove removes the records of name that match; called with the
+// lock held.
+func (z *localZone) remove(name string, match func(dnsRR) bool) {
+	name = normalizeName(name)
+	kept := []dnsRR{}
+	for _, rr := range z.records[name] {
+		if !match(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	if len(kept) == 0 {
+		delete(z.records, name)
+	} else {
+		z.records[name] = kept
+	}
+}
+
+func sameRR(a, b dnsRR) bool {
+	return normalizeName(a.Name) == normalizeName(b.Name) &&
+		a.Type == b.Type && string(a.Data) == string(b.Data)
+}
+
+// update handles an UPDATE message.
+func (z *localZone) update(query []byte, client net.Addr) []byte {
+	q, err := parseMsg(query)
+	if err != nil {
+		return failure(query, rcodeFormErr)
+	}
+	if z.zone == "" {
+		return reply(q, rcodeNotImp).pack()
+	}
+	r := &dnsMsg{
+		ID:       q.ID,
+		Flags:    flagQR | q.Flags&(0xf<<11),
+		Question: q.Question,
+	}
+	key, request, tsig, err := z.verify(query, q)
+	if err != nil {
+		log.Printf("update error: %s: %s", client, err.Error())
+		r.setRcode(rcodeNotAuth)
+		return r.pack()
+	}
+	if tsig.err != 0 {
+		log.Printf("update error: %s: TSIG error %d", client, tsig.err)
+		r.setRcode(rcodeNotAuth)
+		if tsig.err == tsigBadTime {
+			return signResponse(r, key, tsig, request)
+		}
+		return appendTSIG(r.pack(), tsig, nil)
+	}
+	rcode := z.apply(q)
+	if rcode == rcodeSuccess {
+		log.Printf("update: %s (key %s) updated %s", client, key.name, z.zone)
+	}
+	r.setRcode(rcode)
+	return signResponse(r, key, tsig, request)
+}
+
+// apply checks the prerequisites, and makes the updates, all or
+// nothing (RFC 2136, 3.2-3.4).
+func (z *localZone) apply(q *dnsMsg) int {
+	if len(q.Question) != 1 || q.Question[0].Type != typeSOA {
+		return rcodeFormErr
+	}
+	if normalizeName(q.Question[0].Name) != z.zone {
+		return rcodeNotAuth
+	}
+	z.Lock()
+	defer z.Unlock()
+	for _, rr := range q.Answer {
+		if rcode := z.prerequisite(rr, q.Answer); rcode != rcodeSuccess {
+			return rcode
+		}
+	}
+	for _, rr := range q.Authority {
+		if !z.inZone(rr.Name) {
+			return rcodeNotZone
+		}
+		switch {
+		case rr.Class == classINET,
+			rr.Class == classANY && rr.TTL == 0 && len(rr.Data) == 0,
+			rr.Class == classNONE && rr.TTL == 0 && rr.Type != typeANY:
+		default:
+			return rcodeFormErr
+		}
+		if rr.Type == typeSOA || rr.Type == typeNS {
+			// Not ours to change, we make those up.
+			return rcodeRefused
+		}
+	}
+	for _, rr := range q.Authority {
+		rr := rr
+		switch rr.Class {
+		case classINET:
+			z.add(rr)
+		case classANY:
+			z.remove(rr.Name, func(old dnsRR) bool {
+				return rr.Type == typeANY || old.Type == rr.Type
+			})
+		case classNONE:
+			z.remove(rr.Name, func(old dnsRR) bool { return sameRR(old, rr) })
+		}
+	}
+	if len(q.Authority) > 0 {
+		z.serial++
+		if err := z.save(); err != nil {
+			log.Printf("update error: %s", err.Error())
+		}
+	}
+	return rcodeSuccess
+}
+
+// prerequisite checks one prerequisite record (RFC 2136, 3.2).
+func (z *localZone) prerequisite(rr dnsRR, all []dnsRR) int {
+	if rr.TTL != 0 {
+		return rcodeFormErr
+	}
+	if !z.inZone(rr.Name) {
+		return rcodeNotZone
+	}
+	rrs, exists := z.records[normalizeName(rr.Name)]
+	hasType := false
+	for _, old := range rrs {
+		hasType = hasType || old.Type == rr.Type
+	}
+	switch {
+	case rr.Class == classANY && rr.Type == typeANY:
+		if !exists {
+			return rcodeNXDomain
+		}
+	case rr.Class == classANY:
+		if !hasType {
+			return rcodeNXRRSet
+		}
+	case rr.Class == classNONE && rr.Type == typeANY:
+		if exists {
+			return rcodeYXDomain
+		}
+	case rr.Class == classNONE:
+		if hasType {
+			return rcodeYXRRSet
+		}
+	case rr.Class == classINET:
+		// The RRset must be exactly what's listed.
+		want := 0
+		for _, other := range all {
+			if other.Class == classINET && sameRRSet(other, rr) {
+				want++
+				if !z.has(other) {
+					return rcodeNXRRSet
+				}
+			}
+		}
+		have := 0
+		for _, old := range rrs {
+			if old.Type == rr.Type {
+				have++
+			}
+		}
+		if have != want {
+			return rcodeNXRRSet
+		}
+	default:
+		return rcodeFormErr
+	}
+	return rcodeSuccess
+}
+
+func sameRRSet(a, b dnsRR) bool {
+	return normalizeName(a.Name) == normalizeName(b.Name) && a.Type == b.Type
+}
+
+func (z *localZone) has(rr dnsRR) bool {
+	for _, old := range z.records[normalizeName(rr.Name)] {
+		if sameRR(old, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TSIG
+
+type tsigRecord struct {
+	name       string
+	algorithm  string
+	timeSigned uint64
+	fudge      uint16
+	mac        []byte
+	originalID uint16
+	err        uint16
+	other      []byte
+}
+
+func parseTSIG(rr dnsRR) (tsigRecord, error) {
+	t := tsigRecord{name: normalizeName(rr.Name)}
+	d := rr.Data
+	algorithm, off, err := readName(d, 0)
+	if err != nil || off+10 > len(d) {
+		return t, ErrMessage
+	}
+	t.algorithm = normalizeName(algorithm)
+	t.timeSigned = uint64(binary.BigEndian.Uint16(d[off:]))<<32 |
+		uint64(binary.BigEndian.Uint32(d[off+2:]))
+	t.fudge = binary.BigEndian.Uint16(d[off+6:])
+	n := int(binary.BigEndian.Uint16(d[off+8:]))
+	off += 10
+	if off+n+6 > len(d) {
+		return t, ErrMessage
+	}
+	t.mac = d[off : off+n]
+	off += n
+	t.originalID = binary.BigEndian.Uint16(d[off:])
+	t.err = binary.BigEndian.Uint16(d[off+2:])
+	n = int(binary.BigEndian.Uint16(d[off+4:]))
+	off += 6
+	if off+n > len(d) {
+		return t, ErrMessage
+	}
+	t.other = d[off : off+n]
+	return t, nil
+}
+
+// variables are the TSIG fields that go into the MAC, after the
+// message (RFC 8945, 4.3.3).
+func (t tsigRecord) variables() []byte {
+	b := appendName(nil, strings.ToLower(t.name))
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = appendName(b, strings.ToLower(t.algorithm))
+	b = binary.BigEndian.AppendUint16(b, uint16(t.timeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.timeSigned))
+	b = binary.BigEndian.AppendUint16(b, t.fudge)
+	b = binary.BigEndian.AppendUint16(b, t.err)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.other)))
+	return append(b, t.other...)
+}
+
+func (t tsigRecord) rdata() []byte {
+	b := appendName(nil, t.algorithm)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.timeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.timeSigned))
+	b = binary.BigEndian.AppendUint16(b, t.fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.mac)))
+	b = append(b, t.mac...)
+	b = binary.BigEndian.AppendUint16(b, t.originalID)
+	b = binary.BigEndian.AppendUint16(b, t.err)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.other)))
+	return append(b, t.other...)
+}
+
+// stripTSIG returns the message as it was before the TSIG record was
+// added: without it, and with the original ID.
+func stripTSIG(query []byte, q *dnsMsg, originalID uint16) ([]byte, error) {
+	off := 12
+	for range q.Question {
+		_, next, err := readName(query, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	records := len(q.Answer) + len(q.Authority) + len(q.Additional) - 1
+	for i := 0; i < records; i++ {
+		_, next, err := readRR(query, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+	}
+	b := append([]byte{}, query[:off]...)
+	binary.BigEndian.PutUint16(b, originalID)
+	binary.BigEndian.PutUint16(b[10:], uint16(len(q.Additional)-1))
+	return b, nil
+}
+
+// verify checks the request's TSIG; the returned record has err set
+// if it's signed, but not right.
+func (z *localZone) verify(query []byte, q *dnsMsg) (tsigKey, tsigRecord, tsigRecord, error) {
+	var key tsigKey
+	var t tsigRecord
+	n := len(q.Additional)
+	if n == 0 || q.Additional[n-1].Type != typeTSIG {
+		return key, t, t, fmt.Errorf("not signed")
+	}
+	t, err := parseTSIG(q.Additional[n-1])
+	if err != nil {
+		return key, t, t, err
+	}
+	request := t
+	key, ok := z.keys[t.name]
+	if !ok || key.algorithm != t.algorithm {
+		t.err, t.mac = tsigBadKey, nil
+		return key, request, t, nil
+	}
+	msg, err := stripTSIG(query, q, t.originalID)
+	if err != nil {
+		return key, request, t, err
+	}
+	mac := hmac.New(tsigAlgorithms[key.algorithm], key.secret)
+	mac.Write(msg)
+	mac.Write(t.variables())
+	if !hmac.Equal(mac.Sum(nil), t.mac) {
+		t.err, t.mac = tsigBadSig, nil
+		return key, request, t, nil
+	}
+	now := uint64(time.Now().Unix())
+	if now > t.timeSigned+uint64(t.fudge) || t.timeSigned > now+uint64(t.fudge) {
+		t.err = tsigBadTime
+		// The client gets our time, to see how far off it is.
+		t.other = binary.BigEndian.AppendUint16(nil, uint16(now>>32))
+		t.other = binary.BigEndian.AppendUint32(t.other, uint32(now))
+	}
+	return key, request, t, nil
+}
+
+// signResponse packs r, signed with key (RFC 8945, 5.3).
+func signResponse(r *dnsMsg, key tsigKey, t, request tsigRecord) []byte {
+	if t.err != tsigBadTime {
+		t.timeSigned = uint64(time.Now().Unix())
+	}
+	t.originalID = r.ID
+	msg := r.pack()
+	mac := hmac.New(tsigAlgorithms[key.algorithm], key.secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(request.mac))))
+	mac.Write(request.mac)
+	mac.Write(msg)
+	mac.Write(t.variables())
+	return appendTSIG(msg, t, mac.Sum(nil))
+}
+
+// appendTSIG adds the TSIG record to a packed message.
+func appendTSIG(msg []byte, t tsigRecord, mac []byte) []byte {
+	t.mac = mac
+	rr := dnsRR{Name: t.name, Type: typeTSIG, Class: classANY, Data: t.rdata()}
+	b := appendName(msg, rr.Name)
+	b = binary.BigEndian.AppendUint16(b, rr.Type)
+	b = binary.BigEndian.AppendUint16(b, rr.Class)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+	b = append(b, rr.Data...)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+// An UPDATE adding host.lan. 300 A 192.168.1.10 to lan., signed with
+// hmac-sha256 key dhcp. at 1792000000 (fudge 300), put together from
+// RFC 8945 (4.3.3, 5.1) with Python's hmac, not gdoh's code.
+const (
+	testTSIGUpdate = "2a2a28000001000000010001036c616e000006000104686f7374036c616e0000010001" +
+		"0000012c0004c0a8010a04646863700000fa00ff00000000003d0b686d61632d73686132" +
+		"35360000006acfc000012c0020562608a0e21641475a98595d84666c651fabb4069e8ec7" +
+		"4fab33062af5c171482a2a00000000"
+	testTSIGMAC = "562608a0e21641475a98595d84666c651fabb4069e8ec74fab33062af5c17148"
+)
+
+func testZone(t *testing.T, keys ...string) *localZone {
+	z := &localZone{zone: "lan.", keys: map[string]tsigKey{}, records: map[string][]dnsRR{}}
+	for _, v := range keys {
+		k, err := parseTSIGKey(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.keys[k.name] = k
+	}
+	return z
+}
+
+// tsigDigest is what RFC 8945 says goes into the MAC: the request's
+// MAC (for a response), the message as it was before signing, and
+// the TSIG variables.
+func tsigDigest(requestMAC, msg []byte, keyName, algorithm string, timeSigned uint64, fudge uint16) []byte {
+	var b bytes.Buffer
+	if requestMAC != nil {
+		binary.Write(&b, binary.BigEndian, uint16(len(requestMAC)))
+		b.Write(requestMAC)
+	}
+	b.Write(msg)
+	b.Write(appendName(nil, keyName))
+	binary.Write(&b, binary.BigEndian, []uint16{classANY, 0, 0})
+	b.Write(appendName(nil, algorithm))
+	binary.Write(&b, binary.BigEndian, []uint16{uint16(timeSigned >> 32)})
+	binary.Write(&b, binary.BigEndian, []uint32{uint32(timeSigned)})
+	binary.Write(&b, binary.BigEndian, []uint16{fudge, 0, 0})
+	return b.Bytes()
+}
+
+func testTSIGQuery(t *testing.T, hexQuery string) ([]byte, *dnsMsg) {
+	query, err := hex.DecodeString(hexQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := parseMsg(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query, q
+}
+
+func TestTSIGVector(t *testing.T) {
+	query, q := testTSIGQuery(t, testTSIGUpdate)
+	z := testZone(t, "hmac-sha256:dhcp:"+testTSIGSecret)
+	key, request, result, err := z.verify(query, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.name != "dhcp." || hex.EncodeToString(request.mac) != testTSIGMAC {
+		t.Fatalf("key %s, MAC %x", key.name, request.mac)
+	}
+	// The MAC checks out; the time, long gone, doesn't.
+	if result.err != tsigBadTime {
+		t.Errorf("error %d, want BADTIME (%d)", result.err, tsigBadTime)
+	}
+	if len(result.other) != 6 {
+		t.Errorf("BADTIME without the server's time: %x", result.other)
+	}
+}
+
+func TestTSIGVectorTampered(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys []string
+		edit func([]byte)
+		want uint16
+	}{
+		// The A record's last byte: 192.168.1.11.
+		{"data", []string{"hmac-sha256:dhcp:" + testTSIGSecret},
+			func(b []byte) { b[44]++ }, tsigBadSig},
+		// The MAC's first byte.
+		{"MAC", []string{"hmac-sha256:dhcp:" + testTSIGSecret},
+			func(b []byte) { b[len(b)-6-32]++ }, tsigBadSig},
+		// The fudge, which is signed too.
+		{"fudge", []string{"hmac-sha256:dhcp:" + testTSIGSecret},
+			func(b []byte) { b[len(b)-6-32-3]++ }, tsigBadSig},
+		{"secret", []string{"hmac-sha256:dhcp:c2VjcmV0"}, nil, tsigBadSig},
+		{"key name", []string{"hmac-sha256:dhcp2:" + testTSIGSecret}, nil, tsigBadKey},
+		{"algorithm", []string{"hmac-sha1:dhcp:" + testTSIGSecret}, nil, tsigBadKey},
+	} {
+		query, _ := testTSIGQuery(t, testTSIGUpdate)
+		if tc.edit != nil {
+			tc.edit(query)
+		}
+		q, err := parseMsg(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, result, err := testZone(t, tc.keys...).verify(query, q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.err != tc.want {
+			t.Errorf("%s: error %d, want %d", tc.name, result.err, tc.want)
+		}
+		if result.mac != nil {
+			t.Errorf("%s: MAC %x, want none", tc.name, result.mac)
+		}
+	}
+}
+
+func TestTSIGSigned(t *testing.T) {
+	secret, _ := base64.StdEncoding.DecodeString(testTSIGSecret)
+	query, q := testTSIGQuery(t, testTSIGUpdate)
+	// The vector, signed again, now.
+	unsigned, err := stripTSIG(query, q, q.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(time.Now().Unix())
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(tsigDigest(nil, unsigned, "dhcp.", "hmac-sha256.", now, 300))
+	tsig := tsigRecord{name: "dhcp.", algorithm: "hmac-sha256.", timeSigned: now,
+		fudge: 300, originalID: q.ID}
+	query = appendTSIG(unsigned, tsig, mac.Sum(nil))
+	if q, err = parseMsg(query); err != nil {
+		t.Fatal(err)
+	}
+	z := testZone(t, "hmac-sha256:dhcp:"+testTSIGSecret)
+	key, request, result, err := z.verify(query, q)
+	if err != nil || result.err != 0 {
+		t.Fatalf("error %v, TSIG error %d", err, result.err)
+	}
+
+	// And the response: the request's MAC goes in first (5.3.1).
+	resp := signResponse(reply(q, rcodeSuccess), key, result, request)
+	r, err := parseMsg(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := parseTSIG(r.Additional[len(r.Additional)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err = stripTSIG(resp, r, rt.originalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(tsigDigest(request.mac, unsigned, "dhcp.", "hmac-sha256.", rt.timeSigned, rt.fudge))
+	if !hmac.Equal(mac.Sum(nil), rt.mac) {
+		t.Errorf("response MAC %x, want %x", rt.mac, mac.Sum(nil))
+	}
+}
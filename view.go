@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Views, split-horizon style: clients in a view get its local records,
+// and forwarding rules, before everyone's. Say, the internal names
+// only for the LAN:
+//
+//	-view lan=192.168.1.0/24,on:lan
+//	-view-address lan=/intranet.example/192.168.1.20
+//	-view-forward lan=corp.example=dns:192.168.1.1
+//
+// The clients are as for -policy: addresses, ranges, MAC addresses,
+// id:NAME and on:LISTENER (see clientid.go); for each query, the most
+// specific view wins. -view-address takes what -address does, and
+// -view-forward what -forward does.
+
+var viewFlags = &stringsFlag{}
+var viewAddressFlags = &stringsFlag{}
+var viewForwardFlags = &stringsFlag{}
+
+func init() {
+	viewFlags.check = func(v string) error {
+		_, err := parseView(v)
+		return err
+	}
+	viewAddressFlags.check = func(v string) error {
+		_, rule, err := splitViewRule("-view-address", v)
+		if err == nil {
+			err = newAddressRules().load([]string{rule})
+		}
+		return err
+	}
+	viewForwardFlags.check = func(v string) error {
+		_, rule, err := splitViewRule("-view-forward", v)
+		if err == nil {
+			err = forwardRules{}.load([]string{rule})
+		}
+		return err
+	}
+	flag.Var(viewFlags, "view",
+		"View, for some clients: NAME=ADDRESS[/BITS]|MAC|id:NAME|on:LISTENER,... (repeatable)")
+	flag.Var(viewAddressFlags, "view-address",
+		"Fixed address, in a view: VIEW=/DOMAIN/[ADDRESS|#], as for -address (repeatable)")
+	flag.Var(viewForwardFlags, "view-forward",
+		"Route queries by domain, in a view: VIEW=DOMAIN,...=DESTINATION, as for -forward (repeatable)")
+}
+
+type view struct {
+	name      string
+	clients   []clientMatcher
+	addresses addressRules
+	forwards  forwardRules
+}
+
+var views []*view
+
+func parseView(v string) (*view, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("-view %s: want NAME=CLIENT,...", v)
+	}
+	vw := &view{name: parts[0], addresses: newAddressRules(), forwards: forwardRules{}}
+	for _, c := range strings.Split(parts[1], ",") {
+		m, err := parseClientMatcher(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("-view %s: %v", v, err)
+		}
+		vw.clients = append(vw.clients, m)
+	}
+	return vw, nil
+}
+
+// splitViewRule splits VIEW=RULE.
+func splitViewRule(flagName, v string) (name, rule string, err error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%s %s: want VIEW=RULE", flagName, v)
+	}
+	return parts[0], parts[1], nil
+}
+
+func loadViews() error {
+	byName := map[string]*view{}
+	for _, v := range viewFlags.values {
+		vw, err := parseView(v)
+		if err != nil {
+			return err
+		}
+		if byName[vw.name] != nil {
+			return fmt.Errorf("-view %s: there's already a view %s", v, vw.name)
+		}
+		byName[vw.name] = vw
+		views = append(views, vw)
+	}
+	find := func(flagName, v string) (*view, string, error) {
+		name, rule, err := splitViewRule(flagName, v)
+		if err != nil {
+			return nil, "", err
+		}
+		vw := byName[name]
+		if vw == nil {
+			return nil, "", fmt.Errorf("%s %s: no view %s", flagName, v, name)
+		}
+		return vw, rule, nil
+	}
+	for _, v := range viewAddressFlags.values {
+		vw, rule, err := find("-view-address", v)
+		if err != nil {
+			return err
+		}
+		if err := vw.addresses.load([]string{rule}); err != nil {
+			return fmt.Errorf("view %s: %v", vw.name, err)
+		}
+	}
+	for _, v := range viewForwardFlags.values {
+		vw, rule, err := find("-view-forward", v)
+		if err != nil {
+			return err
+		}
+		if err := vw.forwards.load([]string{rule}); err != nil {
+			return fmt.Errorf("view %s: %v", vw.name, err)
+		}
+	}
+	return nil
+}
+
+// viewFor finds the most specific view client is in, if any.
+func viewFor(client net.Addr) *view {
+	var match *view
+	best := 0
+	for _, vw := range views {
+		for _, m := range vw.clients {
+			if !m.match(client) {
+				continue
+			}
+			if s := m.specificity(); match == nil || s > best {
+				match, best = vw, s
+			}
+		}
+	}
+	return match
+}
+
+// forwardFor finds the -view-forward, -vpn-forward (of a connected
+// VPN) or -forward route for name, and tells which one it is, and the
+// cache it goes in: the view's own, the VPN's, or the usual one.
+func (vw *view) forwardFor(name, upstream string) (*route, string, string) {
+	if vw != nil {
+		if domain, rt := vw.forwards.match(name); rt != nil {
+			return rt, "-view-forward " + vw.name + "=" + domain, "view " + vw.name
+		}
+	}
+	if rt, rule, partition := vpns.match(name); rt != nil {
+		return rt, rule, partition
+	}
+	if domain, rt := forwards.match(name); rt != nil {
+		return rt, "-forward " + domain, upstream
+	}
+	return nil, "", upstream
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Split DNS for a VPN: while it's connected, its domains go to its
+// resolver, and when it's not, the usual way (where they presumably
+// don't resolve, or not to anything useful):
+//
+//	-vpn corp=tun0
+//	-vpn-forward corp=corp.example,10.in-addr.arpa=dns:10.8.0.1
+//
+// gdoh looks at the interface every couple of seconds: up, with an
+// address, is connected. Without an interface (-vpn corp=), or to beat
+// the polling to it, the VPN's up and down scripts can say so
+// themselves, over the admin API - with the resolver the VPN pushed,
+// even, in place of the configured ones:
+//
+//	gdoh vpn corp up 10.8.0.1
+//	gdoh vpn corp down
+//
+// That holds until the interface next changes. A VPN's answers are
+// cached apart from everyone else's, and forgotten each time it
+// connects, or disconnects.
+
+var vpnFlags = &stringsFlag{}
+var vpnForwardFlags = &stringsFlag{}
+
+func init() {
+	vpnFlags.check = func(v string) error {
+		_, _, err := parseVPN(v)
+		return err
+	}
+	vpnForwardFlags.check = func(v string) error {
+		_, rule, err := splitViewRule("-vpn-forward", v)
+		if err == nil {
+			err = forwardRules{}.load([]string{rule})
+		}
+		return err
+	}
+	flag.Var(vpnFlags, "vpn",
+		"VPN, for split DNS: NAME=INTERFACE, or NAME= to only switch it over the admin API (repeatable)")
+	flag.Var(vpnForwardFlags, "vpn-forward",
+		"Route queries by domain while a VPN is up: VPN=DOMAIN,...=DESTINATION, as for -forward (repeatable)")
+}
+
+// How often to look at the VPN interfaces.
+const vpnPollInterval = 2 * time.Second
+
+type vpn struct {
+	name     string
+	iface    string
+	forwards forwardRules
+	// Guarded by vpns:
+	up      bool
+	since   time.Time
+	server  *route // the admin API's resolver, if it gave one
+	ifaceUp bool   // as of the last look
+}
+
+type vpnTable struct {
+	sync.RWMutex
+	list []*vpn
+}
+
+var vpns = &vpnTable{}
+
+func parseVPN(v string) (name, iface string, err error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("-vpn %s: want NAME=INTERFACE, or NAME=", v)
+	}
+	return parts[0], parts[1], nil
+}
+
+func loadVPNs() error {
+	byName := map[string]*vpn{}
+	for _, v := range vpnFlags.values {
+		name, iface, err := parseVPN(v)
+		if err != nil {
+			return err
+		}
+		if byName[name] != nil {
+			return fmt.Errorf("-vpn %s: there's already a VPN %s", v, name)
+		}
+		vp := &vpn{name: name, iface: iface, forwards: forwardRules{}}
+		byName[name] = vp
+		vpns.list = append(vpns.list, vp)
+	}
+	for _, v := range vpnForwardFlags.values {
+		name, rule, err := splitViewRule("-vpn-forward", v)
+		if err != nil {
+			return err
+		}
+		vp := byName[name]
+		if vp == nil {
+			return fmt.Errorf("-vpn-forward %s: no VPN %s", v, name)
+		}
+		if err := vp.forwards.load([]string{rule}); err != nil {
+			return fmt.Errorf("VPN %s: %v", name, err)
+		}
+	}
+	for _, vp := range vpns.list {
+		if len(vp.forwards) == 0 {
+			return fmt.Errorf("-vpn %s: no -vpn-forward %s=...", vp.name, vp.name)
+		}
+	}
+	vpns.poll()
+	return nil
+}
+
+// interfaceUp tells whether the interface is there, up, and has an
+// address.
+func interfaceUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	return err == nil && len(addrs) > 0
+}
+
+func (vs *vpnTable) find(name string) *vpn {
+	for _, vp := range vs.list {
+		if vp.name == name {
+			return vp
+		}
+	}
+	return nil
+}
+
+// poll switches the VPNs whose interfaces came up, or went down, since
+// the last look.
+func (vs *vpnTable) poll() {
+	for _, vp := range vs.list {
+		if vp.iface == "" {
+			continue
+		}
+		up := interfaceUp(vp.iface)
+		vs.Lock()
+		changed := up != vp.ifaceUp
+		vp.ifaceUp = up
+		vs.Unlock()
+		if changed {
+			vp.set(up, nil, "interface "+vp.iface)
+		}
+	}
+}
+
+func (vs *vpnTable) run() {
+	if len(vs.list) == 0 {
+		return
+	}
+	for range backgroundTick(vpnPollInterval) {
+		vs.poll()
+	}
+}
+
+// set connects, or disconnects, the VPN: server is the resolver to use
+// instead of the configured ones, if any; why goes in the log.
+func (vp *vpn) set(up bool, server *route, why string) {
+	vpns.Lock()
+	changed := up != vp.up
+	if up && !changed && serverOf(server) != serverOf(vp.server) {
+		// Same VPN, new resolver: the old one's answers go, too.
+		changed, why = true, why+", resolver "+serverOf(server)
+	}
+	vp.up, vp.server = up, server
+	if changed {
+		vp.since = time.Now()
+	}
+	vpns.Unlock()
+	if !changed {
+		return
+	}
+	n := responseCache.flushUpstream(vp.partition())
+	state := "down"
+	if up {
+		state = "up"
+	}
+	log.Printf("VPN %s is %s (%s); %d cached answers forgotten", vp.name, state, why, n)
+}
+
+// serverOf names rt's plain DNS server, if rt is one.
+func serverOf(rt *route) string {
+	if rt == nil {
+		return "(configured)"
+	}
+	return rt.server
+}
+
+// partition is the cache the VPN's answers go in.
+func (vp *vpn) partition() string {
+	return "vpn " + vp.name
+}
+
+// match finds the route for name through a connected VPN, if there's
+// one: the most specific domain wins, then the first VPN.
+func (vs *vpnTable) match(name string) (*route, string, string) {
+	vs.RLock()
+	defer vs.RUnlock()
+	if len(vs.list) == 0 {
+		return nil, "", ""
+	}
+	for _, parent := range parentNames(name) {
+		for _, vp := range vs.list {
+			if !vp.up {
+				continue
+			}
+			if rt, ok := vp.forwards[parent]; ok {
+				if vp.server != nil {
+					rt = vp.server
+				}
+				return rt, "-vpn-forward " + vp.name + "=" + parent, vp.partition()
+			}
+		}
+	}
+	return nil, "", ""
+}
+
+type vpnStatus struct {
+	Name      string    `json:"name"`
+	Interface string    `json:"interface,omitempty"`
+	Up        bool      `json:"up"`
+	Since     time.Time `json:"since"`
+	Server    string    `json:"server,omitempty"`
+	Domains   []string  `json:"domains"`
+}
+
+func (vs *vpnTable) status() []vpnStatus {
+	vs.RLock()
+	defer vs.RUnlock()
+	list := []vpnStatus{}
+	for _, vp := range vs.list {
+		s := vpnStatus{Name: vp.name, Interface: vp.iface, Up: vp.up,
+			Since: vp.since, Domains: []string{}}
+		if vp.server != nil {
+			s.Server = vp.server.server
+		}
+		for domain := range vp.forwards {
+			s.Domains = append(s.Domains, domain)
+		}
+		sort.Strings(s.Domains)
+		list = append(list, s)
+	}
+	return list
+}
+
+func vpnMetrics() []metric {
+	ms := []metric{}
+	for _, s := range vpns.status() {
+		up := 0.0
+		if s.Up {
+			up = 1
+		}
+		ms = append(ms, metric{"gdoh_vpn_up", "gauge",
+			"1 while the VPN is connected, and its domains go to its resolver.",
+			fmt.Sprintf("{vpn=%q}", s.Name), up})
+	}
+	return ms
+}
+
+// adminVPN lists the VPNs, or switches one: name, up, and optionally
+// server (plain DNS, ADDRESS[:PORT]).
+func adminVPN(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		vp := vpns.find(r.FormValue("name"))
+		if vp == nil {
+			http.Error(w, "No such VPN", http.StatusNotFound)
+			return
+		}
+		up, err := strconv.ParseBool(r.FormValue("up"))
+		if err != nil {
+			http.Error(w, "Bad value for up", http.StatusBadRequest)
+			return
+		}
+		var server *route
+		if s := r.FormValue("server"); s != "" && up {
+			if server, err = parseDestination("dns:" + s); err != nil {
+				http.Error(w, "Bad value for server", http.StatusBadRequest)
+				return
+			}
+		}
+		vp.set(up, server, "admin API")
+	}
+	writeJSON(w, vpns.status())
+}
+
+func vpnCommand(args []string) error {
+	params := url.Values{}
+	method := "GET"
+	switch {
+	case len(args) == 0:
+	case len(args) >= 2 && len(args) <= 3 && args[1] == "up":
+		params.Set("up", "true")
+		if len(args) == 3 {
+			params.Set("server", args[2])
+		}
+	case len(args) == 2 && args[1] == "down":
+		params.Set("up", "false")
+	default:
+		return errors.New("Usage: gdoh vpn [NAME up [ADDRESS] | NAME down]")
+	}
+	if len(args) > 0 {
+		method = "POST"
+		params.Set("name", args[0])
+	}
+	body, err := adminCall(method, "/api/vpn", params)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	return nil
+}
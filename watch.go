@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query-match alerts: raise an alert when someone asks for a name on
+// the watchlist - known C2 domains, canary tokens, and alike.
+//
+// A rule is either a domain (which also matches its subdomains), a
+// glob ("*.canary.example.net"), or a regular expression prefixed
+// with "~" ("~^[a-z0-9]{32}\.example\.com\.$"). Names are matched
+// lowercase and fully qualified, with the trailing dot.
+
+var alertOn = &stringsFlag{}
+var alertLists = &stringsFlag{}
+
+func init() {
+	alertOn.check = func(v string) error {
+		return newWatchlist().load([]string{v}, nil)
+	}
+	alertLists.check = checkFile
+	flag.Var(alertOn, "alert-on",
+		"Alert when a name matching this domain, glob, or ~regexp is queried (repeatable)")
+	flag.Var(alertLists, "alert-list",
+		"Alert when a domain from this file is queried; same format as -block (repeatable)")
+}
+
+// Don't repeat an alert for the same client and name more often than
+// this.
+const watchQuiet = time.Minute
+
+type watchRule struct {
+	pattern string
+	glob    string
+	re      *regexp.Regexp
+}
+
+type watchlist struct {
+	sync.Mutex
+	domains map[string]string // domain -> source
+	rules   []watchRule
+	// (client, name) -> last alert
+	seen map[[2]string]time.Time
+}
+
+var watched = newWatchlist()
+
+func newWatchlist() *watchlist {
+	return &watchlist{
+		domains: map[string]string{},
+		seen:    map[[2]string]time.Time{},
+	}
+}
+
+func (wl *watchlist) load(patterns, lists []string) error {
+	for _, p := range patterns {
+		switch {
+		case strings.HasPrefix(p, "~"):
+			re, err := regexp.Compile(p[1:])
+			if err != nil {
+				return fmt.Errorf("-alert-on %s: %v", p, err)
+			}
+			wl.rules = append(wl.rules, watchRule{pattern: p, re: re})
+		case strings.Contains(p, "*") || strings.Contains(p, "?"):
+			glob := normalizeName(p)
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("-alert-on %s: %v", p, err)
+			}
+			wl.rules = append(wl.rules, watchRule{pattern: p, glob: glob})
+		default:
+			wl.domains[normalizeName(p)] = p
+		}
+	}
+	for _, list := range lists {
+		domains, err := readBlocklist(list)
+		if err != nil {
+			return err
+		}
+		for domain := range domains {
+			wl.domains[domain] = list
+		}
+	}
+	return nil
+}
+
+// match returns the rule (or list) matching name, if any.
+func (wl *watchlist) match(name string) (string, bool) {
+	name = normalizeName(name)
+	for _, parent := range parentNames(name) {
+		if source, ok := wl.domains[parent]; ok {
+			return source, true
+		}
+	}
+	for _, r := range wl.rules {
+		if r.re != nil && r.re.MatchString(name) {
+			return r.pattern, true
+		}
+		if ok, _ := path.Match(r.glob, name); r.glob != "" && ok {
+			return r.pattern, true
+		}
+	}
+	return "", false
+}
+
+// check raises an alert if the query is on the watchlist.
+func (wl *watchlist) check(e queryEntry) {
+	if len(wl.domains) == 0 && len(wl.rules) == 0 {
+		return
+	}
+	rule, ok := wl.match(e.Name)
+	if !ok {
+		return
+	}
+	key := [2]string{clientHost(e.Client), normalizeName(e.Name)}
+	wl.Lock()
+	last, seen := wl.seen[key]
+	if seen && e.Time.Sub(last) < watchQuiet {
+		wl.Unlock()
+		return
+	}
+	wl.seen[key] = e.Time
+	// Forget about the oldest alerts once in a while.
+	if len(wl.seen) > 10000 {
+		for k, t := range wl.seen {
+			if e.Time.Sub(t) >= watchQuiet {
+				delete(wl.seen, k)
+			}
+		}
+	}
+	wl.Unlock()
+	alert("query_match",
+		fmt.Sprintf("%s asked for %s %s", key[0], e.Name, e.Type),
+		map[string]string{
+			"client": key[0],
+			"name":   e.Name,
+			"type":   e.Type,
+			"rule":   rule,
+		})
+}